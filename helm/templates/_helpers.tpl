@@ -56,3 +56,25 @@ Create the name of the service account to use
 {{- define "gitlab-workspaces-proxy.serviceAccountName" -}}
 {{- default (include "gitlab-workspaces-proxy.fullname" .) .Values.serviceAccount.name }}
 {{- end }}
+
+{{/*
+RBAC rules of the proxy, granted cluster wide or per watched namespace
+*/}}
+{{- define "gitlab-workspaces-proxy.rbacRules" -}}
+- apiGroups: [""]
+  resources: ["services"]
+  verbs: ["get", "watch", "list"{{ if .Values.activity.annotate_services }}, "patch"{{ end }}]
+- apiGroups: [""]
+  resources: ["events"]
+  verbs: ["create", "patch", "update"]
+{{- if .Values.discovery.kubernetes.watch_endpoints }}
+- apiGroups: ["discovery.k8s.io"]
+  resources: ["endpointslices"]
+  verbs: ["get", "watch", "list"]
+{{- end }}
+{{- if .Values.rbac.readSecrets }}
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: ["get"]
+{{- end }}
+{{- end }}
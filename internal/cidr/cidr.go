@@ -0,0 +1,76 @@
+package cidr
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Set is a list of networks, e.g. the load balancers or ingress pods whose
+// connection metadata the proxy trusts.
+type Set []*net.IPNet
+
+// Parse parses CIDRs such as "10.0.0.0/8". Plain IP addresses are accepted
+// and treated as a single host network.
+func Parse(cidrs []string) (Set, error) {
+	set := make(Set, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			set = append(set, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		set = append(set, network)
+	}
+	return set, nil
+}
+
+func (s Set) Contains(ip net.IP) bool {
+	for _, network := range s {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr reports whether the IP of a TCP or UDP address, or of a
+// "host:port" string, is part of the set.
+func (s Set) ContainsAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return s.Contains(a.IP)
+	case *net.UDPAddr:
+		return s.Contains(a.IP)
+	case nil:
+		return false
+	default:
+		return s.ContainsHostPort(addr.String())
+	}
+}
+
+func (s Set) ContainsHostPort(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return s.Contains(ip)
+}
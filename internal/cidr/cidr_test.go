@@ -0,0 +1,64 @@
+package cidr
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSet(t *testing.T) {
+	tt := []struct {
+		description    string
+		cidrs          []string
+		address        string
+		expectedError  bool
+		expectedResult bool
+	}{
+		{
+			description:    "When the address is inside a network returns true",
+			cidrs:          []string{"10.0.0.0/8"},
+			address:        "10.1.2.3:1234",
+			expectedResult: true,
+		},
+		{
+			description:    "When the address is outside every network returns false",
+			cidrs:          []string{"10.0.0.0/8", "192.168.0.0/16"},
+			address:        "172.16.0.1:1234",
+			expectedResult: false,
+		},
+		{
+			description:    "When a plain IP is configured matches only that IP",
+			cidrs:          []string{"192.168.1.1"},
+			address:        "192.168.1.1:22",
+			expectedResult: true,
+		},
+		{
+			description:    "When an IPv6 network is configured matches IPv6 addresses",
+			cidrs:          []string{"fd00::/8"},
+			address:        "[fd00::1]:443",
+			expectedResult: true,
+		},
+		{
+			description:   "When a CIDR is invalid returns error",
+			cidrs:         []string{"10.0.0.0/33"},
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			set, err := Parse(tr.cidrs)
+			if tr.expectedError {
+				require.Error(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			addr, err := net.ResolveTCPAddr("tcp", tr.address)
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, set.ContainsAddr(addr))
+			require.Equal(t, tr.expectedResult, set.ContainsHostPort(tr.address))
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package logz
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// secretNames are the identifiers which hold credentials in this repository.
+// Passing them to a field which logs its value verbatim leaks them.
+var secretNames = map[string]bool{ //nolint:gochecknoglobals
+	"AccessToken":  true,
+	"ClientSecret": true,
+	"HostKey":      true,
+	"IDToken":      true,
+	"Password":     true,
+	"PrivateKey":   true,
+	"RefreshToken": true,
+	"SigningKey":   true,
+	"Token":        true,
+	"accessToken":  true,
+	"password":     true,
+	"signedJwt":    true,
+}
+
+// secretFields fingerprint or redact their argument instead of logging it.
+var secretFields = map[string]bool{ //nolint:gochecknoglobals
+	"Secret":     true,
+	"SSHHostKey": true,
+}
+
+// findSecretFields reports log fields in the file which are given a secret.
+func findSecretFields(fset *token.FileSet, file *ast.File) []string {
+	var findings []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		fun, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		pkg, ok := fun.X.(*ast.Ident)
+		if !ok || (pkg.Name != "zap" && pkg.Name != "logz") || secretFields[fun.Sel.Name] {
+			return true
+		}
+
+		for _, arg := range call.Args {
+			// Selectors such as cfg.HostKey are covered through their Sel identifier
+			ast.Inspect(arg, func(n ast.Node) bool {
+				if ident, ok := n.(*ast.Ident); ok && secretNames[ident.Name] {
+					findings = append(findings, fset.Position(call.Pos()).String()+": "+ident.Name+" passed to "+pkg.Name+"."+fun.Sel.Name)
+				}
+				return true
+			})
+		}
+		return true
+	})
+	return findings
+}
+
+func TestNoSecretsInRawFields(t *testing.T) {
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	require.Nil(t, err)
+
+	var findings []string
+	fset := token.NewFileSet()
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == "vendor" || strings.HasPrefix(d.Name(), ".")) && path != root {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		file, parseErr := parser.ParseFile(fset, path, nil, 0)
+		if parseErr != nil {
+			return parseErr
+		}
+		findings = append(findings, findSecretFields(fset, file)...)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Empty(t, findings, "log secrets through logz.Secret or a redacting field instead")
+}
+
+func TestFindSecretFields(t *testing.T) {
+	src := `package example
+
+func log(cfg config, logger *zap.Logger) {
+	logger.Error("failed", logz.SSHHostKey(cfg.HostKey))
+	logger.Error("failed", zap.String("key", cfg.SSH.HostKey))
+	logger.Debug("token", logz.WorkspaceName(token.AccessToken))
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "example.go", src, 0)
+	require.Nil(t, err)
+
+	findings := findSecretFields(fset, file)
+	require.Len(t, findings, 2)
+	require.Contains(t, findings[0], "HostKey passed to zap.String")
+	require.Contains(t, findings[1], "AccessToken passed to logz.WorkspaceName")
+}
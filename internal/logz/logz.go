@@ -1,31 +1,23 @@
 package logz
 
-import "go.uber.org/zap"
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
 
 func Error(err error) zap.Field {
 	return zap.Error(err)
 }
 
-func SSHHostKey(key string) zap.Field {
-	return zap.String("ssh_host_key", key)
-}
-
 func WorkspaceName(name string) zap.Field {
 	return zap.String("workspace_name", name)
 }
 
-func WorkspaceURL(url string) zap.Field {
-	return zap.String("workspace_url", url)
-}
-
 func WorkspaceHostTemplate(template string) zap.Field {
 	return zap.String("workspace_host_template", template)
 }
 
-func WorkspaceHostTemplateData(data map[string]string) zap.Field {
-	return zap.Any("workspace_host_template_data", data)
-}
-
 func ServiceName(name string) zap.Field {
 	return zap.String("service_name", name)
 }
@@ -34,6 +26,10 @@ func ServiceNamespace(namespace string) zap.Field {
 	return zap.String("service_namespace", namespace)
 }
 
+func SecretName(name string) zap.Field {
+	return zap.String("secret_name", name)
+}
+
 func HostMappingHostname(hostname string) zap.Field {
 	return zap.String("host_mapping_hostname", hostname)
 }
@@ -46,6 +42,10 @@ func HostMappingBackendPort(port int32) zap.Field {
 	return zap.Int32("host_mapping_backend_port", port)
 }
 
+func HostMappingPortName(name string) zap.Field {
+	return zap.String("host_mapping_port_name", name)
+}
+
 func HostMappingBackendProtocol(protocol string) zap.Field {
 	return zap.String("host_mapping_protocol", protocol)
 }
@@ -58,6 +58,10 @@ func HTTPIp(ip string) zap.Field {
 	return zap.String("http_ip", ip)
 }
 
+func RemoteAddr(addr string) zap.Field {
+	return zap.String("remote_addr", addr)
+}
+
 func HTTPStatus(status int) zap.Field {
 	return zap.Int("http_status", status)
 }
@@ -77,3 +81,71 @@ func HTTPScheme(scheme string) zap.Field {
 func Port(port int) zap.Field {
 	return zap.Int("port", port)
 }
+
+func UpstreamErrorKind(kind string) zap.Field {
+	return zap.String("upstream_error_kind", kind)
+}
+
+func UpstreamAttempt(attempt int) zap.Field {
+	return zap.Int("upstream_attempt", attempt)
+}
+
+func RequestID(id string) zap.Field {
+	return zap.String("request_id", id)
+}
+
+func HTTPQuery(query string) zap.Field {
+	return zap.String("http_query", query)
+}
+
+func HTTPDuration(duration time.Duration) zap.Field {
+	return zap.Duration("http_duration", duration)
+}
+
+func HTTPResponseBytes(bytes int64) zap.Field {
+	return zap.Int64("http_response_bytes", bytes)
+}
+
+func HTTPUserAgent(userAgent string) zap.Field {
+	return zap.String("http_user_agent", userAgent)
+}
+
+func Username(username string) zap.Field {
+	return zap.String("username", username)
+}
+
+func WorkspaceID(id string) zap.Field {
+	return zap.String("workspace_id", id)
+}
+
+func Upstream(upstream string) zap.Field {
+	return zap.String("upstream", upstream)
+}
+
+func Websocket(websocket bool) zap.Field {
+	return zap.Bool("websocket", websocket)
+}
+
+func WebsocketDuration(duration time.Duration) zap.Field {
+	return zap.Duration("websocket_duration", duration)
+}
+
+func SessionCount(count int) zap.Field {
+	return zap.Int("session_count", count)
+}
+
+func FilePath(path string) zap.Field {
+	return zap.String("file_path", path)
+}
+
+func Cluster(name string) zap.Field {
+	return zap.String("cluster", name)
+}
+
+func ConflictingCluster(name string) zap.Field {
+	return zap.String("conflicting_cluster", name)
+}
+
+func ConflictingWorkspaceName(name string) zap.Field {
+	return zap.String("conflicting_workspace_name", name)
+}
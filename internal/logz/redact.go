@@ -0,0 +1,155 @@
+package logz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/ssh"
+)
+
+// Redacted replaces values which must not be logged.
+const Redacted = "REDACTED"
+
+// fingerprintBytes is the length of the hash prefix logged for secrets. It is
+// enough to tell two secrets apart without making them guessable.
+const fingerprintBytes = 8
+
+// Redaction lists the query parameters and headers, matched
+// case-insensitively, whose values never reach the logs.
+type Redaction struct {
+	QueryParams []string `yaml:"query_params"`
+	Headers     []string `yaml:"headers"`
+}
+
+// DefaultRedaction covers the credentials seen by the proxy, including the
+// OAuth code received on the auth callback and the session cookie.
+func DefaultRedaction() Redaction {
+	return Redaction{
+		QueryParams: []string{"access_token", "code", "id_token", "password", "private_token", "refresh_token", "secret", "token"},
+		Headers:     []string{"Authorization", "Cookie", "Private-Token", "Proxy-Authorization", "Set-Cookie"},
+	}
+}
+
+// Redactor replaces the values of denylisted query parameters and headers.
+// A nil Redactor uses DefaultRedaction.
+type Redactor struct {
+	queryParams map[string]bool
+	headers     map[string]bool
+}
+
+// defaultRedactor backs nil Redactors, it is never modified.
+var defaultRedactor = sync.OnceValue(func() *Redactor { //nolint:gochecknoglobals
+	return NewRedactor(DefaultRedaction())
+})
+
+func NewRedactor(redaction Redaction) *Redactor {
+	r := &Redactor{
+		queryParams: make(map[string]bool),
+		headers:     make(map[string]bool),
+	}
+	for _, param := range redaction.QueryParams {
+		r.queryParams[strings.ToLower(param)] = true
+	}
+	for _, header := range redaction.Headers {
+		r.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	return r
+}
+
+func (r *Redactor) orDefault() *Redactor {
+	if r == nil {
+		return defaultRedactor()
+	}
+	return r
+}
+
+// Fingerprint identifies a secret in the logs without revealing it.
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:fingerprintBytes])
+}
+
+// Secret logs the fingerprint of a secret under key.
+func Secret(key string, secret string) zap.Field {
+	return zap.String(key+"_fingerprint", Fingerprint(secret))
+}
+
+// SSHHostKey logs the fingerprint of the public key of a private host key.
+// Keys which cannot be parsed are logged as a hash.
+func SSHHostKey(key string) zap.Field {
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	if err != nil {
+		return Secret("ssh_host_key", key)
+	}
+	return zap.String("ssh_host_key_fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+}
+
+// Query replaces the values of denylisted parameters in a raw query. The
+// order and encoding of the other parameters are kept.
+func (r *Redactor) Query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	queryParams := r.orDefault().queryParams
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if queryParams[strings.ToLower(name)] {
+			pairs[i] = key + "=" + Redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// URL replaces the values of denylisted query parameters in a URL.
+func (r *Redactor) URL(rawURL string) string {
+	path, rawQuery, found := strings.Cut(rawURL, "?")
+	if !found {
+		return rawURL
+	}
+	return path + "?" + r.Query(rawQuery)
+}
+
+// WorkspaceURL logs a workspace URL with denylisted query parameters redacted.
+func (r *Redactor) WorkspaceURL(url string) zap.Field {
+	return zap.String("workspace_url", r.URL(url))
+}
+
+// HTTPHeaders logs request or response headers with denylisted values redacted.
+func (r *Redactor) HTTPHeaders(header http.Header) zap.Field {
+	return zap.Object("http_headers", redactedHeaders{header: header, denylist: r.orDefault().headers})
+}
+
+type redactedHeaders struct {
+	header   http.Header
+	denylist map[string]bool
+}
+
+func (h redactedHeaders) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	names := make([]string, 0, len(h.header))
+	for name := range h.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := strings.Join(h.header[name], ", ")
+		if h.denylist[http.CanonicalHeaderKey(name)] {
+			value = Redacted
+		}
+		enc.AddString(name, value)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package logz
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRedactURL(t *testing.T) {
+	tt := []struct {
+		description    string
+		url            string
+		expectedResult string
+	}{
+		{
+			description:    "When the url has no query returns it unchanged",
+			url:            "https://workspace1.workspaces.com/files",
+			expectedResult: "https://workspace1.workspaces.com/files",
+		},
+		{
+			description:    "When the query has denylisted parameters redacts their values",
+			url:            "https://workspaces.com/callback?code=abc&state=https%3A%2F%2Fworkspace1&Private_Token=xyz",
+			expectedResult: "https://workspaces.com/callback?code=REDACTED&state=https%3A%2F%2Fworkspace1&Private_Token=REDACTED",
+		},
+		{
+			description:    "When a denylisted parameter has no value redacts it",
+			url:            "https://workspace1.workspaces.com/?token",
+			expectedResult: "https://workspace1.workspaces.com/?token=REDACTED",
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			var redactor *Redactor
+			require.Equal(t, tr.expectedResult, redactor.URL(tr.url))
+		})
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	redactor := NewRedactor(Redaction{QueryParams: []string{"session"}, Headers: []string{"X-Session"}})
+
+	require.Equal(t, "/?session=REDACTED&code=abc", redactor.URL("/?session=1&code=abc"))
+
+	core, logs := observer.New(zap.InfoLevel)
+	zap.New(core).Info("headers", redactor.HTTPHeaders(http.Header{
+		"X-Session":     []string{"secret"},
+		"Authorization": []string{"Bearer abc"},
+	}))
+	require.Equal(t, map[string]interface{}{
+		"X-Session":     Redacted,
+		"Authorization": "Bearer abc",
+	}, logs.All()[0].ContextMap()["http_headers"])
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	var redactor *Redactor
+	core, logs := observer.New(zap.InfoLevel)
+	zap.New(core).Info("headers", redactor.HTTPHeaders(http.Header{
+		"Authorization": []string{"Bearer abc"},
+		"Cookie":        []string{"gitlab-workspace-session=abc"},
+		"Accept":        []string{"text/html", "application/json"},
+	}))
+
+	require.Equal(t, map[string]interface{}{
+		"Accept":        "text/html, application/json",
+		"Authorization": Redacted,
+		"Cookie":        Redacted,
+	}, logs.All()[0].ContextMap()["http_headers"])
+}
+
+func TestSSHHostKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	require.Nil(t, err)
+	hostKey := string(pem.EncodeToMemory(block))
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	require.Nil(t, err)
+
+	field := SSHHostKey(hostKey)
+	require.Equal(t, "ssh_host_key_fingerprint", field.Key)
+	require.Equal(t, ssh.FingerprintSHA256(signer.PublicKey()), field.String)
+
+	field = SSHHostKey("not a key")
+	require.Equal(t, "ssh_host_key_fingerprint", field.Key)
+	require.Equal(t, Fingerprint("not a key"), field.String)
+	require.True(t, strings.HasPrefix(field.String, "sha256:"))
+	require.NotContains(t, field.String, "not a key")
+}
@@ -1,29 +1,29 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
-	"text/template"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/auth"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/discovery"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/k8s"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/logging"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/server"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
 	"go.uber.org/zap"
-	v1 "k8s.io/api/core/v1"
-)
-
-const (
-	workspaceHostTemplateAnnotation = "workspaces.gitlab.com/host-template"
-	workspaceIDAnnotation           = "workspaces.gitlab.com/id"
 )
 
 func main() { //nolint:cyclop
@@ -61,9 +61,46 @@ func main() { //nolint:cyclop
 		}
 	}()
 
-	k8sClient, err := k8s.New(logger, *kubeconfig)
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "failed to create kubernetes client %s", err)
+		_, _ = fmt.Fprintf(os.Stderr, "failed to set up tracing %s", err)
+		os.Exit(-1)
+	}
+	defer func() {
+		if shutdownErr := shutdownTracing(ctx); shutdownErr != nil {
+			logger.Error("failed to flush traces", logz.Error(shutdownErr))
+		}
+	}()
+
+	var providers []discovery.Provider
+	// annotators hold the Kubernetes client of every watched cluster
+	annotators := make(map[string]activity.ServiceAnnotator)
+	kubernetesProviders := make(map[string]*discovery.KubernetesProvider)
+	switch cfg.Discovery.Provider {
+	case discovery.ProviderStatic:
+		providers = append(providers, discovery.NewStaticProvider(logger, cfg.Discovery.Static))
+	default:
+		clusters := cfg.Discovery.Kubernetes.Clusters
+		if len(clusters) == 0 {
+			clusters = []k8s.ClusterConfig{{Kubeconfig: *kubeconfig}}
+		}
+
+		for _, cluster := range clusters {
+			k8sClient, err := k8s.New(logger, cluster, cfg.Discovery.Kubernetes.WatchConfig, cfg.Discovery.Kubernetes.EventInterval)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "failed to create kubernetes client for cluster %q %s", cluster.Name, err)
+				os.Exit(-1)
+			}
+			annotators[cluster.Name] = k8sClient
+			kubernetesProviders[cluster.Name] = discovery.NewKubernetesProvider(logger, k8sClient, cluster.Name, cfg.Discovery.Kubernetes)
+			providers = append(providers, kubernetesProviders[cluster.Name])
+		}
+	}
+	eventRecorder := discovery.NewEventRecorder(kubernetesProviders)
+
+	backendRootCAs, err := server.LoadBackendRootCAs(cfg.HTTP.BackendTLS.CAFile)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to load backend CA file %s", err)
 		os.Exit(-1)
 	}
 
@@ -71,55 +108,63 @@ func main() { //nolint:cyclop
 		return gitlab.NewClient(logger, accessToken, cfg.Auth.Host, gitlab.BearerTokenType)
 	}
 
+	trustedProxies, err := cidr.Parse(cfg.HTTP.TrustedProxies)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to parse trusted proxies %s", err)
+		os.Exit(-1)
+	}
+
 	upstreamTracker := upstream.NewTracker(logger)
-	loggingMiddleware := logging.NewMiddleware(logger)
-	authMiddleware := auth.NewMiddleware(logger, &cfg.Auth, upstreamTracker, apiFactory)
+	activityTracker := activity.NewTracker()
+	workspaceLabelLimiter := cardinality.NewLimiter(cfg.MetricsWorkspaceLabelLimit)
+	prometheus.MustRegister(activity.NewCollector(activityTracker, workspaceLabelLimiter))
+	clientInfoMiddleware := clientinfo.NewMiddleware(trustedProxies)
+	requestIDMiddleware := requestid.NewMiddleware(trustedProxies)
+	logRedactor := logz.NewRedactor(cfg.LogRedaction)
+	loggingMiddleware, err := logging.NewMiddleware(logger, cfg.AccessLog, logRedactor, os.Stdout)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to configure access log %s", err)
+		os.Exit(-1)
+	}
+	resolver := routing.NewResolver(cfg.HTTP.Routing.Mode, cfg.HTTP.Routing.PathPrefix, upstreamTracker)
+	authMetrics := auth.NewMetrics(prometheus.DefaultRegisterer, workspaceLabelLimiter)
+	authMiddleware := auth.NewMiddleware(logger, logRedactor, &cfg.Auth, resolver, authMetrics, apiFactory, eventRecorder)
 
 	opts := &server.Options{
-		HTTPConfig:        cfg.HTTP,
-		SSHConfig:         cfg.SSH,
-		LoggingMiddleware: loggingMiddleware,
-		AuthMiddleware:    authMiddleware,
-		Logger:            logger,
-		Tracker:           upstreamTracker,
-		MetricsPath:       cfg.MetricsPath,
-		APIFactory:        apiFactory,
+		HTTPConfig:            cfg.HTTP,
+		SSHConfig:             cfg.SSH,
+		ClientInfoMiddleware:  clientInfoMiddleware,
+		RequestIDMiddleware:   requestIDMiddleware,
+		LoggingMiddleware:     loggingMiddleware,
+		AuthMiddleware:        authMiddleware,
+		Logger:                logger,
+		Tracker:               upstreamTracker,
+		MetricsPath:           cfg.MetricsPath,
+		MetricsRegisterer:     prometheus.DefaultRegisterer,
+		WorkspaceLabelLimiter: workspaceLabelLimiter,
+		APIFactory:            apiFactory,
+		BackendRootCAs:        backendRootCAs,
+		AdminConfig:           cfg.Admin,
+		Activity:              activityTracker,
+		EventRecorder:         eventRecorder,
 	}
 
 	s := server.New(opts)
 
-	err = k8sClient.GetService(ctx, func(action k8s.InformerAction, svc *v1.Service) {
-		workspaceHostTemplate := svc.Annotations[workspaceHostTemplateAnnotation]
-		workspaceID := svc.Annotations[workspaceIDAnnotation]
-
-		if workspaceHostTemplate == "" {
-			logger.Error("workspace host template annotation not available on kubernetes service",
-				logz.ServiceName(svc.Name),
-				logz.ServiceNamespace(svc.Namespace),
-			)
-			return
-		}
+	go activity.ForgetRemovedWorkspaces(ctx, upstreamTracker.Subscribe(upstream.DefaultSubscriptionBuffer), upstreamTracker, activityTracker, workspaceLabelLimiter)
 
-		if workspaceID == "" {
-			logger.Error("workspace id annotation not available on kubernetes service",
-				logz.ServiceName(svc.Name),
-				logz.ServiceNamespace(svc.Namespace),
-			)
+	for _, provider := range providers {
+		err = provider.Start(ctx, upstreamTracker)
+		if err != nil {
+			logger.Error("failed to start workspace discovery", logz.Error(err))
 			return
 		}
+	}
 
-		switch action {
-		case k8s.InformerActionAdd:
-			addPorts(workspaceID, workspaceHostTemplate, upstreamTracker, svc, logger)
-		case k8s.InformerActionUpdate:
-			addPorts(workspaceID, workspaceHostTemplate, upstreamTracker, svc, logger)
-		case k8s.InformerActionDelete:
-			upstreamTracker.DeleteByHostname(workspaceHostTemplate)
-		}
-	})
-	if err != nil {
-		logger.Error("failed to start informer", logz.Error(err))
-		return
+	// Services can only be annotated when they are discovered from Kubernetes
+	if cfg.Activity.AnnotateServices && len(annotators) > 0 {
+		reporter := activity.NewReporter(logger, activityTracker, upstreamTracker, annotators, cfg.Activity.AnnotationInterval)
+		go reporter.Run(ctx)
 	}
 
 	err = s.Start(ctx)
@@ -127,37 +172,3 @@ func main() { //nolint:cyclop
 		logger.Error("failed to start server", logz.Error(err))
 	}
 }
-
-func addPorts(workspaceID string, workspaceHostTemplate string, tracker *upstream.Tracker, svc *v1.Service, logger *zap.Logger) {
-	for _, port := range svc.Spec.Ports {
-		t, err := template.New("workspaceHostTemplate").Parse(workspaceHostTemplate)
-		if err != nil {
-			logger.Error(
-				"failed to parse workspace host template", logz.Error(err),
-				logz.WorkspaceHostTemplate(workspaceHostTemplate),
-			)
-			return
-		}
-		var h bytes.Buffer
-		data := map[string]string{"port": strconv.Itoa(port.TargetPort.IntValue())}
-		err = t.Execute(&h, data)
-		if err != nil {
-			logger.Error(
-				"failed to patch values in workspace host template",
-				logz.Error(err),
-				logz.WorkspaceHostTemplate(workspaceHostTemplate),
-				logz.WorkspaceHostTemplateData(data),
-			)
-			return
-		}
-
-		tracker.Add(upstream.HostMapping{
-			Hostname:        h.String(),
-			BackendPort:     port.Port,
-			Backend:         fmt.Sprintf("%s.%s", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace),
-			BackendProtocol: "http",
-			WorkspaceID:     workspaceID,
-			WorkspaceName:   svc.ObjectMeta.Name,
-		})
-	}
-}
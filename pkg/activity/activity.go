@@ -0,0 +1,153 @@
+// Package activity records when each workspace was last used through the
+// proxy, so that idle workspaces can be found and stopped.
+package activity
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// touchResolution is how precisely activity is recorded. Traffic within it
+// of the recorded time does not update it, so that busy connections do not
+// write on every read.
+const touchResolution = time.Second
+
+// Tracker keeps the last time traffic was seen per workspace name. The map is
+// only locked for writing when a workspace is first seen or forgotten, the
+// time itself is updated atomically.
+type Tracker struct {
+	now        func() time.Time
+	lastActive map[string]*atomic.Int64
+	sync.RWMutex
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		now:        time.Now,
+		lastActive: make(map[string]*atomic.Int64),
+	}
+}
+
+// Workspace is the activity of a single workspace.
+type Workspace struct {
+	WorkspaceName string    `json:"workspace_name"`
+	LastActiveAt  time.Time `json:"last_active_at"`
+	IdleSeconds   int64     `json:"idle_seconds"`
+}
+
+// Touch records traffic for the workspace.
+func (t *Tracker) Touch(workspaceName string) {
+	if workspaceName == "" {
+		return
+	}
+
+	now := t.now().UnixNano()
+	t.RLock()
+	lastActive, ok := t.lastActive[workspaceName]
+	t.RUnlock()
+	if !ok {
+		t.Lock()
+		if lastActive, ok = t.lastActive[workspaceName]; !ok {
+			lastActive = &atomic.Int64{}
+			t.lastActive[workspaceName] = lastActive
+		}
+		t.Unlock()
+	}
+
+	for {
+		last := lastActive.Load()
+		if last != 0 && now-last < int64(touchResolution) {
+			return
+		}
+		if lastActive.CompareAndSwap(last, now) {
+			return
+		}
+	}
+}
+
+// Forget drops the workspace, e.g. once it has been removed.
+func (t *Tracker) Forget(workspaceName string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.lastActive, workspaceName)
+}
+
+func (t *Tracker) Get(workspaceName string) (Workspace, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	lastActive, ok := t.lastActive[workspaceName]
+	if !ok {
+		return Workspace{}, false
+	}
+	return t.workspace(workspaceName, time.Unix(0, lastActive.Load())), true
+}
+
+// List returns the activity of every workspace sorted by name.
+func (t *Tracker) List() []Workspace {
+	t.RLock()
+	defer t.RUnlock()
+	result := make([]Workspace, 0, len(t.lastActive))
+	for name, lastActive := range t.lastActive {
+		result = append(result, t.workspace(name, time.Unix(0, lastActive.Load())))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].WorkspaceName < result[j].WorkspaceName
+	})
+	return result
+}
+
+func (t *Tracker) workspace(name string, lastActive time.Time) Workspace {
+	return Workspace{
+		WorkspaceName: name,
+		LastActiveAt:  lastActive.UTC(),
+		IdleSeconds:   int64(t.now().Sub(lastActive).Seconds()),
+	}
+}
+
+// Reader touches the workspace whenever data is read, e.g. from an SSH channel.
+func (t *Tracker) Reader(workspaceName string, r io.Reader) io.Reader {
+	return &reader{Reader: r, touch: func() { t.Touch(workspaceName) }}
+}
+
+// ReadWriteCloser touches the workspace whenever data passes in either
+// direction, e.g. websocket frames on an upgraded connection.
+func (t *Tracker) ReadWriteCloser(workspaceName string, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &readWriteCloser{ReadWriteCloser: rwc, touch: func() { t.Touch(workspaceName) }}
+}
+
+type reader struct {
+	io.Reader
+	touch func()
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
+
+type readWriteCloser struct {
+	io.ReadWriteCloser
+	touch func()
+}
+
+func (c *readWriteCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *readWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
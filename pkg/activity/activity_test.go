@@ -0,0 +1,131 @@
+package activity
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestTracker() (*Tracker, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)}
+	tracker := NewTracker()
+	tracker.now = clock.Now
+	return tracker, clock
+}
+
+func TestTracker(t *testing.T) {
+	tracker, clock := newTestTracker()
+	start := clock.now
+
+	tracker.Touch("workspace2")
+	clock.now = clock.now.Add(time.Minute)
+	tracker.Touch("workspace1")
+	tracker.Touch("")
+	clock.now = clock.now.Add(time.Minute)
+
+	require.Equal(t, []Workspace{
+		{WorkspaceName: "workspace1", LastActiveAt: start.Add(time.Minute), IdleSeconds: 60},
+		{WorkspaceName: "workspace2", LastActiveAt: start, IdleSeconds: 120},
+	}, tracker.List())
+
+	workspace, ok := tracker.Get("workspace2")
+	require.True(t, ok)
+	require.Equal(t, start, workspace.LastActiveAt)
+
+	tracker.Forget("workspace2")
+	_, ok = tracker.Get("workspace2")
+	require.False(t, ok)
+}
+
+func TestTrackerTouchResolution(t *testing.T) {
+	tracker, clock := newTestTracker()
+	start := clock.now
+
+	tracker.Touch("workspace1")
+	clock.now = start.Add(touchResolution / 2)
+	tracker.Touch("workspace1")
+	workspace, ok := tracker.Get("workspace1")
+	require.True(t, ok)
+	require.Equal(t, start, workspace.LastActiveAt, "traffic within the resolution is not recorded")
+
+	clock.now = start.Add(touchResolution)
+	tracker.Touch("workspace1")
+	workspace, ok = tracker.Get("workspace1")
+	require.True(t, ok)
+	require.Equal(t, start.Add(touchResolution), workspace.LastActiveAt)
+}
+
+func TestReader(t *testing.T) {
+	tracker, _ := newTestTracker()
+
+	_, err := io.Copy(io.Discard, tracker.Reader("workspace1", strings.NewReader("")))
+	require.Nil(t, err)
+	_, ok := tracker.Get("workspace1")
+	require.False(t, ok, "reading nothing is not activity")
+
+	_, err = io.Copy(io.Discard, tracker.Reader("workspace1", strings.NewReader("ls -la\n")))
+	require.Nil(t, err)
+	_, ok = tracker.Get("workspace1")
+	require.True(t, ok)
+}
+
+type nopReadWriteCloser struct {
+	io.Reader
+	io.Writer
+}
+
+func (nopReadWriteCloser) Close() error { return nil }
+
+func TestReadWriteCloser(t *testing.T) {
+	tracker, _ := newTestTracker()
+	var written bytes.Buffer
+	rwc := tracker.ReadWriteCloser("workspace1", nopReadWriteCloser{Reader: strings.NewReader(""), Writer: &written})
+
+	_, err := rwc.Write([]byte("frame"))
+	require.Nil(t, err)
+	require.Equal(t, "frame", written.String())
+	_, ok := tracker.Get("workspace1")
+	require.True(t, ok)
+}
+
+func TestCollector(t *testing.T) {
+	tracker, _ := newTestTracker()
+	tracker.Touch("workspace1")
+
+	expected := `
+# HELP gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds Unix time of the last HTTP, websocket or SSH traffic of a workspace.
+# TYPE gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds gauge
+gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds{workspace="workspace1"} 1.6829352e+09
+`
+	require.Nil(t, testutil.CollectAndCompare(NewCollector(tracker, nil), strings.NewReader(expected)))
+}
+
+func TestCollectorWithLabelLimit(t *testing.T) {
+	tracker, clock := newTestTracker()
+	tracker.Touch("workspace1")
+	clock.now = clock.now.Add(time.Minute)
+	tracker.Touch("workspace3")
+	tracker.Touch("workspace2")
+
+	expected := `
+# HELP gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds Unix time of the last HTTP, websocket or SSH traffic of a workspace.
+# TYPE gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds gauge
+gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds{workspace="other"} 1.68293526e+09
+gitlab_workspaces_proxy_workspace_last_activity_timestamp_seconds{workspace="workspace1"} 1.6829352e+09
+`
+	require.Nil(t, testutil.CollectAndCompare(NewCollector(tracker, cardinality.NewLimiter(1)), strings.NewReader(expected)))
+}
@@ -0,0 +1,47 @@
+package activity
+
+import (
+	"context"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+// ForgetRemovedWorkspaces drops the activity and metric label of workspaces
+// once their last port is removed, until the context is done.
+func ForgetRemovedWorkspaces(ctx context.Context, sub *upstream.Subscription, tracker *upstream.Tracker, activity *Tracker, limiter *cardinality.Limiter) {
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+
+			switch event.Type {
+			case upstream.EventRemoved:
+				forgetIfRemoved(tracker, activity, limiter, event.Before.WorkspaceName)
+			case upstream.EventResync:
+				// Removals may have been dropped, check every known workspace
+				for _, workspace := range activity.List() {
+					forgetIfRemoved(tracker, activity, limiter, workspace.WorkspaceName)
+				}
+				for _, workspaceName := range limiter.Values() {
+					forgetIfRemoved(tracker, activity, limiter, workspaceName)
+				}
+			}
+		}
+	}
+}
+
+// forgetIfRemoved keeps workspaces which still expose other ports.
+func forgetIfRemoved(tracker *upstream.Tracker, activity *Tracker, limiter *cardinality.Limiter, workspaceName string) {
+	if _, err := tracker.GetWorkspaceByName(workspaceName); err == nil {
+		return
+	}
+	activity.Forget(workspaceName)
+	limiter.Forget(workspaceName)
+}
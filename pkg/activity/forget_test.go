@@ -0,0 +1,54 @@
+package activity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestForgetRemovedWorkspaces(t *testing.T) {
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace1", WorkspaceName: "workspace1", BackendPort: 3000})
+	tracker.Add(upstream.HostMapping{Hostname: "8080-workspace1", WorkspaceName: "workspace1", BackendPort: 8080})
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace2", WorkspaceName: "workspace2", BackendPort: 3000})
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace3", WorkspaceName: "workspace3", BackendPort: 3000})
+
+	activity, _ := newTestTracker()
+	limiter := cardinality.NewLimiter(10)
+	for _, name := range []string{"workspace1", "workspace2", "workspace3"} {
+		activity.Touch(name)
+		limiter.Value(name)
+	}
+
+	// The subscriber falls behind, the removal of workspace3 is dropped
+	sub := tracker.Subscribe(2)
+	tracker.DeleteByHostname("3000-workspace1")
+	tracker.DeleteByHostname("3000-workspace2")
+	tracker.DeleteByHostname("3000-workspace3")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ForgetRemovedWorkspaces(ctx, sub, tracker, activity, limiter)
+
+	require.Eventually(t, func() bool {
+		_, ok := activity.Get("workspace2")
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The next change delivers the resync
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace4", WorkspaceName: "workspace4", BackendPort: 3000})
+	require.Eventually(t, func() bool {
+		_, ok := activity.Get("workspace3")
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// workspace1 still exposes a port
+	_, ok := activity.Get("workspace1")
+	require.True(t, ok)
+	require.Equal(t, []string{"workspace1"}, limiter.Values())
+}
@@ -0,0 +1,55 @@
+package activity
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+)
+
+const metricsNamespace = "gitlab_workspaces_proxy"
+
+type collector struct {
+	tracker    *Tracker
+	workspaces *cardinality.Limiter
+	desc       *prometheus.Desc
+}
+
+// NewCollector exposes the last activity of each workspace as a unix timestamp.
+// Workspaces beyond the label limit are reported together with the most
+// recent activity among them.
+func NewCollector(tracker *Tracker, workspaces *cardinality.Limiter) prometheus.Collector {
+	return &collector{
+		tracker:    tracker,
+		workspaces: workspaces,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "workspace_last_activity_timestamp_seconds"),
+			"Unix time of the last HTTP, websocket or SSH traffic of a workspace.",
+			[]string{"workspace"},
+			nil,
+		),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	lastActive := make(map[string]time.Time)
+	for _, workspace := range c.tracker.List() {
+		label := c.workspaces.Value(workspace.WorkspaceName)
+		if workspace.LastActiveAt.After(lastActive[label]) {
+			lastActive[label] = workspace.LastActiveAt
+		}
+	}
+
+	for label, at := range lastActive {
+		ch <- prometheus.MustNewConstMetric(
+			c.desc,
+			prometheus.GaugeValue,
+			float64(at.UnixNano())/1e9,
+			label,
+		)
+	}
+}
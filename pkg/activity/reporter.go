@@ -0,0 +1,105 @@
+package activity
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap"
+)
+
+// LastActivityAnnotation holds the RFC 3339 time the workspace was last used.
+const LastActivityAnnotation = "workspaces.gitlab.com/last-activity"
+
+// ServiceAnnotator writes annotations on the Kubernetes service of a workspace.
+type ServiceAnnotator interface {
+	AnnotateService(ctx context.Context, namespace, name string, annotations map[string]string) error
+}
+
+// Reporter periodically writes the last activity of each workspace back to its
+// service, so that the agent can stop idle workspaces without asking the proxy.
+type Reporter struct {
+	logger    *zap.Logger
+	activity  *Tracker
+	upstreams *upstream.Tracker
+	// annotators are keyed by the cluster the workspaces are discovered in
+	annotators map[string]ServiceAnnotator
+	interval   time.Duration
+	// reported is the last activity written per workspace, only newer activity
+	// is written again to keep the API server traffic down
+	reported map[string]time.Time
+}
+
+func NewReporter(logger *zap.Logger, activity *Tracker, upstreams *upstream.Tracker, annotators map[string]ServiceAnnotator, interval time.Duration) *Reporter {
+	return &Reporter{
+		logger:     logger,
+		activity:   activity,
+		upstreams:  upstreams,
+		annotators: annotators,
+		interval:   interval,
+		reported:   make(map[string]time.Time),
+	}
+}
+
+// Run reports the activity every interval until the context is done.
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.report(ctx)
+		}
+	}
+}
+
+func (r *Reporter) report(ctx context.Context) {
+	workspaces := r.activity.List()
+
+	// Forget the workspaces the activity tracker forgot
+	tracked := make(map[string]bool, len(workspaces))
+	for _, workspace := range workspaces {
+		tracked[workspace.WorkspaceName] = true
+	}
+	for name := range r.reported {
+		if !tracked[name] {
+			delete(r.reported, name)
+		}
+	}
+
+	for _, workspace := range workspaces {
+		if !workspace.LastActiveAt.After(r.reported[workspace.WorkspaceName]) {
+			continue
+		}
+
+		upstreamWorkspace, err := r.upstreams.GetWorkspaceByName(workspace.WorkspaceName)
+		if err != nil || upstreamWorkspace.Namespace == "" {
+			// The workspace is gone or was not discovered from a service
+			continue
+		}
+
+		annotator, ok := r.annotators[upstreamWorkspace.Cluster]
+		if !ok {
+			continue
+		}
+
+		err = annotator.AnnotateService(ctx, upstreamWorkspace.Namespace, upstreamWorkspace.Name, map[string]string{
+			LastActivityAnnotation: workspace.LastActiveAt.Format(time.RFC3339),
+		})
+		if err != nil {
+			r.logger.Error("failed to write workspace activity to service",
+				logz.Error(err),
+				logz.WorkspaceName(workspace.WorkspaceName),
+				logz.ServiceNamespace(upstreamWorkspace.Namespace),
+				logz.Cluster(upstreamWorkspace.Cluster),
+			)
+			continue
+		}
+
+		r.reported[workspace.WorkspaceName] = workspace.LastActiveAt
+	}
+}
@@ -0,0 +1,81 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+type annotation struct {
+	namespace   string
+	name        string
+	annotations map[string]string
+}
+
+type fakeAnnotator struct {
+	calls []annotation
+	err   error
+}
+
+func (a *fakeAnnotator) AnnotateService(_ context.Context, namespace, name string, annotations map[string]string) error {
+	a.calls = append(a.calls, annotation{namespace: namespace, name: name, annotations: annotations})
+	return a.err
+}
+
+func TestReporter(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	upstreams := upstream.NewTracker(logger)
+	upstreams.Add(upstream.HostMapping{Hostname: "workspace1.workspaces.com", WorkspaceName: "workspace1", Namespace: "ns1"})
+
+	tracker, clock := newTestTracker()
+	annotator := &fakeAnnotator{}
+	reporter := NewReporter(logger, tracker, upstreams, map[string]ServiceAnnotator{"": annotator}, time.Minute)
+
+	tracker.Touch("workspace1")
+	// Not backed by a known service, nothing to annotate
+	tracker.Touch("workspace2")
+	reporter.report(context.Background())
+	require.Equal(t, []annotation{{
+		namespace:   "ns1",
+		name:        "workspace1",
+		annotations: map[string]string{LastActivityAnnotation: "2023-05-01T10:00:00Z"},
+	}}, annotator.calls)
+
+	// Unchanged activity is not written again
+	reporter.report(context.Background())
+	require.Len(t, annotator.calls, 1)
+
+	clock.now = clock.now.Add(time.Minute)
+	tracker.Touch("workspace1")
+	annotator.err = errors.New("forbidden")
+	reporter.report(context.Background())
+	require.Len(t, annotator.calls, 2)
+
+	// Failed writes are retried on the next report
+	annotator.err = nil
+	reporter.report(context.Background())
+	require.Len(t, annotator.calls, 3)
+	require.Equal(t, "2023-05-01T10:01:00Z", annotator.calls[2].annotations[LastActivityAnnotation])
+}
+
+func TestReporterForgetsWorkspaces(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	upstreams := upstream.NewTracker(logger)
+	upstreams.Add(upstream.HostMapping{Hostname: "workspace1.workspaces.com", WorkspaceName: "workspace1", Namespace: "ns1"})
+
+	tracker, _ := newTestTracker()
+	reporter := NewReporter(logger, tracker, upstreams, map[string]ServiceAnnotator{"": &fakeAnnotator{}}, time.Minute)
+
+	tracker.Touch("workspace1")
+	reporter.report(context.Background())
+	require.Len(t, reporter.reported, 1)
+
+	tracker.Forget("workspace1")
+	reporter.report(context.Background())
+	require.Empty(t, reporter.reported)
+}
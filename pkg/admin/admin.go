@@ -0,0 +1,101 @@
+// Package admin serves the JSON admin API of the proxy.
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap"
+)
+
+const (
+	activityPath  = "/api/v1/activity"
+	upstreamsPath = "/api/v1/upstreams"
+	lookupPath    = "/api/v1/lookup"
+	sessionsPath  = "/api/v1/sessions"
+	conflictsPath = "/api/v1/conflicts"
+)
+
+type Options struct {
+	Logger   *zap.Logger
+	Activity *activity.Tracker
+	Tracker  *upstream.Tracker
+	Resolver *routing.Resolver
+	Sessions *sessions.Registry
+	// Token must be sent as a bearer token unless the client presented a
+	// verified certificate. An empty token only admits such clients.
+	Token string
+}
+
+type handler struct {
+	opts *Options
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewHandler(opts *Options) http.Handler {
+	h := &handler{opts: opts}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(activityPath, h.listActivity)
+	mux.HandleFunc(activityPath+"/", h.getActivity)
+	mux.HandleFunc(upstreamsPath, h.listUpstreams)
+	mux.HandleFunc(conflictsPath, h.listConflicts)
+	mux.HandleFunc(lookupPath, h.lookup)
+	mux.HandleFunc(sessionsPath, h.listSessions)
+	mux.HandleFunc(sessionsPath+"/", h.workspaceSessions)
+	return h.authenticate(mux)
+}
+
+// listActivity returns the last activity of every workspace seen by the proxy.
+func (h *handler) listActivity(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.opts.Activity.List())
+}
+
+// getActivity returns the last activity of a single workspace.
+func (h *handler) getActivity(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	workspaceName := strings.TrimPrefix(r.URL.Path, activityPath+"/")
+	workspace, ok := h.opts.Activity.Get(workspaceName)
+	if !ok {
+		h.writeJSON(w, http.StatusNotFound, errorResponse{Error: "no activity recorded for workspace"})
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, workspace)
+}
+
+func (h *handler) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		h.opts.Logger.Error("failed to write admin API response", logz.Error(err))
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
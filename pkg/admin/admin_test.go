@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
+	"go.uber.org/zap/zaptest"
+)
+
+const testToken = "admin-token"
+
+func newRequest(method, target string) *http.Request {
+	request := httptest.NewRequest(method, target, nil)
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	return request
+}
+
+func TestAuthentication(t *testing.T) {
+	tt := []struct {
+		description        string
+		token              string
+		request            func() *http.Request
+		expectedStatusCode int
+	}{
+		{
+			description: "When no token is sent returns 401",
+			token:       testToken,
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/v1/activity", nil)
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			description: "When a wrong token is sent returns 401",
+			token:       testToken,
+			request: func() *http.Request {
+				request := httptest.NewRequest(http.MethodGet, "/api/v1/activity", nil)
+				request.Header.Set("Authorization", "Bearer wrong")
+				return request
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			description: "When no token is configured an empty bearer token returns 401",
+			request: func() *http.Request {
+				request := httptest.NewRequest(http.MethodGet, "/api/v1/activity", nil)
+				request.Header.Set("Authorization", "Bearer ")
+				return request
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			description: "When the token matches returns 200",
+			token:       testToken,
+			request: func() *http.Request {
+				return newRequest(http.MethodGet, "/api/v1/activity")
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description: "When the client certificate is verified returns 200",
+			request: func() *http.Request {
+				request := httptest.NewRequest(http.MethodGet, "/api/v1/activity", nil)
+				request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+				return request
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			handler := NewHandler(&Options{
+				Logger:   zaptest.NewLogger(t),
+				Activity: activity.NewTracker(),
+				Token:    tr.token,
+			})
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, tr.request())
+
+			require.Equal(t, tr.expectedStatusCode, recorder.Code)
+			if tr.expectedStatusCode == http.StatusUnauthorized {
+				require.Equal(t, "Bearer", recorder.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestActivity(t *testing.T) {
+	tracker := activity.NewTracker()
+	tracker.Touch("workspace1")
+
+	handler := NewHandler(&Options{
+		Logger:   zaptest.NewLogger(t),
+		Activity: tracker,
+		Token:    testToken,
+	})
+
+	tt := []struct {
+		description        string
+		method             string
+		path               string
+		expectedStatusCode int
+		expectedWorkspaces []string
+	}{
+		{
+			description:        "When listing activity returns every workspace",
+			method:             http.MethodGet,
+			path:               "/api/v1/activity",
+			expectedStatusCode: http.StatusOK,
+			expectedWorkspaces: []string{"workspace1"},
+		},
+		{
+			description:        "When getting the activity of a workspace returns it",
+			method:             http.MethodGet,
+			path:               "/api/v1/activity/workspace1",
+			expectedStatusCode: http.StatusOK,
+			expectedWorkspaces: []string{"workspace1"},
+		},
+		{
+			description:        "When the workspace has no activity returns 404",
+			method:             http.MethodGet,
+			path:               "/api/v1/activity/workspace2",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			description:        "When the method is not GET returns 405",
+			method:             http.MethodPost,
+			path:               "/api/v1/activity",
+			expectedStatusCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newRequest(tr.method, tr.path))
+
+			require.Equal(t, tr.expectedStatusCode, recorder.Code)
+			if tr.expectedWorkspaces == nil {
+				return
+			}
+
+			var workspaces []activity.Workspace
+			body := recorder.Body.Bytes()
+			if body[0] == '{' {
+				body = append(append([]byte("["), body...), ']')
+			}
+			require.Nil(t, json.Unmarshal(body, &workspaces))
+
+			names := make([]string, 0, len(workspaces))
+			for _, workspace := range workspaces {
+				names = append(names, workspace.WorkspaceName)
+			}
+			require.Equal(t, tr.expectedWorkspaces, names)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+)
+
+// authenticate admits clients with a verified TLS certificate or the static
+// bearer token.
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasVerifiedClientCertificate(r) || h.hasValidToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.opts.Logger.Info("rejected unauthenticated admin API request",
+			logz.HTTPPath(r.URL.Path),
+			logz.RemoteAddr(r.RemoteAddr),
+		)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		h.writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "authentication required"})
+	})
+}
+
+func hasVerifiedClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+func (h *handler) hasValidToken(r *http.Request) bool {
+	if h.opts.Token == "" {
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.Token)) == 1
+}
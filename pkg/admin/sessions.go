@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+)
+
+type terminateResponse struct {
+	WorkspaceName string `json:"workspace_name"`
+	Terminated    int    `json:"terminated"`
+}
+
+// listSessions returns the open SSH connections and websockets of every workspace.
+func (h *handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.opts.Sessions.List(""))
+}
+
+// workspaceSessions lists the sessions of a workspace, or closes them all on DELETE.
+func (h *handler) workspaceSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	workspaceName := strings.TrimPrefix(r.URL.Path, sessionsPath+"/")
+	if workspaceName == "" {
+		h.writeJSON(w, http.StatusNotFound, errorResponse{Error: "workspace name is required"})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		h.writeJSON(w, http.StatusOK, h.opts.Sessions.List(workspaceName))
+		return
+	}
+
+	terminated := h.opts.Sessions.Terminate(workspaceName)
+	h.opts.Logger.Info("terminated workspace sessions through the admin API",
+		logz.WorkspaceName(workspaceName),
+		logz.SessionCount(terminated),
+	)
+	h.writeJSON(w, http.StatusOK, terminateResponse{WorkspaceName: workspaceName, Terminated: terminated})
+}
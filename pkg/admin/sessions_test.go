@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSessions(t *testing.T) {
+	registry := sessions.NewRegistry()
+	closed := 0
+	closer := sessions.CloseFunc(func() error {
+		closed++
+		return nil
+	})
+	registry.Register(sessions.KindSSH, "workspace1", "192.0.2.1:1234", closer)
+	registry.Register(sessions.KindWebsocket, "workspace1", "192.0.2.1:1235", closer)
+	registry.Register(sessions.KindWebsocket, "workspace2", "192.0.2.2:1234", closer)
+
+	handler := NewHandler(&Options{
+		Logger:   zaptest.NewLogger(t),
+		Sessions: registry,
+		Token:    testToken,
+	})
+
+	listSessions := func(target string) []sessions.Session {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newRequest(http.MethodGet, target))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var result []sessions.Session
+		require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+		return result
+	}
+
+	require.Len(t, listSessions("/api/v1/sessions"), 3)
+	require.Len(t, listSessions("/api/v1/sessions/workspace1"), 2)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newRequest(http.MethodDelete, "/api/v1/sessions/workspace1"))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var result terminateResponse
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, terminateResponse{WorkspaceName: "workspace1", Terminated: 2}, result)
+	require.Equal(t, 2, closed)
+	require.Empty(t, listSessions("/api/v1/sessions/workspace1"))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newRequest(http.MethodDelete, "/api/v1/sessions"))
+	require.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
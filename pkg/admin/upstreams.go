@@ -0,0 +1,170 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+// hostMapping is the admin API view of upstream.HostMapping. The CA bundle of
+// a backend is reduced to whether one is set.
+type hostMapping struct {
+	Hostname      string      `json:"hostname"`
+	WorkspaceID   string      `json:"workspace_id"`
+	WorkspaceName string      `json:"workspace_name"`
+	Namespace     string      `json:"namespace"`
+	Cluster       string      `json:"cluster,omitempty"`
+	Backend       string      `json:"backend"`
+	Port          int32       `json:"port"`
+	PortName      string      `json:"port_name,omitempty"`
+	Protocol      string      `json:"protocol"`
+	Streaming     bool        `json:"streaming"`
+	TLS           *backendTLS `json:"tls,omitempty"`
+	// Readiness is empty when the discovery provider does not track pods
+	Readiness upstream.Readiness `json:"readiness,omitempty"`
+	Endpoints []string           `json:"endpoints,omitempty"`
+}
+
+type backendTLS struct {
+	ServerName         string `json:"server_name,omitempty"`
+	CustomCA           bool   `json:"custom_ca"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func newHostMapping(mapping *upstream.HostMapping) *hostMapping {
+	result := &hostMapping{
+		Hostname:      mapping.Hostname,
+		WorkspaceID:   mapping.WorkspaceID,
+		WorkspaceName: mapping.WorkspaceName,
+		Namespace:     mapping.Namespace,
+		Cluster:       mapping.Cluster,
+		Backend:       mapping.Backend,
+		Port:          mapping.BackendPort,
+		PortName:      mapping.PortName,
+		Protocol:      mapping.BackendProtocol,
+		Streaming:     mapping.Streaming,
+		Readiness:     mapping.Readiness,
+		Endpoints:     mapping.Endpoints,
+	}
+	if mapping.TLS != nil {
+		result.TLS = &backendTLS{
+			ServerName:         mapping.TLS.ServerName,
+			CustomCA:           mapping.TLS.CA != "",
+			InsecureSkipVerify: mapping.TLS.InsecureSkipVerify,
+		}
+	}
+	return result
+}
+
+// conflict is the admin API view of upstream.Conflict.
+type conflict struct {
+	Hostname   string       `json:"hostname"`
+	Source     string       `json:"source,omitempty"`
+	DetectedAt time.Time    `json:"detected_at"`
+	Mapping    *hostMapping `json:"mapping"`
+	Owner      *hostMapping `json:"owner"`
+}
+
+type lookupResponse struct {
+	Hostname    string       `json:"hostname"`
+	Path        string       `json:"path"`
+	RoutingMode routing.Mode `json:"routing_mode"`
+	Found       bool         `json:"found"`
+	Explanation string       `json:"explanation"`
+	Upstream    *hostMapping `json:"upstream,omitempty"`
+	// BackendPath is the path the backend receives once the workspace prefix is stripped
+	BackendPath string `json:"backend_path,omitempty"`
+}
+
+// listUpstreams returns every host mapping known to the proxy.
+func (h *handler) listUpstreams(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	mappings := h.opts.Tracker.List()
+	result := make([]*hostMapping, 0, len(mappings))
+	for i := range mappings {
+		result = append(result, newHostMapping(&mappings[i]))
+	}
+	h.writeJSON(w, http.StatusOK, result)
+}
+
+// listConflicts returns the host mappings which are not routed because another
+// workspace claimed their hostname or workspace port first.
+func (h *handler) listConflicts(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	conflicts := h.opts.Tracker.Conflicts()
+	result := make([]conflict, 0, len(conflicts))
+	for i := range conflicts {
+		result = append(result, conflict{
+			Hostname:   conflicts[i].Mapping.Hostname,
+			Source:     conflicts[i].Source,
+			DetectedAt: conflicts[i].DetectedAt,
+			Mapping:    newHostMapping(&conflicts[i].Mapping),
+			Owner:      newHostMapping(&conflicts[i].Owner),
+		})
+	}
+	h.writeJSON(w, http.StatusOK, result)
+}
+
+// lookup explains which workspace port a hostname and path resolve to, e.g.
+// /api/v1/lookup?hostname=3000-workspace1.workspaces.com&path=/
+func (h *handler) lookup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	hostname := r.URL.Query().Get("hostname")
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	if hostname == "" && h.opts.Resolver.Mode() == routing.ModeHost {
+		h.writeJSON(w, http.StatusBadRequest, errorResponse{Error: "the hostname query parameter is required"})
+		return
+	}
+
+	result := lookupResponse{
+		Hostname:    hostname,
+		Path:        path,
+		RoutingMode: h.opts.Resolver.Mode(),
+	}
+
+	route, err := h.opts.Resolver.Resolve(hostname, path)
+	if err != nil {
+		result.Explanation = h.explainNotFound(hostname, err)
+		h.writeJSON(w, http.StatusNotFound, result)
+		return
+	}
+
+	mapping := route.Mapping
+	result.Found = true
+	result.Upstream = newHostMapping(mapping)
+	result.BackendPath = route.Path
+	if route.Prefix == "" {
+		result.Explanation = fmt.Sprintf("hostname %s is mapped to port %d of service %s of workspace %s",
+			hostname, mapping.BackendPort, mapping.Backend, mapping.WorkspaceName)
+	} else {
+		result.Explanation = fmt.Sprintf("path prefix %s selects port %d of service %s of workspace %s, the prefix is stripped before proxying",
+			route.Prefix, mapping.BackendPort, mapping.Backend, mapping.WorkspaceName)
+	}
+	if mapping.Readiness == upstream.ReadinessNotReady {
+		result.Explanation += ", no pod is ready to serve it"
+	}
+	h.writeJSON(w, http.StatusOK, result)
+}
+
+func (h *handler) explainNotFound(hostname string, err error) string {
+	if h.opts.Resolver.Mode() == routing.ModeHost && errors.Is(err, upstream.ErrNotFound) {
+		return fmt.Sprintf("no host mapping for hostname %s, either the workspace service is not tracked or its host template renders a different hostname", hostname)
+	}
+	return err.Error()
+}
@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func newUpstreamsHandler(t *testing.T, mode routing.Mode) http.Handler {
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{
+		Hostname:        "3000-workspace1.workspaces.com",
+		Backend:         "workspace1.gl-workspaces",
+		BackendPort:     3000,
+		BackendProtocol: "https",
+		WorkspaceID:     "1",
+		WorkspaceName:   "workspace1",
+		Namespace:       "gl-workspaces",
+		TLS:             &upstream.BackendTLS{ServerName: "workspace1.internal", CA: "-----BEGIN CERTIFICATE-----"},
+	})
+
+	return NewHandler(&Options{
+		Logger:   logger,
+		Tracker:  tracker,
+		Resolver: routing.NewResolver(mode, "/w", tracker),
+		Token:    testToken,
+	})
+}
+
+func TestListUpstreams(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	newUpstreamsHandler(t, routing.ModeHost).ServeHTTP(recorder, newRequest(http.MethodGet, "/api/v1/upstreams"))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NotContains(t, recorder.Body.String(), "BEGIN CERTIFICATE")
+
+	var mappings []hostMapping
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &mappings))
+	require.Equal(t, []hostMapping{{
+		Hostname:      "3000-workspace1.workspaces.com",
+		WorkspaceID:   "1",
+		WorkspaceName: "workspace1",
+		Namespace:     "gl-workspaces",
+		Backend:       "workspace1.gl-workspaces",
+		Port:          3000,
+		Protocol:      "https",
+		TLS:           &backendTLS{ServerName: "workspace1.internal", CustomCA: true},
+	}}, mappings)
+}
+
+func TestLookup(t *testing.T) {
+	tt := []struct {
+		description         string
+		mode                routing.Mode
+		target              string
+		expectedStatusCode  int
+		expectedFound       bool
+		expectedBackendPath string
+	}{
+		{
+			description:         "When the hostname is mapped returns the upstream",
+			mode:                routing.ModeHost,
+			target:              "/api/v1/lookup?hostname=3000-workspace1.workspaces.com&path=/index.html",
+			expectedStatusCode:  http.StatusOK,
+			expectedFound:       true,
+			expectedBackendPath: "/index.html",
+		},
+		{
+			description:        "When the hostname is not mapped returns 404",
+			mode:               routing.ModeHost,
+			target:             "/api/v1/lookup?hostname=3000-workspace2.workspaces.com",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			description:        "When the hostname is missing in host mode returns 400",
+			mode:               routing.ModeHost,
+			target:             "/api/v1/lookup",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			description:         "When the path selects a workspace port strips the prefix",
+			mode:                routing.ModePath,
+			target:              "/api/v1/lookup?hostname=workspaces.com&path=/w/workspace1/3000/index.html",
+			expectedStatusCode:  http.StatusOK,
+			expectedFound:       true,
+			expectedBackendPath: "/index.html",
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			newUpstreamsHandler(t, tr.mode).ServeHTTP(recorder, newRequest(http.MethodGet, tr.target))
+
+			require.Equal(t, tr.expectedStatusCode, recorder.Code)
+			if tr.expectedStatusCode == http.StatusBadRequest {
+				return
+			}
+
+			var result lookupResponse
+			require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+			require.Equal(t, tr.expectedFound, result.Found)
+			require.Equal(t, tr.expectedBackendPath, result.BackendPath)
+			require.NotEmpty(t, result.Explanation)
+		})
+	}
+}
+
+func TestListConflicts(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Replace("uid-1", []upstream.HostMapping{{Hostname: "3000-workspace1.workspaces.com", BackendPort: 3000, WorkspaceName: "workspace1", Namespace: "ns1"}})
+	tracker.Replace("uid-2", []upstream.HostMapping{{Hostname: "3000-workspace1.workspaces.com", BackendPort: 3000, WorkspaceName: "workspace2", Namespace: "ns2"}})
+	handler := NewHandler(&Options{Logger: logger, Tracker: tracker, Token: testToken})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newRequest(http.MethodGet, "/api/v1/conflicts"))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var conflicts []conflict
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &conflicts))
+	require.Len(t, conflicts, 1)
+	require.Equal(t, "3000-workspace1.workspaces.com", conflicts[0].Hostname)
+	require.Equal(t, "uid-2", conflicts[0].Source)
+	require.Equal(t, "workspace2", conflicts[0].Mapping.WorkspaceName)
+	require.Equal(t, "workspace1", conflicts[0].Owner.WorkspaceName)
+}
@@ -5,26 +5,39 @@ import (
 	"errors"
 
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 )
 
 var ErrInvalidUser = errors.New("user does not have access to this workspace")
 
-func checkAuthorization(ctx context.Context, accessToken string, workspaceID string, apiFactory gitlab.APIFactory) error {
+// checkAuthorization returns the user of the access token if they own the workspace.
+func checkAuthorization(ctx context.Context, accessToken string, workspaceID string, apiFactory gitlab.APIFactory) (*gitlab.User, error) {
+	ctx, span := tracing.Start(ctx, "auth.checkAuthorization")
+	defer span.End()
+
+	user, err := authorize(ctx, accessToken, workspaceID, apiFactory)
+	if err != nil {
+		tracing.RecordError(span, err)
+	}
+	return user, err
+}
+
+func authorize(ctx context.Context, accessToken string, workspaceID string, apiFactory gitlab.APIFactory) (*gitlab.User, error) {
 	api := apiFactory(accessToken)
 
 	currentUser, err := api.GetUserInfo(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	workspaceInfo, err := api.GetWorkspace(ctx, workspaceID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if currentUser.ID != workspaceInfo.User.ID {
-		return ErrInvalidUser
+		return nil, ErrInvalidUser
 	}
 
-	return nil
+	return currentUser, nil
 }
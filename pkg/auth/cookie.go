@@ -12,28 +12,39 @@ const (
 )
 
 func checkIfValidCookieExists(r *http.Request, config *Config, workspaceID string) bool {
+	_, ok := sessionFromCookie(r, config, workspaceID)
+	return ok
+}
+
+// sessionFromCookie returns the claims of a valid session cookie for the workspace.
+func sessionFromCookie(r *http.Request, config *Config, workspaceID string) (*Claims, bool) {
 	cookie, err := r.Cookie(SessionCookieName)
 	if err != nil {
-		return false
+		return nil, false
 	}
 
 	if cookie.Value == "" {
-		return false
+		return nil, false
 	}
 
-	return validateJWT(config.SigningKey, cookie.Value, workspaceID)
+	return parseJWT(config.SigningKey, cookie.Value, workspaceID)
 }
 
-func setCookie(w http.ResponseWriter, value string, domain string, expires int) {
+// setCookie sets the session cookie for the workspace. The path scopes it to a
+// single workspace when workspaces share the proxy hostname.
+func setCookie(w http.ResponseWriter, value string, domain string, path string, expires int, secure bool) {
 	// Remove port
 	domainElements := strings.Split(domain, ":")
 	cookie := &http.Cookie{
-		Path:    "/",
+		Path:    path,
 		Domain:  fmt.Sprintf(".%s", domainElements[0]),
 		Name:    SessionCookieName,
 		Value:   value,
 		Expires: time.Now().Add(time.Duration(expires) * time.Second),
-		Secure:  false,
+		Secure:  secure,
+		// Workspace scripts have no use for the session, and in path mode
+		// every workspace shares the same origin
+		HttpOnly: true,
 	}
 	http.SetCookie(w, cookie)
 }
@@ -48,10 +48,23 @@ func TestCheckIfValidCookieExists(t *testing.T) {
 	}
 }
 
+func TestSetCookie(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	setCookie(recorder, "token", "workspace.example.com:8080", "/w/workspace1/", 60, true)
+
+	cookies := recorder.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, SessionCookieName, cookies[0].Name)
+	require.Equal(t, "workspace.example.com", cookies[0].Domain)
+	require.Equal(t, "/w/workspace1/", cookies[0].Path)
+	require.True(t, cookies[0].Secure)
+	require.True(t, cookies[0].HttpOnly)
+}
+
 func generateRequestWithCookie(t *testing.T, token string, url string) *http.Request {
 	t.Helper()
 	recorder := httptest.NewRecorder()
-	setCookie(recorder, token, "example.com", 1)
+	setCookie(recorder, token, "example.com", "/", 1, true)
 
 	request := httptest.NewRequest(http.MethodGet, url, nil)
 	result := recorder.Result()
@@ -8,15 +8,18 @@ import (
 
 type Claims struct {
 	WorkspaceID string `json:"workspaceID"`
+	// Username identifies the GitLab user in the access log
+	Username string `json:"username,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func generateJWT(signingKey string, workspaceID string, expiresIn int) (string, error) {
+func generateJWT(signingKey string, workspaceID string, username string, expiresIn int) (string, error) {
 	expirationTime := time.Now().Add(time.Duration(expiresIn) * time.Second)
 
 	// Create the JWT claims, which includes the workspace id and expiry time
 	claims := &Claims{
 		WorkspaceID: workspaceID,
+		Username:    username,
 		RegisteredClaims: jwt.RegisteredClaims{
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
@@ -33,6 +36,12 @@ func generateJWT(signingKey string, workspaceID string, expiresIn int) (string,
 }
 
 func validateJWT(signingKey, token string, workspaceID string) bool {
+	_, ok := parseJWT(signingKey, token, workspaceID)
+	return ok
+}
+
+// parseJWT returns the claims of a valid token issued for the workspace.
+func parseJWT(signingKey, token string, workspaceID string) (*Claims, bool) {
 	var claims Claims
 	tkn, err := jwt.ParseWithClaims(
 		token,
@@ -45,16 +54,16 @@ func validateJWT(signingKey, token string, workspaceID string) bool {
 		}),
 	)
 	if err != nil {
-		return false
+		return nil, false
 	}
 
 	if !tkn.Valid {
-		return false
+		return nil, false
 	}
 
 	if claims.WorkspaceID != workspaceID {
-		return false
+		return nil, false
 	}
 
-	return true
+	return &claims, true
 }
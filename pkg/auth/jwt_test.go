@@ -53,7 +53,7 @@ func TestValidateJwt(t *testing.T) {
 
 func generateToken(t *testing.T, expires int, workspaceID string) string {
 	t.Helper()
-	tkn, err := generateJWT(signingKey, workspaceID, expires)
+	tkn, err := generateJWT(signingKey, workspaceID, "root", expires)
 	require.NoError(t, err)
 
 	return tkn
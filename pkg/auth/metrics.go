@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+)
+
+const metricsNamespace = "gitlab_workspaces_proxy"
+
+// Reasons an authentication attempt is denied.
+const (
+	denialWorkspaceNotFound  = "workspace_not_found"
+	denialMissingCode        = "missing_code"
+	denialTokenExchange      = "token_exchange_failed"
+	denialMissingState       = "missing_state"
+	denialInvalidState       = "invalid_state"
+	denialUnauthorized       = "unauthorized"
+	denialAuthorizationError = "authorization_error"
+	denialSessionError       = "session_error"
+)
+
+const (
+	callbackResultSuccess = "success"
+	callbackResultDenied  = "denied"
+)
+
+// Metrics counts redirects to GitLab, OAuth callbacks and denied requests.
+type Metrics struct {
+	workspaces *cardinality.Limiter
+	redirects  *prometheus.CounterVec
+	callbacks  *prometheus.CounterVec
+	denials    *prometheus.CounterVec
+}
+
+// NewMetrics creates the auth metrics. When registerer is nil the collectors
+// are created but not registered, which keeps tests independent.
+func NewMetrics(registerer prometheus.Registerer, workspaces *cardinality.Limiter) *Metrics {
+	factory := promauto.With(registerer)
+
+	m := &Metrics{
+		workspaces: workspaces,
+		redirects: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "auth",
+			Name:      "redirects_total",
+			Help:      "Number of requests without a valid session redirected to GitLab, by cluster and workspace.",
+		}, []string{"cluster", "workspace"}),
+		callbacks: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "auth",
+			Name:      "callbacks_total",
+			Help:      "Number of OAuth callbacks handled, by result.",
+		}, []string{"result"}),
+		denials: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "auth",
+			Name:      "denials_total",
+			Help:      "Number of requests denied by the auth middleware, by reason.",
+		}, []string{"reason"}),
+	}
+
+	// Series of a workspace would otherwise be exported until restart
+	workspaces.OnForget(func(workspaceName string) {
+		m.redirects.DeletePartialMatch(prometheus.Labels{"workspace": workspaceName})
+	})
+
+	return m
+}
+
+func (m *Metrics) redirect(cluster, workspaceName string) {
+	m.redirects.WithLabelValues(cluster, m.workspaces.Value(workspaceName)).Inc()
+}
+
+func (m *Metrics) deny(reason string) {
+	m.denials.WithLabelValues(reason).Inc()
+}
+
+// callbackDenied records a callback which did not result in a session.
+func (m *Metrics) callbackDenied(reason string) {
+	m.callbacks.WithLabelValues(callbackResultDenied).Inc()
+	m.deny(reason)
+}
+
+func (m *Metrics) callbackSucceeded() {
+	m.callbacks.WithLabelValues(callbackResultSuccess).Inc()
+}
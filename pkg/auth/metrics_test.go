@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMiddlewareMetrics(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{Hostname: "workspace1.workspaces.com", WorkspaceID: "1", WorkspaceName: "workspace1", Cluster: "cluster1"})
+
+	config := &Config{
+		ClientID:    "CLIENT_ID",
+		RedirectURI: "http://workspaces.com/callback",
+		SigningKey:  "abc",
+		Protocol:    "http",
+	}
+
+	registry := prometheus.NewRegistry()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	middleware := NewMiddleware(logger, nil, config, routing.NewResolver(routing.ModeHost, "", tracker), NewMetrics(registry, nil), gitlab.MockAPIFactory, nil)(handler)
+
+	for _, target := range []string{
+		"http://workspace1.workspaces.com",
+		"http://workspace2.workspaces.com",
+		"https://workspaces.com/callback",
+	} {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	expected := `
+# HELP gitlab_workspaces_proxy_auth_callbacks_total Number of OAuth callbacks handled, by result.
+# TYPE gitlab_workspaces_proxy_auth_callbacks_total counter
+gitlab_workspaces_proxy_auth_callbacks_total{result="denied"} 1
+# HELP gitlab_workspaces_proxy_auth_denials_total Number of requests denied by the auth middleware, by reason.
+# TYPE gitlab_workspaces_proxy_auth_denials_total counter
+gitlab_workspaces_proxy_auth_denials_total{reason="missing_code"} 1
+gitlab_workspaces_proxy_auth_denials_total{reason="workspace_not_found"} 1
+# HELP gitlab_workspaces_proxy_auth_redirects_total Number of requests without a valid session redirected to GitLab, by cluster and workspace.
+# TYPE gitlab_workspaces_proxy_auth_redirects_total counter
+gitlab_workspaces_proxy_auth_redirects_total{cluster="cluster1",workspace="workspace1"} 1
+`
+	require.Nil(t, testutil.GatherAndCompare(registry, strings.NewReader(expected)))
+}
+
+func TestMetricsForgetWorkspaces(t *testing.T) {
+	limiter := cardinality.NewLimiter(2)
+	metrics := NewMetrics(nil, limiter)
+
+	for i := 0; i < 10; i++ {
+		name := "workspace" + strconv.Itoa(i)
+		metrics.redirect("cluster1", name)
+		limiter.Forget(name)
+	}
+
+	require.Equal(t, 0, testutil.CollectAndCount(metrics.redirects))
+}
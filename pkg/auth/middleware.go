@@ -1,15 +1,21 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"strings"
 
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/discovery"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
-	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/logging"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -24,59 +30,101 @@ type Config struct {
 
 type HTTPMiddleware func(http.Handler) http.Handler
 
+// eventReasonAuthorizationDenied is recorded on the workspace service when a
+// user who does not own the workspace tries to open it.
+const eventReasonAuthorizationDenied = "AuthorizationDenied"
+
+// NewMiddleware creates the auth middleware. A nil recorder records no events,
+// a nil redactor redacts the default query parameters from logged URLs.
 func NewMiddleware(
 	logger *zap.Logger,
+	redactor *logz.Redactor,
 	config *Config,
-	upstreams *upstream.Tracker,
+	resolver *routing.Resolver,
+	metrics *Metrics,
 	apiFactory gitlab.APIFactory,
+	recorder discovery.EventRecorder,
 ) HTTPMiddleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// TODO: refactor this block - https://gitlab.com/gitlab-org/gitlab/-/issues/408340
-			// Check path if callback then get token and set cookie
-			if isRedirectURI(config, r) {
-				handleRedirect(logger, r, w, config, upstreams, apiFactory)
-				return
-			}
+			// The span ends before the request is proxied so that it only
+			// measures the time spent on authentication
+			ctx, span := tracing.Start(r.Context(), "auth.Middleware")
+			authenticated := authenticate(logger, redactor, r.WithContext(ctx), w, config, resolver, metrics, apiFactory, recorder)
+			span.End()
 
-			protocol := "https"
-			if config.Protocol != "" {
-				protocol = config.Protocol
-			}
-			workspaceURL := fmt.Sprintf("%s://%s%s%s%s", protocol, r.Host, r.URL.Port(), r.URL.Path, r.URL.RawQuery)
-			logger.Debug("attempting to find workspace upstream from url", logz.WorkspaceURL(workspaceURL))
-			workspace, err := getWorkspaceFromURL(workspaceURL, upstreams)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				logger.Error("failed to find workspace upstream from url",
-					logz.Error(err),
-					logz.WorkspaceURL(workspaceURL),
-				)
-				return
+			if authenticated {
+				next.ServeHTTP(w, r)
 			}
+		})
+	}
+}
 
-			// Check if cookie is already present for workspace ID
-			if !checkIfValidCookieExists(r, config, workspace.WorkspaceID) {
-				redirectToAuthURL(config, w, r)
-				return
-			}
+// authenticate reports whether the request carries a valid session for its
+// workspace, otherwise it writes the redirect or error response.
+func authenticate(
+	logger *zap.Logger,
+	redactor *logz.Redactor,
+	r *http.Request,
+	w http.ResponseWriter,
+	config *Config,
+	resolver *routing.Resolver,
+	metrics *Metrics,
+	apiFactory gitlab.APIFactory,
+	recorder discovery.EventRecorder,
+) bool {
+	logger = requestid.Logger(logger, r)
 
-			next.ServeHTTP(w, r)
-		})
+	// TODO: refactor this block - https://gitlab.com/gitlab-org/gitlab/-/issues/408340
+	// Check path if callback then get token and set cookie
+	if isRedirectURI(config, r) {
+		handleRedirect(logger, redactor, r, w, config, resolver, metrics, apiFactory, recorder)
+		return false
 	}
+
+	workspaceURL := fmt.Sprintf("%s://%s%s", requestScheme(config, r), clientinfo.FromRequest(r).Host, r.URL.RequestURI())
+	logger.Debug("attempting to find workspace upstream from url", redactor.WorkspaceURL(workspaceURL))
+	route, err := resolver.ResolveRequest(r)
+	if err != nil {
+		metrics.deny(denialWorkspaceNotFound)
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Error("failed to find workspace upstream from url",
+			logz.Error(err),
+			redactor.WorkspaceURL(workspaceURL),
+		)
+		return false
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("workspace.name", route.Mapping.WorkspaceName))
+	details := logging.DetailsFromRequest(r)
+	details.WorkspaceID = route.Mapping.WorkspaceID
+
+	// Check if cookie is already present for workspace ID
+	claims, ok := sessionFromCookie(r, config, route.Mapping.WorkspaceID)
+	if !ok {
+		metrics.redirect(route.Mapping.Cluster, route.Mapping.WorkspaceName)
+		redirectToAuthURL(config, w, r)
+		return false
+	}
+	details.Username = claims.Username
+
+	return true
 }
 
 func handleRedirect(
 	logger *zap.Logger,
+	redactor *logz.Redactor,
 	r *http.Request,
 	w http.ResponseWriter,
 	config *Config,
-	upstreams *upstream.Tracker,
+	resolver *routing.Resolver,
+	metrics *Metrics,
 	apiFactory gitlab.APIFactory,
+	recorder discovery.EventRecorder,
 ) {
 	if authCode, ok := r.URL.Query()["code"]; ok {
 		token, err := getToken(r.Context(), config, authCode[0])
 		if err != nil {
+			metrics.callbackDenied(denialTokenExchange)
 			w.WriteHeader(http.StatusBadRequest)
 			logger.Error("failed to find token in the request", logz.Error(err))
 			return
@@ -84,35 +132,54 @@ func handleRedirect(
 
 		state := r.URL.Query().Get("state")
 		if state == "" {
+			metrics.callbackDenied(denialMissingState)
 			w.WriteHeader(http.StatusBadRequest)
 			logger.Error("failed to find state in the request", logz.Error(err))
 			return
 		}
 
-		workspace, err := getWorkspaceFromURL(state, upstreams)
+		route, err := getRouteFromState(state, resolver)
 		if err != nil {
+			metrics.callbackDenied(denialInvalidState)
 			w.WriteHeader(http.StatusBadRequest)
 			logger.Error("failed to find workspace upstream from state",
 				logz.Error(err),
-				logz.WorkspaceURL(state),
+				redactor.WorkspaceURL(state),
 			)
+			return
 		}
+		workspace := route.Mapping
 
 		logger.Debug("attempting to authorize workspace access request", logz.WorkspaceName(workspace.WorkspaceName))
-		err = checkAuthorization(r.Context(), token.AccessToken, workspace.WorkspaceID, apiFactory)
+		user, err := checkAuthorization(r.Context(), token.AccessToken, workspace.WorkspaceID, apiFactory)
 		if err != nil {
+			clientIP := clientinfo.FromRequest(r).IP
+			if errors.Is(err, ErrInvalidUser) {
+				metrics.callbackDenied(denialUnauthorized)
+				if recorder != nil {
+					recorder.RecordWorkspaceWarning(workspace.Cluster, workspace.Namespace, workspace.WorkspaceName, eventReasonAuthorizationDenied,
+						fmt.Sprintf("a GitLab user who does not own the workspace was denied access from %s", clientIP))
+				}
+			} else {
+				metrics.callbackDenied(denialAuthorizationError)
+			}
 			w.WriteHeader(http.StatusBadRequest)
 			logger.Error("failed to authorize workspace access request",
 				logz.Error(err),
 				logz.WorkspaceName(workspace.WorkspaceName),
+				logz.HTTPIp(clientIP),
 			)
 			return
 		}
 		logger.Debug("workspace access authorization successful", logz.WorkspaceName(workspace.WorkspaceName))
+		details := logging.DetailsFromRequest(r)
+		details.Username = user.Username
+		details.WorkspaceID = workspace.WorkspaceID
 
 		// Create JWT for cookie
-		signedJwt, err := generateJWT(config.SigningKey, workspace.WorkspaceID, token.ExpiresIn)
+		signedJwt, err := generateJWT(config.SigningKey, workspace.WorkspaceID, user.Username, token.ExpiresIn)
 		if err != nil {
+			metrics.callbackDenied(denialSessionError)
 			w.WriteHeader(http.StatusBadRequest)
 			logger.Error("failed to generate jwt",
 				logz.Error(err),
@@ -125,34 +192,26 @@ func handleRedirect(
 		stateURI, _ := url.QueryUnescape(state)
 
 		// Write Cookie
-		setCookie(w, signedJwt, r.Host, token.ExpiresIn)
+		setCookie(w, signedJwt, clientinfo.FromRequest(r).Host, route.CookiePath(), token.ExpiresIn, requestScheme(config, r) == "https")
 
+		metrics.callbackSucceeded()
 		http.Redirect(w, r, stateURI, http.StatusTemporaryRedirect)
 		return
 	} else {
+		metrics.callbackDenied(denialMissingCode)
 		w.WriteHeader(http.StatusBadRequest)
 		logger.Error("failed to find auth code in the request")
 		return
 	}
 }
 
-func getHostnameFromState(state string) (string, error) {
+func parseState(state string) (*url.URL, error) {
 	stateURL, err := url.QueryUnescape(state)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	log.Printf("getHostnameFromState state=%s", stateURL)
 
-	u, err := url.Parse(stateURL)
-	if err != nil {
-		return "", err
-	}
-	log.Printf("getHostnameFromState u.Hostname()=%s", u.Hostname())
-
-	// Get first part of hostname (without port)
-	hostElements := strings.Split(u.Hostname(), ":")
-
-	return hostElements[0], nil
+	return url.Parse(stateURL)
 }
 
 func redirectToAuthURL(config *Config, w http.ResponseWriter, r *http.Request) {
@@ -167,36 +226,37 @@ func redirectToAuthURL(config *Config, w http.ResponseWriter, r *http.Request) {
 		port = fmt.Sprintf(":%s", r.URL.Port())
 	}
 
-	protocol := "https"
-	if config.Protocol != "" {
-		protocol = config.Protocol
-	}
-
-	state := url.QueryEscape(fmt.Sprintf("%s://%s%s%s%s", protocol, r.Host, port, r.URL.Path, query))
+	state := url.QueryEscape(fmt.Sprintf("%s://%s%s%s%s", requestScheme(config, r), clientinfo.FromRequest(r).Host, port, r.URL.Path, query))
 	authURL := fmt.Sprintf("%s/oauth/authorize?response_type=code&client_id=%s&redirect_uri=%s&scope=openid profile api read_user&state=%s", config.Host, config.ClientID, config.RedirectURI, state)
 	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
 }
 
 func isRedirectURI(config *Config, r *http.Request) bool {
+	uri := fmt.Sprintf("%s://%s%s", requestScheme(config, r), clientinfo.FromRequest(r).Host, r.URL.Path)
+	return uri == config.RedirectURI
+}
+
+// requestScheme returns the scheme the client used as reported by a trusted
+// proxy, falling back to the configured protocol.
+func requestScheme(config *Config, r *http.Request) string {
 	protocol := "https"
 	if config.Protocol != "" {
 		protocol = config.Protocol
 	}
 
-	uri := fmt.Sprintf("%s://%s%s", protocol, r.Host, r.URL.Path)
-	return uri == config.RedirectURI
+	return clientinfo.FromRequest(r).SchemeOr(protocol)
 }
 
-func getWorkspaceFromURL(url string, upstreams *upstream.Tracker) (*upstream.HostMapping, error) {
-	hostname, err := getHostnameFromState(url)
+func getRouteFromState(state string, resolver *routing.Resolver) (*routing.Route, error) {
+	u, err := parseState(state)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse workspace from host %s", err)
+		return nil, fmt.Errorf("could not parse workspace from state %s", err)
 	}
 
-	upstreamHostMapping, err := upstreams.GetByHostname(hostname)
+	route, err := resolver.Resolve(u.Hostname(), u.Path)
 	if err != nil {
 		return nil, fmt.Errorf("could not find upstream workspace %s", err)
 	}
 
-	return upstreamHostMapping, nil
+	return route, nil
 }
@@ -5,16 +5,20 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
 	"go.uber.org/zap/zaptest"
 )
 
-func TestGetHostnameFromState(t *testing.T) {
+func TestParseState(t *testing.T) {
 	tt := []struct {
 		description    string
 		state          string
@@ -35,14 +39,14 @@ func TestGetHostnameFromState(t *testing.T) {
 
 	for _, tr := range tt {
 		t.Run(tr.description, func(t *testing.T) {
-			result, err := getHostnameFromState(tr.state)
+			result, err := parseState(tr.state)
 			if tr.expectedError {
 				require.NotNil(t, err)
 				return
 			}
 
 			require.Nil(t, err)
-			require.Equal(t, tr.expectedResult, result)
+			require.Equal(t, tr.expectedResult, result.Hostname())
 		})
 	}
 }
@@ -209,7 +213,7 @@ func TestMiddleware(t *testing.T) {
 				_, _ = w.Write([]byte("Hello World"))
 			})
 
-			middleware := NewMiddleware(logger, config, tracker, gitlab.MockAPIFactory)(handler)
+			middleware := NewMiddleware(logger, nil, config, routing.NewResolver(routing.ModeHost, "", tracker), NewMetrics(nil, nil), gitlab.MockAPIFactory, nil)(handler)
 			middleware.ServeHTTP(recorder, tr.request)
 
 			result := recorder.Result()
@@ -221,3 +225,134 @@ func TestMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestScheme(t *testing.T) {
+	trusted, err := cidr.Parse([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+
+	tt := []struct {
+		description    string
+		protocol       string
+		remoteAddr     string
+		expectedScheme string
+	}{
+		{
+			description:    "When no protocol is configured defaults to https",
+			remoteAddr:     "192.0.2.1:1234",
+			expectedScheme: "https",
+		},
+		{
+			description:    "When the request is not from a trusted proxy uses the configured protocol",
+			protocol:       "http",
+			remoteAddr:     "192.0.2.1:1234",
+			expectedScheme: "http",
+		},
+		{
+			description:    "When a trusted proxy forwards the scheme uses the forwarded scheme",
+			protocol:       "http",
+			remoteAddr:     "10.0.0.5:1234",
+			expectedScheme: "https",
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			var scheme string
+			handler := clientinfo.NewMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				scheme = requestScheme(&Config{Protocol: tr.protocol}, r)
+			}))
+
+			request := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com", nil)
+			request.RemoteAddr = tr.remoteAddr
+			request.Header.Set("X-Forwarded-Proto", "https")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			require.Equal(t, tr.expectedScheme, scheme)
+		})
+	}
+}
+
+func TestMiddlewarePathRouting(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(token{AccessToken: "abc"})
+		require.Nil(t, err)
+
+		_, _ = w.Write(data)
+	}))
+	defer svr.Close()
+
+	config := &Config{
+		Host:         svr.URL,
+		ClientID:     "CLIENT_ID",
+		ClientSecret: "CLIENT_SECRET",
+		RedirectURI:  "http://workspaces.com/callback",
+		SigningKey:   "abc",
+		Protocol:     "http",
+	}
+
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace1.workspaces.com", WorkspaceName: "workspace1", BackendPort: 3000})
+	resolver := routing.NewResolver(routing.ModePath, "/w", tracker)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello World"))
+	})
+	middleware := NewMiddleware(logger, nil, config, resolver, NewMetrics(nil, nil), gitlab.MockAPIFactory, nil)(handler)
+
+	recorder := httptest.NewRecorder()
+	middleware.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://workspaces.com/w/workspace1/3000/", nil))
+	require.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	state := url.QueryEscape("http://workspaces.com/w/workspace1/3000/")
+	middleware.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://workspaces.com/callback?code=123&state="+state, nil))
+
+	result := recorder.Result()
+	defer func() { _ = result.Body.Close() }()
+	require.Equal(t, http.StatusTemporaryRedirect, result.StatusCode)
+	require.Equal(t, "http://workspaces.com/w/workspace1/3000/", result.Header.Get("Location"))
+	require.Len(t, result.Cookies(), 1)
+	require.Equal(t, "/w/workspace1/", result.Cookies()[0].Path)
+}
+
+type fakeRecorder struct {
+	warnings []string
+}
+
+func (r *fakeRecorder) RecordWorkspaceWarning(_, namespace, workspaceName, reason, message string) {
+	r.warnings = append(r.warnings, namespace+"/"+workspaceName+": "+reason+": "+message)
+}
+
+func TestMiddlewareRecordsAuthorizationDenied(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(token{AccessToken: "abc"})
+		require.Nil(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer svr.Close()
+
+	config := &Config{
+		Host:        svr.URL,
+		RedirectURI: "http://workspaces.com/callback",
+		SigningKey:  "abc",
+		Protocol:    "http",
+	}
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{Hostname: "workspace1.workspaces.com", WorkspaceID: "1", WorkspaceName: "workspace1", Namespace: "gl-workspaces"})
+	// The user of the token does not own the workspace
+	apiFactory := func(accessToken string) gitlab.API {
+		return &gitlab.MockAPI{GetUserInfoUserID: 2, GetWorkspaceUserID: 1, ValidToken: accessToken, AccessToken: accessToken}
+	}
+
+	recorder := &fakeRecorder{}
+	middleware := NewMiddleware(logger, nil, config, routing.NewResolver(routing.ModeHost, "", tracker), NewMetrics(nil, nil), apiFactory, recorder)(http.NotFoundHandler())
+	response := httptest.NewRecorder()
+	middleware.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "https://workspaces.com/callback?code=123&state=https://workspace1.workspaces.com", nil))
+
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	// httptest requests come from 192.0.2.1
+	require.Equal(t, []string{"gl-workspaces/workspace1: " + eventReasonAuthorizationDenied + ": a GitLab user who does not own the workspace was denied access from 192.0.2.1"}, recorder.warnings)
+}
@@ -7,9 +7,23 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 )
 
 func getToken(ctx context.Context, config *Config, code string) (*token, error) {
+	ctx, span := tracing.Start(ctx, "auth.getToken")
+	defer span.End()
+
+	tkn, err := exchangeCode(ctx, config, code)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	return tkn, nil
+}
+
+func exchangeCode(ctx context.Context, config *Config, code string) (*token, error) {
 	u := fmt.Sprintf("%s/oauth/token", config.Host)
 	form := url.Values{
 		"redirect_uri":  []string{config.RedirectURI},
@@ -26,7 +40,7 @@ func getToken(ctx context.Context, config *Config, code string) (*token, error)
 	req = req.WithContext(ctx)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	client := http.Client{}
+	client := http.Client{Transport: tracing.NewTransport(http.DefaultTransport)}
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,92 @@
+// Package cardinality caps the number of distinct values a metric label can
+// take, so that a cluster with many workspaces cannot flood the TSDB.
+package cardinality
+
+import (
+	"sort"
+	"sync"
+)
+
+// OverflowValue replaces label values once the limit is reached.
+const OverflowValue = "other"
+
+// Limiter admits label values until the limit is reached, later values are
+// reported as OverflowValue. A nil Limiter admits every value.
+type Limiter struct {
+	limit    int
+	values   map[string]struct{}
+	onForget []func(value string)
+	sync.Mutex
+}
+
+// NewLimiter creates a limiter for up to limit values, zero or less disables the cap.
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{
+		limit:  limit,
+		values: make(map[string]struct{}),
+	}
+}
+
+// Value returns the label value to use for value. Values are remembered
+// without a cap as well, so that they can be forgotten.
+func (l *Limiter) Value(value string) string {
+	if l == nil {
+		return value
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.values[value]; ok {
+		return value
+	}
+	if l.limit > 0 && len(l.values) >= l.limit {
+		return OverflowValue
+	}
+	l.values[value] = struct{}{}
+	return value
+}
+
+// Values returns the admitted values in order.
+func (l *Limiter) Values() []string {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	values := make([]string, 0, len(l.values))
+	for value := range l.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// OnForget registers fn to be called with every forgotten value, so that the
+// series labelled with it can be deleted.
+func (l *Limiter) OnForget(fn func(value string)) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.onForget = append(l.onForget, fn)
+}
+
+// Forget frees the slot of a value which is not reported anymore, e.g. the
+// name of a deleted workspace.
+func (l *Limiter) Forget(value string) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	delete(l.values, value)
+	onForget := l.onForget
+	l.Unlock()
+
+	for _, fn := range onForget {
+		fn(value)
+	}
+}
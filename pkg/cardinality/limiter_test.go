@@ -0,0 +1,54 @@
+package cardinality
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(2)
+
+	require.Equal(t, "workspace1", limiter.Value("workspace1"))
+	require.Equal(t, "workspace2", limiter.Value("workspace2"))
+	require.Equal(t, OverflowValue, limiter.Value("workspace3"))
+	require.Equal(t, "workspace1", limiter.Value("workspace1"))
+
+	limiter.Forget("workspace1")
+	require.Equal(t, "workspace3", limiter.Value("workspace3"))
+	require.Equal(t, OverflowValue, limiter.Value("workspace1"))
+	require.Equal(t, []string{"workspace2", "workspace3"}, limiter.Values())
+}
+
+func TestLimiterOnForget(t *testing.T) {
+	limiter := NewLimiter(2)
+	var forgotten []string
+	limiter.OnForget(func(value string) {
+		forgotten = append(forgotten, value)
+	})
+
+	limiter.Value("workspace1")
+	limiter.Forget("workspace1")
+	require.Equal(t, []string{"workspace1"}, forgotten)
+
+	var nilLimiter *Limiter
+	nilLimiter.OnForget(func(string) {
+		t.Fatal("a nil limiter forgets nothing")
+	})
+	nilLimiter.Forget("workspace1")
+}
+
+func TestLimiterWithoutLimit(t *testing.T) {
+	var nilLimiter *Limiter
+	require.Equal(t, "workspace1", nilLimiter.Value("workspace1"))
+	nilLimiter.Forget("workspace1")
+
+	require.Empty(t, nilLimiter.Values())
+
+	limiter := NewLimiter(0)
+	for _, value := range []string{"workspace1", "workspace2", "workspace3"} {
+		require.Equal(t, value, limiter.Value(value))
+	}
+	limiter.Forget("workspace2")
+	require.Equal(t, []string{"workspace1", "workspace3"}, limiter.Values())
+}
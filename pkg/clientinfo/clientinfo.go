@@ -0,0 +1,222 @@
+// Package clientinfo works out the address, scheme and host the client used
+// to reach the proxy. Forwarded headers are only honoured when the request
+// comes from a trusted proxy such as the ingress controller.
+package clientinfo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+)
+
+type contextKey struct{}
+
+type peerContextKey struct{}
+
+// Info describes the original client request.
+type Info struct {
+	// IP is the address of the client, without port
+	IP string
+	// Scheme is "http" or "https" when a trusted proxy reported it and empty
+	// otherwise, the proxy itself only serves plain HTTP
+	Scheme string
+	// Host is the host requested by the client, including the port if any
+	Host string
+}
+
+// SchemeOr returns the scheme of the client request or the fallback when it
+// is not known.
+func (i Info) SchemeOr(fallback string) string {
+	if i.Scheme != "" {
+		return i.Scheme
+	}
+	return fallback
+}
+
+// Hostname returns the host without port.
+func (i Info) Hostname() string {
+	return strings.Split(i.Host, ":")[0]
+}
+
+// ConnContext records the peer of connections which report another client
+// address, like those accepted with the PROXY protocol. It is meant for
+// http.Server.ConnContext.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if peer, ok := conn.(interface{ PeerAddr() net.Addr }); ok {
+		return context.WithValue(ctx, peerContextKey{}, peer.PeerAddr())
+	}
+	return ctx
+}
+
+// NewMiddleware resolves the client info of each request and stores it in the
+// request context. Forwarded headers are ignored unless the peer is in trusted.
+// The peer is the load balancer which sent the PROXY protocol header when the
+// connection was accepted with it, since that is where the headers come from.
+func NewMiddleware(trusted cidr.Set) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := resolve(r, trusted)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, info)))
+		})
+	}
+}
+
+// FromRequest returns the client info resolved by the middleware. Requests
+// which did not pass the middleware are described by their own connection.
+func FromRequest(r *http.Request) Info {
+	if info, ok := r.Context().Value(contextKey{}).(Info); ok {
+		return info
+	}
+	return resolve(r, nil)
+}
+
+func resolve(r *http.Request, trusted cidr.Set) Info {
+	info := Info{
+		IP:   peerIP(r.RemoteAddr),
+		Host: r.Host,
+	}
+
+	if !trustedPeer(r, trusted) {
+		return info
+	}
+
+	if header := r.Header.Values("Forwarded"); len(header) > 0 {
+		elements := parseForwarded(header)
+		if len(elements) == 0 {
+			return info
+		}
+
+		hops := make([]string, 0, len(elements))
+		for _, element := range elements {
+			hops = append(hops, element["for"])
+		}
+		index := clientIndex(hops, trusted)
+		if ip := nodeIP(hops[index]); ip != "" {
+			info.IP = ip
+		}
+		if proto := normalizeScheme(elements[index]["proto"]); proto != "" {
+			info.Scheme = proto
+		}
+		if host := elements[index]["host"]; host != "" {
+			info.Host = host
+		}
+		return info
+	}
+
+	hops := splitList(r.Header.Values("X-Forwarded-For"))
+	index := 0
+	if len(hops) > 0 {
+		index = clientIndex(hops, trusted)
+		if ip := nodeIP(hops[index]); ip != "" {
+			info.IP = ip
+		}
+	}
+	if proto := hopValue(splitList(r.Header.Values("X-Forwarded-Proto")), len(hops), index); proto != "" {
+		if proto = normalizeScheme(proto); proto != "" {
+			info.Scheme = proto
+		}
+	}
+	if host := hopValue(splitList(r.Header.Values("X-Forwarded-Host")), len(hops), index); host != "" {
+		info.Host = host
+	}
+
+	return info
+}
+
+func trustedPeer(r *http.Request, trusted cidr.Set) bool {
+	if peer, ok := r.Context().Value(peerContextKey{}).(net.Addr); ok {
+		return trusted.ContainsAddr(peer)
+	}
+	return trusted.ContainsHostPort(r.RemoteAddr)
+}
+
+// clientIndex walks the hops from the closest proxy outwards and returns the
+// index of the first one which is not trusted. When every hop is trusted the
+// first one is the client.
+func clientIndex(hops []string, trusted cidr.Set) int {
+	for i := len(hops) - 1; i > 0; i-- {
+		ip := net.ParseIP(nodeIP(hops[i]))
+		if ip == nil || !trusted.Contains(ip) {
+			return i
+		}
+	}
+	return 0
+}
+
+// hopValue picks the value of a forwarded header reported by the hop the
+// client address was taken from. Headers which are not appended per hop, like
+// the ones ingress controllers overwrite, cannot be matched to a hop, their
+// last value is the one set by the trusted proxy closest to the proxy.
+func hopValue(values []string, hops int, index int) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if len(values) == hops {
+		return values[index]
+	}
+	return values[len(values)-1]
+}
+
+// parseForwarded parses RFC 7239 Forwarded headers into one map of lowercased
+// parameters per element.
+func parseForwarded(values []string) []map[string]string {
+	var elements []map[string]string
+	for _, element := range splitList(values) {
+		params := map[string]string{}
+		for _, pair := range strings.Split(element, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found {
+				continue
+			}
+			params[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+		elements = append(elements, params)
+	}
+	return elements
+}
+
+// nodeIP extracts the IP of a forwarded node such as "192.0.2.60",
+// "192.0.2.60:4711" or "[2001:db8::1]:4711". Obfuscated and unknown nodes
+// yield an empty string.
+func nodeIP(node string) string {
+	node = strings.TrimSpace(node)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if ip := net.ParseIP(node); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func peerIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+func normalizeScheme(scheme string) string {
+	switch scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme {
+	case "http", "https":
+		return scheme
+	default:
+		return ""
+	}
+}
+
+func splitList(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
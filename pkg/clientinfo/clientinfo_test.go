@@ -0,0 +1,177 @@
+package clientinfo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+)
+
+func TestMiddleware(t *testing.T) {
+	trusted, err := cidr.Parse([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+
+	tt := []struct {
+		description  string
+		remoteAddr   string
+		header       http.Header
+		expectedInfo Info
+	}{
+		{
+			description:  "When the peer is not trusted ignores forwarded headers",
+			remoteAddr:   "192.0.2.1:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"203.0.113.7"}, "X-Forwarded-Proto": []string{"https"}},
+			expectedInfo: Info{IP: "192.0.2.1", Host: "workspace.example.com"},
+		},
+		{
+			description: "When the peer is trusted honours X-Forwarded headers",
+			remoteAddr:  "10.0.0.5:1234",
+			header: http.Header{
+				"X-Forwarded-For":   []string{"203.0.113.7"},
+				"X-Forwarded-Proto": []string{"https"},
+				"X-Forwarded-Host":  []string{"workspace.example.org:8443"},
+			},
+			expectedInfo: Info{IP: "203.0.113.7", Scheme: "https", Host: "workspace.example.org:8443"},
+		},
+		{
+			description:  "When the forwarded chain has trusted hops returns the first untrusted address",
+			remoteAddr:   "10.0.0.5:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"198.51.100.1, 203.0.113.7", "10.0.0.9"}},
+			expectedInfo: Info{IP: "203.0.113.7", Host: "workspace.example.com"},
+		},
+		{
+			description:  "When every hop is trusted returns the first address",
+			remoteAddr:   "10.0.0.5:1234",
+			header:       http.Header{"X-Forwarded-For": []string{"10.0.0.7, 10.0.0.9"}},
+			expectedInfo: Info{IP: "10.0.0.7", Host: "workspace.example.com"},
+		},
+		{
+			description: "When the forwarded headers list every hop uses the values of the client hop",
+			remoteAddr:  "10.0.0.5:1234",
+			header: http.Header{
+				"X-Forwarded-For":   []string{"203.0.113.7, 10.0.0.9"},
+				"X-Forwarded-Proto": []string{"https, http"},
+				"X-Forwarded-Host":  []string{"workspace.example.org, proxy.internal"},
+			},
+			expectedInfo: Info{IP: "203.0.113.7", Scheme: "https", Host: "workspace.example.org"},
+		},
+		{
+			description: "When the client prepends forwarded headers uses the values of the trusted proxy",
+			remoteAddr:  "10.0.0.5:1234",
+			header: http.Header{
+				"X-Forwarded-For":   []string{"203.0.113.7"},
+				"X-Forwarded-Proto": []string{"http, https"},
+				"X-Forwarded-Host":  []string{"evil.example.org, workspace.example.org"},
+			},
+			expectedInfo: Info{IP: "203.0.113.7", Scheme: "https", Host: "workspace.example.org"},
+		},
+		{
+			description:  "When the forwarded scheme is not http or https ignores it",
+			remoteAddr:   "10.0.0.5:1234",
+			header:       http.Header{"X-Forwarded-Proto": []string{"wss"}},
+			expectedInfo: Info{IP: "10.0.0.5", Host: "workspace.example.com"},
+		},
+		{
+			description: "When the peer is trusted honours the Forwarded header",
+			remoteAddr:  "10.0.0.5:1234",
+			header: http.Header{
+				"Forwarded":       []string{`for="[2001:db8::1]:4711";proto=https;host=workspace.example.org, for=10.0.0.9;proto=http`},
+				"X-Forwarded-For": []string{"198.51.100.1"},
+			},
+			expectedInfo: Info{IP: "2001:db8::1", Scheme: "https", Host: "workspace.example.org"},
+		},
+		{
+			description:  "When the Forwarded node is obfuscated keeps the peer address",
+			remoteAddr:   "10.0.0.5:1234",
+			header:       http.Header{"Forwarded": []string{"for=_hidden;proto=https"}},
+			expectedInfo: Info{IP: "10.0.0.5", Scheme: "https", Host: "workspace.example.com"},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			var info Info
+			handler := NewMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info = FromRequest(r)
+			}))
+
+			request := httptest.NewRequest(http.MethodGet, "http://workspace.example.com/path", nil)
+			request.RemoteAddr = tr.remoteAddr
+			if tr.header != nil {
+				request.Header = tr.header
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			require.Equal(t, tr.expectedInfo, info)
+		})
+	}
+}
+
+type proxiedConn struct {
+	net.Conn
+	peer net.Addr
+}
+
+func (c proxiedConn) PeerAddr() net.Addr {
+	return c.peer
+}
+
+func TestMiddlewareWithProxyProtocol(t *testing.T) {
+	trusted, err := cidr.Parse([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+
+	tt := []struct {
+		description  string
+		peer         string
+		expectedInfo Info
+	}{
+		{
+			description:  "When the load balancer is trusted honours forwarded headers",
+			peer:         "10.0.0.5:1234",
+			expectedInfo: Info{IP: "198.51.100.1", Scheme: "https", Host: "workspace.example.com"},
+		},
+		{
+			description:  "When the load balancer is not trusted ignores forwarded headers",
+			peer:         "192.0.2.1:1234",
+			expectedInfo: Info{IP: "203.0.113.7", Host: "workspace.example.com"},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			var info Info
+			handler := NewMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info = FromRequest(r)
+			}))
+
+			peer, err := net.ResolveTCPAddr("tcp", tr.peer)
+			require.Nil(t, err)
+			ctx := ConnContext(context.Background(), proxiedConn{peer: peer})
+
+			// The PROXY protocol header reported the client address
+			request := httptest.NewRequest(http.MethodGet, "http://workspace.example.com/path", nil).WithContext(ctx)
+			request.RemoteAddr = "203.0.113.7:4711"
+			request.Header.Set("X-Forwarded-For", "198.51.100.1")
+			request.Header.Set("X-Forwarded-Proto", "https")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			require.Equal(t, tr.expectedInfo, info)
+		})
+	}
+}
+
+func TestFromRequestWithoutMiddleware(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://workspace.example.com:8080/path", nil)
+	request.RemoteAddr = "10.0.0.5:1234"
+	request.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	info := FromRequest(request)
+
+	require.Equal(t, "10.0.0.5", info.IP)
+	require.Equal(t, "workspace.example.com", info.Hostname())
+	require.Equal(t, "https", info.SchemeOr("https"))
+}
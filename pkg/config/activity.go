@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// Activity configures how workspace activity is reported.
+type Activity struct {
+	// AnnotateServices writes the last activity to an annotation on the
+	// workspace service every AnnotationInterval
+	AnnotateServices   bool          `yaml:"annotate_services"`
+	AnnotationInterval time.Duration `yaml:"annotation_interval"`
+}
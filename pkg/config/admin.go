@@ -0,0 +1,26 @@
+package config
+
+// Admin configures the admin API. It is served on its own port so that it can
+// be kept off the ingress. Requests must carry Token as a bearer token or
+// present a client certificate signed by TLS.ClientCAFile.
+type Admin struct {
+	Enabled bool `yaml:"enabled"`
+	// Address to listen on, only the pod itself can reach the API by default
+	Address string   `yaml:"address"`
+	Port    int      `yaml:"port"`
+	Token   string   `yaml:"token"`
+	TLS     AdminTLS `yaml:"tls"`
+}
+
+// AdminTLS serves the admin API over TLS. When a client CA is set, clients
+// presenting a certificate signed by it need no token.
+type AdminTLS struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// Enabled reports whether the admin API is served over TLS.
+func (t AdminTLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
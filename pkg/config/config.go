@@ -2,21 +2,51 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"time"
 
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/auth"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/discovery"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/k8s"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/logging"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 )
 
-var errAuthConfigInvalid = errors.New("auth config invalid")
+var (
+	errAuthConfigInvalid   = errors.New("auth config invalid")
+	errRoutingModeInvalid  = errors.New("http routing mode must be host or path")
+	errAccessLogInvalid    = errors.New("access log format must be json, combined or off")
+	errAdminAuthMissing    = errors.New("admin API requires a token or a client CA")
+	errAdminTLSInvalid     = errors.New("admin API TLS requires both a certificate and a key")
+	errAdminTokenInsecure  = errors.New("admin API token requires TLS unless the address is a loopback address")
+	errDiscoveryInvalid    = errors.New("discovery provider must be kubernetes or static")
+	errStaticFileMissing   = errors.New("static discovery requires a file")
+	errEndpointsNotWatched = errors.New("routing to endpoints requires watching endpoints")
+	errClusterNameMissing  = errors.New("every cluster needs a name when several clusters are watched")
+	errClusterNameTaken    = errors.New("cluster names must be unique")
+)
 
 type Config struct {
 	Auth        auth.Config `yaml:"auth"`
 	MetricsPath string      `yaml:"metrics_path"`
-	LogLevel    string      `yaml:"log_level"`
-	HTTP        HTTP        `yaml:"http"`
-	SSH         SSH         `yaml:"ssh"`
+	// MetricsWorkspaceLabelLimit caps the distinct workspace label values,
+	// further workspaces are reported as "other"
+	MetricsWorkspaceLabelLimit int                     `yaml:"metrics_workspace_label_limit"`
+	LogLevel                   string                  `yaml:"log_level"`
+	HTTP                       HTTP                    `yaml:"http"`
+	SSH                        SSH                     `yaml:"ssh"`
+	Admin                      Admin                   `yaml:"admin"`
+	Activity                   Activity                `yaml:"activity"`
+	Tracing                    tracing.Config          `yaml:"tracing"`
+	AccessLog                  logging.AccessLogConfig `yaml:"access_log"`
+	LogRedaction               logz.Redaction          `yaml:"log_redaction"`
+	Discovery                  discovery.Config        `yaml:"discovery"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -49,15 +79,102 @@ func (c *Config) setDefaults() error {
 		c.MetricsPath = "/metrics"
 	}
 
+	if c.MetricsWorkspaceLabelLimit == 0 {
+		c.MetricsWorkspaceLabelLimit = 500
+	}
+
 	if c.LogLevel == "" {
 		c.LogLevel = "info"
 	}
 
 	c.setHTTPDefaults()
 	c.setSSHDefaults()
+	c.setAdminDefaults()
+	c.setActivityDefaults()
+	c.setTracingDefaults()
+	c.setAccessLogDefaults()
+	c.setLogRedactionDefaults()
+	c.setDiscoveryDefaults()
+
+	if !routing.IsValidMode(c.HTTP.Routing.Mode) {
+		return errRoutingModeInvalid
+	}
+
+	if !logging.IsValidFormat(c.AccessLog.Format) {
+		return errAccessLogInvalid
+	}
+
+	if err := c.HTTP.ProxyProtocol.validate(); err != nil {
+		return fmt.Errorf("http proxy_protocol: %w", err)
+	}
+
+	if err := c.SSH.ProxyProtocol.validate(); err != nil {
+		return fmt.Errorf("ssh proxy_protocol: %w", err)
+	}
+
+	if err := c.validateDiscovery(); err != nil {
+		return err
+	}
+
+	return c.validateAdmin()
+}
+
+func (c *Config) validateDiscovery() error {
+	if !discovery.IsValidProvider(c.Discovery.Provider) {
+		return errDiscoveryInvalid
+	}
+
+	if c.Discovery.Provider == discovery.ProviderStatic && c.Discovery.Static.File == "" {
+		return errStaticFileMissing
+	}
+
+	if c.Discovery.Kubernetes.RouteToEndpoints && !c.Discovery.Kubernetes.WatchEndpoints {
+		return errEndpointsNotWatched
+	}
+
+	clusters := c.Discovery.Kubernetes.Clusters
+	names := make(map[string]bool, len(clusters))
+	for _, cluster := range clusters {
+		if cluster.Name == "" && len(clusters) > 1 {
+			return errClusterNameMissing
+		}
+		if names[cluster.Name] {
+			return errClusterNameTaken
+		}
+		names[cluster.Name] = true
+	}
 	return nil
 }
 
+func (c *Config) validateAdmin() error {
+	if !c.Admin.Enabled {
+		return nil
+	}
+
+	tls := c.Admin.TLS
+	if (tls.Enabled() || tls.ClientCAFile != "") && (tls.CertFile == "" || tls.KeyFile == "") {
+		return errAdminTLSInvalid
+	}
+
+	if c.Admin.Token == "" && tls.ClientCAFile == "" {
+		return errAdminAuthMissing
+	}
+
+	// The token would travel in clear text over the network
+	if c.Admin.Token != "" && !tls.Enabled() && !isLoopback(c.Admin.Address) {
+		return errAdminTokenInsecure
+	}
+	return nil
+}
+
+func isLoopback(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
 func (c *Config) setSSHDefaults() {
 	if c.SSH.BackendUsername == "" {
 		c.SSH.BackendUsername = "gitlab-workspaces"
@@ -68,10 +185,92 @@ func (c *Config) setSSHDefaults() {
 	}
 }
 
+func (c *Config) setAdminDefaults() {
+	if c.Admin.Address == "" {
+		c.Admin.Address = "127.0.0.1"
+	}
+
+	if c.Admin.Port == 0 {
+		c.Admin.Port = 9877
+	}
+}
+
+func (c *Config) setActivityDefaults() {
+	if c.Activity.AnnotationInterval == 0 {
+		c.Activity.AnnotationInterval = time.Minute
+	}
+}
+
+func (c *Config) setDiscoveryDefaults() {
+	if c.Discovery.Provider == "" {
+		c.Discovery.Provider = discovery.ProviderKubernetes
+	}
+
+	if c.Discovery.Kubernetes.ResyncPeriod == 0 {
+		c.Discovery.Kubernetes.ResyncPeriod = k8s.DefaultResyncPeriod
+	}
+
+	if c.Discovery.Kubernetes.EventInterval == 0 {
+		c.Discovery.Kubernetes.EventInterval = k8s.DefaultEventInterval
+	}
+
+	if c.Discovery.Static.PollInterval == 0 {
+		c.Discovery.Static.PollInterval = discovery.DefaultPollInterval
+	}
+}
+
+func (c *Config) setTracingDefaults() {
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = tracing.DefaultServiceName
+	}
+
+	if c.Tracing.SampleRatio == nil {
+		sampleRatio := tracing.DefaultSampleRatio
+		c.Tracing.SampleRatio = &sampleRatio
+	}
+}
+
+func (c *Config) setLogRedactionDefaults() {
+	defaults := logz.DefaultRedaction()
+	if len(c.LogRedaction.QueryParams) == 0 {
+		c.LogRedaction.QueryParams = defaults.QueryParams
+	}
+
+	if len(c.LogRedaction.Headers) == 0 {
+		c.LogRedaction.Headers = defaults.Headers
+	}
+}
+
+func (c *Config) setAccessLogDefaults() {
+	if c.AccessLog.Format == "" {
+		c.AccessLog.Format = logging.FormatJSON
+	}
+}
+
 func (c *Config) setHTTPDefaults() {
 	if c.HTTP.Port == 0 {
 		c.HTTP.Port = 9876
 	}
+
+	if c.HTTP.Routing.Mode == "" {
+		c.HTTP.Routing.Mode = routing.ModeHost
+	}
+
+	if c.HTTP.Routing.PathPrefix == "" {
+		c.HTTP.Routing.PathPrefix = routing.DefaultPathPrefix
+	}
+
+	if c.HTTP.UpstreamRetry.MaxAttempts == 0 {
+		c.HTTP.UpstreamRetry.MaxAttempts = 4
+	}
+
+	if c.HTTP.UpstreamRetry.InitialBackoff == 0 {
+		c.HTTP.UpstreamRetry.InitialBackoff = 250 * time.Millisecond
+	}
+
+	if c.HTTP.UpstreamRetry.MaxBackoff == 0 {
+		c.HTTP.UpstreamRetry.MaxBackoff = 2 * time.Second
+	}
 }
 
 func (c *Config) GetZapLevel() (zap.AtomicLevel, error) {
@@ -2,8 +2,15 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/discovery"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/k8s"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/logging"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 	"go.uber.org/zap"
 )
 
@@ -99,6 +106,402 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+func TestLoadConfigUpstreamRetry(t *testing.T) {
+	tt := []struct {
+		description    string
+		filename       string
+		expectedResult UpstreamRetry
+	}{
+		{
+			description: "When upstream retry is not present in config, defaults upstream retry",
+			filename:    "./fixtures/sample.yaml",
+			expectedResult: UpstreamRetry{
+				MaxAttempts:    4,
+				InitialBackoff: 250 * time.Millisecond,
+				MaxBackoff:     2 * time.Second,
+			},
+		},
+		{
+			description: "When upstream retry is present in config, loads upstream retry",
+			filename:    "./fixtures/sample_with_upstream_retry.yaml",
+			expectedResult: UpstreamRetry{
+				MaxAttempts:    2,
+				InitialBackoff: 100 * time.Millisecond,
+				MaxBackoff:     time.Second,
+			},
+		},
+		{
+			description: "When max attempts is 1, keeps retries off",
+			filename:    "./fixtures/sample_with_upstream_retry_off.yaml",
+			expectedResult: UpstreamRetry{
+				MaxAttempts:    1,
+				InitialBackoff: 250 * time.Millisecond,
+				MaxBackoff:     2 * time.Second,
+			},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, config.HTTP.UpstreamRetry)
+		})
+	}
+}
+
+func TestLoadConfigRouting(t *testing.T) {
+	tt := []struct {
+		description    string
+		filename       string
+		expectedError  bool
+		expectedResult Routing
+	}{
+		{
+			description:    "When routing is not present in config, defaults to host routing",
+			filename:       "./fixtures/sample.yaml",
+			expectedResult: Routing{Mode: routing.ModeHost, PathPrefix: "/w"},
+		},
+		{
+			description:    "When path routing is present in config, loads routing",
+			filename:       "./fixtures/sample_with_path_routing.yaml",
+			expectedResult: Routing{Mode: routing.ModePath, PathPrefix: "/workspaces/"},
+		},
+		{
+			description:   "When the routing mode is unknown throws error",
+			filename:      "./fixtures/sample_with_invalid_routing.yaml",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, config.HTTP.Routing)
+		})
+	}
+}
+
+func TestLoadConfigTracing(t *testing.T) {
+	tt := []struct {
+		description    string
+		filename       string
+		expectedResult tracing.Config
+	}{
+		{
+			description:    "When tracing is not present in config, tracing is disabled",
+			filename:       "./fixtures/sample.yaml",
+			expectedResult: tracing.Config{SampleRatio: ptr(1.0), ServiceName: "gitlab-workspaces-proxy"},
+		},
+		{
+			description: "When tracing is present in config, loads tracing",
+			filename:    "./fixtures/sample_with_tracing.yaml",
+			expectedResult: tracing.Config{
+				Enabled:     true,
+				Endpoint:    "http://otel-collector:4318",
+				SampleRatio: ptr(0.1),
+				ServiceName: "gitlab-workspaces-proxy",
+			},
+		},
+		{
+			description: "When the sample ratio is zero, keeps it",
+			filename:    "./fixtures/sample_with_tracing_sample_ratio_zero.yaml",
+			expectedResult: tracing.Config{
+				Enabled:     true,
+				SampleRatio: ptr(0.0),
+				ServiceName: "gitlab-workspaces-proxy",
+			},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, config.Tracing)
+		})
+	}
+}
+
+func TestLoadConfigAccessLog(t *testing.T) {
+	tt := []struct {
+		description    string
+		filename       string
+		expectedError  bool
+		expectedResult logging.AccessLogConfig
+	}{
+		{
+			description: "When the access log is not present in config, defaults to JSON",
+			filename:    "./fixtures/sample.yaml",
+			expectedResult: logging.AccessLogConfig{
+				Format: logging.FormatJSON,
+			},
+		},
+		{
+			description: "When the access log is present in config, loads access log",
+			filename:    "./fixtures/sample_with_access_log.yaml",
+			expectedResult: logging.AccessLogConfig{
+				Format:             logging.FormatCombined,
+				LogHeaders:         true,
+				RedactPathPatterns: []string{"glpat-[0-9A-Za-z_-]+"},
+			},
+		},
+		{
+			description:   "When the access log format is unknown throws error",
+			filename:      "./fixtures/sample_with_invalid_access_log.yaml",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, config.AccessLog)
+		})
+	}
+}
+
+func TestLoadConfigAdmin(t *testing.T) {
+	tt := []struct {
+		description    string
+		filename       string
+		expectedError  bool
+		expectedResult Admin
+	}{
+		{
+			description:    "When admin is not present in config, the admin API is disabled",
+			filename:       "./fixtures/sample.yaml",
+			expectedResult: Admin{Address: "127.0.0.1", Port: 9877},
+		},
+		{
+			description: "When admin is present in config, loads admin",
+			filename:    "./fixtures/sample_with_admin.yaml",
+			expectedResult: Admin{
+				Enabled: true,
+				Address: "0.0.0.0",
+				Port:    9000,
+				Token:   "ADMIN_TOKEN",
+				TLS: AdminTLS{
+					CertFile:     "/etc/admin/tls.crt",
+					KeyFile:      "/etc/admin/tls.key",
+					ClientCAFile: "/etc/admin/ca.crt",
+				},
+			},
+		},
+		{
+			description:   "When admin is enabled without a token or client CA throws error",
+			filename:      "./fixtures/sample_with_admin_without_auth.yaml",
+			expectedError: true,
+		},
+		{
+			description:   "When admin has a client CA without a certificate throws error",
+			filename:      "./fixtures/sample_with_admin_invalid_tls.yaml",
+			expectedError: true,
+		},
+		{
+			description: "When admin has a token without TLS on localhost, loads admin",
+			filename:    "./fixtures/sample_with_admin_token.yaml",
+			expectedResult: Admin{
+				Enabled: true,
+				Address: "127.0.0.1",
+				Port:    9877,
+				Token:   "ADMIN_TOKEN",
+			},
+		},
+		{
+			description:   "When admin has a token without TLS on all interfaces throws error",
+			filename:      "./fixtures/sample_with_admin_token_insecure.yaml",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, config.Admin)
+		})
+	}
+}
+
+func TestLoadConfigProxyProtocol(t *testing.T) {
+	tt := []struct {
+		description          string
+		filename             string
+		expectedError        bool
+		expectedHTTPProtocol ProxyProtocol
+		expectedSSHProtocol  ProxyProtocol
+	}{
+		{
+			description:          "When PROXY protocol is present in config, loads it",
+			filename:             "./fixtures/sample_with_proxy_protocol.yaml",
+			expectedHTTPProtocol: ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8"}},
+			expectedSSHProtocol:  ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8", "192.168.1.10"}},
+		},
+		{
+			description:   "When PROXY protocol is enabled without trusted CIDRs throws error",
+			filename:      "./fixtures/sample_with_proxy_protocol_without_cidrs.yaml",
+			expectedError: true,
+		},
+		{
+			description:   "When PROXY protocol has an invalid trusted CIDR throws error",
+			filename:      "./fixtures/sample_with_proxy_protocol_invalid_cidr.yaml",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedHTTPProtocol, config.HTTP.ProxyProtocol)
+			require.Equal(t, tr.expectedSSHProtocol, config.SSH.ProxyProtocol)
+		})
+	}
+}
+
+func TestLoadConfigDiscovery(t *testing.T) {
+	tt := []struct {
+		description    string
+		filename       string
+		expectedError  bool
+		expectedResult discovery.Config
+	}{
+		{
+			description: "When discovery is not present in config, defaults to kubernetes",
+			filename:    "./fixtures/sample.yaml",
+			expectedResult: discovery.Config{
+				Provider: discovery.ProviderKubernetes,
+				Kubernetes: discovery.KubernetesConfig{
+					WatchConfig:   k8s.WatchConfig{ResyncPeriod: k8s.DefaultResyncPeriod},
+					EventInterval: k8s.DefaultEventInterval,
+				},
+				Static: discovery.StaticConfig{PollInterval: discovery.DefaultPollInterval},
+			},
+		},
+		{
+			description: "When static discovery is present in config, loads discovery",
+			filename:    "./fixtures/sample_with_static_discovery.yaml",
+			expectedResult: discovery.Config{
+				Provider: discovery.ProviderStatic,
+				Kubernetes: discovery.KubernetesConfig{
+					WatchConfig:   k8s.WatchConfig{ResyncPeriod: k8s.DefaultResyncPeriod},
+					EventInterval: k8s.DefaultEventInterval,
+				},
+				Static: discovery.StaticConfig{File: "/etc/workspaces/mappings.yaml", PollInterval: 5 * time.Second},
+			},
+		},
+		{
+			description:   "When static discovery has no file throws error",
+			filename:      "./fixtures/sample_with_static_discovery_without_file.yaml",
+			expectedError: true,
+		},
+		{
+			description: "When endpoint watching is present in config, loads discovery",
+			filename:    "./fixtures/sample_with_endpoint_routing.yaml",
+			expectedResult: discovery.Config{
+				Provider: discovery.ProviderKubernetes,
+				Kubernetes: discovery.KubernetesConfig{
+					WatchConfig:      k8s.WatchConfig{ResyncPeriod: k8s.DefaultResyncPeriod},
+					WatchEndpoints:   true,
+					RouteToEndpoints: true,
+					EventInterval:    k8s.DefaultEventInterval,
+				},
+				Static: discovery.StaticConfig{PollInterval: discovery.DefaultPollInterval},
+			},
+		},
+		{
+			description: "When the watch scope is present in config, loads discovery",
+			filename:    "./fixtures/sample_with_watch_scope.yaml",
+			expectedResult: discovery.Config{
+				Provider: discovery.ProviderKubernetes,
+				Kubernetes: discovery.KubernetesConfig{
+					WatchConfig: k8s.WatchConfig{
+						Namespaces:    []string{"team-a", "team-b"},
+						LabelSelector: "workspaces.gitlab.com/tier=premium",
+						FieldSelector: "metadata.name!=ignored",
+						ResyncPeriod:  10 * time.Minute,
+					},
+					EventInterval: time.Minute,
+				},
+				Static: discovery.StaticConfig{PollInterval: discovery.DefaultPollInterval},
+			},
+		},
+		{
+			description:   "When routing to endpoints without watching them throws error",
+			filename:      "./fixtures/sample_with_endpoint_routing_without_watch.yaml",
+			expectedError: true,
+		},
+		{
+			description: "When several clusters are present in config, loads discovery",
+			filename:    "./fixtures/sample_with_clusters.yaml",
+			expectedResult: discovery.Config{
+				Provider: discovery.ProviderKubernetes,
+				Kubernetes: discovery.KubernetesConfig{
+					WatchConfig: k8s.WatchConfig{ResyncPeriod: k8s.DefaultResyncPeriod},
+					Clusters: []k8s.ClusterConfig{
+						{Name: "local"},
+						{Name: "east", Kubeconfig: "/app/kubeconfig/config", Context: "east"},
+					},
+					EventInterval: k8s.DefaultEventInterval,
+				},
+				Static: discovery.StaticConfig{PollInterval: discovery.DefaultPollInterval},
+			},
+		},
+		{
+			description:   "When one of several clusters has no name throws error",
+			filename:      "./fixtures/sample_with_unnamed_cluster.yaml",
+			expectedError: true,
+		},
+		{
+			description:   "When the discovery provider is unknown throws error",
+			filename:      "./fixtures/sample_with_invalid_discovery.yaml",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			config, err := LoadConfig(tr.filename)
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedResult, config.Discovery)
+		})
+	}
+}
+
+func TestLoadConfigLogRedaction(t *testing.T) {
+	config, err := LoadConfig("./fixtures/sample.yaml")
+	require.Nil(t, err)
+	require.Equal(t, logz.DefaultRedaction(), config.LogRedaction)
+}
+
 func TestGetZapLevel(t *testing.T) {
 	tt := []struct {
 		description    string
@@ -135,3 +538,7 @@ func TestGetZapLevel(t *testing.T) {
 		})
 	}
 }
+
+func ptr[T any](value T) *T {
+	return &value
+}
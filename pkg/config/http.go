@@ -1,6 +1,48 @@
 package config
 
+import (
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+)
+
 type HTTP struct {
-	Enabled bool `yaml:"enabled"`
-	Port    int  `yaml:"port"`
+	Enabled       bool          `yaml:"enabled"`
+	Port          int           `yaml:"port"`
+	UpstreamRetry UpstreamRetry `yaml:"upstream_retry"`
+	BackendTLS    BackendTLS    `yaml:"backend_tls"`
+	ProxyProtocol ProxyProtocol `yaml:"proxy_protocol"`
+	// TrustedProxies lists the CIDRs, e.g. of the ingress controller, whose
+	// Forwarded and X-Forwarded-* headers describe the client request. With
+	// the PROXY protocol they are matched against the load balancer which sent
+	// the header rather than the client address it reported.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Routing        Routing  `yaml:"routing"`
+}
+
+// Routing selects how a request is mapped to a workspace. In path mode
+// workspaces are served below <path_prefix>/<workspace-name>/<port>/ so that
+// no wildcard DNS record or certificate is needed. Path mode gives workspaces
+// no origin isolation: all of them share one origin, so scripts served by one
+// workspace can read the cookies and storage of every other workspace the user
+// opened.
+type Routing struct {
+	Mode       routing.Mode `yaml:"mode"`
+	PathPrefix string       `yaml:"path_prefix"`
+}
+
+// BackendTLS configures the trust roots used to verify https workspace backends.
+type BackendTLS struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string `yaml:"ca_file"`
+}
+
+// UpstreamRetry controls how idempotent requests are retried while a
+// workspace backend refuses connections, e.g. while its pod is restarting.
+type UpstreamRetry struct {
+	// MaxAttempts includes the first attempt, 1 turns retries off. Zero or
+	// an unset value uses the default.
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
 }
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"errors"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+)
+
+var errProxyProtocolCIDRsMissing = errors.New("PROXY protocol requires trusted CIDRs")
+
+// ProxyProtocol enables parsing of PROXY protocol headers sent by a load
+// balancer. Headers are only honoured on connections from TrustedCIDRs.
+type ProxyProtocol struct {
+	Enabled      bool     `yaml:"enabled"`
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
+}
+
+func (p ProxyProtocol) validate() error {
+	if !p.Enabled {
+		return nil
+	}
+
+	if len(p.TrustedCIDRs) == 0 {
+		return errProxyProtocolCIDRsMissing
+	}
+
+	_, err := cidr.Parse(p.TrustedCIDRs)
+	return err
+}
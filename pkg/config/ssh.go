@@ -1,9 +1,11 @@
 package config
 
 type SSH struct {
-	Enabled         bool   `yaml:"enabled"`
-	Port            int    `yaml:"port"`
-	HostKey         string `yaml:"host_key"`
-	BackendPort     int    `yaml:"backend_port"`
-	BackendUsername string `yaml:"backend_username"`
+	Enabled bool   `yaml:"enabled"`
+	Port    int    `yaml:"port"`
+	HostKey string `yaml:"host_key"`
+	// BackendPort is used for workspaces whose service has no port named ssh
+	BackendPort     int           `yaml:"backend_port"`
+	BackendUsername string        `yaml:"backend_username"`
+	ProxyProtocol   ProxyProtocol `yaml:"proxy_protocol"`
 }
@@ -0,0 +1,75 @@
+// Package discovery feeds the upstream tracker with the host mappings of
+// workspaces, either from Kubernetes services or from a static file.
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/k8s"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+// ProviderName selects where workspaces are discovered.
+type ProviderName string
+
+const (
+	ProviderKubernetes ProviderName = "kubernetes"
+	// ProviderStatic reads host mappings from a YAML file, e.g. for local
+	// development without a cluster
+	ProviderStatic ProviderName = "static"
+)
+
+// DefaultPollInterval is how often the static file is checked for changes.
+const DefaultPollInterval = 2 * time.Second
+
+func IsValidProvider(name ProviderName) bool {
+	switch name {
+	case ProviderKubernetes, ProviderStatic:
+		return true
+	default:
+		return false
+	}
+}
+
+// Provider discovers workspaces and keeps their host mappings in the tracker
+// up to date.
+type Provider interface {
+	// Start returns once the initial host mappings are in the tracker, so that
+	// the proxy starts with complete routes, and keeps updating them in the
+	// background until the context is done.
+	Start(ctx context.Context, tracker *upstream.Tracker) error
+}
+
+type Config struct {
+	Provider   ProviderName     `yaml:"provider"`
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	Static     StaticConfig     `yaml:"static"`
+}
+
+// KubernetesConfig configures the Kubernetes provider.
+type KubernetesConfig struct {
+	k8s.WatchConfig `yaml:",inline"`
+	// Clusters to discover workspaces in, each with its own informers feeding
+	// the shared tracker. When empty the cluster of the -kubeconfig flag, or
+	// the in-cluster configuration, is used. Requests to workspaces in remote
+	// clusters are sent to the service name, which must therefore resolve from
+	// the proxy, unless RouteToEndpoints is used on a flat pod network.
+	Clusters []k8s.ClusterConfig `yaml:"clusters"`
+	// WatchEndpoints records the readiness of every workspace port from the
+	// endpoint slices of the workspace service
+	WatchEndpoints bool `yaml:"watch_endpoints"`
+	// RouteToEndpoints sends requests straight to ready pods instead of the
+	// service, skipping kube-proxy. It requires WatchEndpoints.
+	RouteToEndpoints bool `yaml:"route_to_endpoints"`
+	// EventInterval is how often the same problem is reported as an event on
+	// a workspace service
+	EventInterval time.Duration `yaml:"event_interval"`
+}
+
+// StaticConfig configures the static provider. The file lists host mappings
+// below a mappings key and is reloaded whenever it changes.
+type StaticConfig struct {
+	File         string        `yaml:"file"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
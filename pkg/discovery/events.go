@@ -0,0 +1,27 @@
+package discovery
+
+// EventRecorder reports problems to the owner of a workspace, e.g. when
+// access to the workspace is denied. Workspace owners cannot read the proxy
+// logs, but they see the events with kubectl describe.
+type EventRecorder interface {
+	RecordWorkspaceWarning(cluster, namespace, workspaceName, reason, message string)
+}
+
+// providerEventRecorder records warnings on workspace services through the
+// provider of the cluster the workspace was discovered in.
+type providerEventRecorder struct {
+	providers map[string]*KubernetesProvider
+}
+
+// NewEventRecorder creates a recorder for providers keyed by cluster name.
+func NewEventRecorder(providers map[string]*KubernetesProvider) EventRecorder {
+	return &providerEventRecorder{providers: providers}
+}
+
+// RecordWorkspaceWarning records a warning on the workspace service. Workspaces
+// which were not discovered from Kubernetes are skipped.
+func (r *providerEventRecorder) RecordWorkspaceWarning(cluster, namespace, workspaceName, reason, message string) {
+	if provider, ok := r.providers[cluster]; ok {
+		provider.RecordWorkspaceWarning(namespace, workspaceName, reason, message)
+	}
+}
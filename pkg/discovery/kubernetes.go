@@ -0,0 +1,434 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/k8s"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	workspaceHostTemplateAnnotation = "workspaces.gitlab.com/host-template"
+	workspaceIDAnnotation           = "workspaces.gitlab.com/id"
+	// workspaceStreamingPortsAnnotation lists the names or numbers of the service
+	// ports whose responses are flushed immediately, e.g. "3000,jupyter".
+	workspaceStreamingPortsAnnotation = "workspaces.gitlab.com/streaming-ports"
+	// workspaceBackendProtocolsAnnotation maps service port names or numbers to the
+	// protocol spoken by the backend, e.g. "grpc-api=grpc,8443=https". Ports which
+	// are not listed use plain HTTP.
+	workspaceBackendProtocolsAnnotation = "workspaces.gitlab.com/backend-protocols"
+	// The backend TLS annotations apply to every https port of the workspace. The CA
+	// secret must live in the namespace of the service and hold the bundle in ca.crt.
+	workspaceBackendTLSServerNameAnnotation         = "workspaces.gitlab.com/backend-tls-server-name"
+	workspaceBackendCASecretAnnotation              = "workspaces.gitlab.com/backend-ca-secret"
+	workspaceBackendTLSInsecureSkipVerifyAnnotation = "workspaces.gitlab.com/backend-tls-insecure-skip-verify"
+	backendCASecretKey                              = "ca.crt"
+)
+
+// Reasons of the events recorded on workspace services with invalid annotations.
+const (
+	eventReasonMissingHostTemplate     = "MissingHostTemplate"
+	eventReasonMissingWorkspaceID      = "MissingWorkspaceID"
+	eventReasonInvalidHostTemplate     = "InvalidHostTemplate"
+	eventReasonInvalidBackendProtocols = "InvalidBackendProtocols"
+	eventReasonHostnameConflict        = "HostnameConflict"
+)
+
+// KubernetesProvider discovers workspaces from the services labelled with
+// k8s.WorkspaceServiceLabel. With WatchEndpoints the readiness of every port
+// is taken from the endpoint slices of the service. A provider watches a
+// single cluster, one is started per cluster to discover several.
+type KubernetesProvider struct {
+	logger  *zap.Logger
+	client  k8s.Client
+	cluster string
+	config  KubernetesConfig
+
+	mu sync.Mutex
+	// services and slices are keyed by the namespace and name of the service
+	services map[string]*serviceState
+	slices   map[string]map[string]*discoveryv1.EndpointSlice
+}
+
+// serviceState holds the mappings of a service before readiness is applied,
+// so that endpoint changes do not require reading the service secrets again.
+type serviceState struct {
+	source   string
+	service  *v1.Service
+	mappings []upstream.HostMapping
+}
+
+// NewKubernetesProvider creates a provider for the cluster the client talks
+// to. The mappings it discovers are tagged with the cluster name.
+func NewKubernetesProvider(logger *zap.Logger, client k8s.Client, cluster string, config KubernetesConfig) *KubernetesProvider {
+	if cluster != "" {
+		logger = logger.With(logz.Cluster(cluster))
+	}
+
+	return &KubernetesProvider{
+		logger:   logger,
+		client:   client,
+		cluster:  cluster,
+		config:   config,
+		services: make(map[string]*serviceState),
+		slices:   make(map[string]map[string]*discoveryv1.EndpointSlice),
+	}
+}
+
+// Start returns once the informer caches are synced. Endpoint slices are
+// synced first so that services are not reported as not ready on startup.
+func (p *KubernetesProvider) Start(ctx context.Context, tracker *upstream.Tracker) error {
+	if p.config.WatchEndpoints {
+		err := p.client.GetEndpointSlices(ctx, func(action k8s.InformerAction, slice *discoveryv1.EndpointSlice) {
+			p.reconcileEndpointSlice(tracker, action, slice)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.client.GetService(ctx, func(action k8s.InformerAction, svc *v1.Service) {
+		p.reconcile(ctx, tracker, action, svc)
+	})
+}
+
+func serviceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func (p *KubernetesProvider) reconcile(ctx context.Context, tracker *upstream.Tracker, action k8s.InformerAction, svc *v1.Service) {
+	key := serviceKey(svc.Namespace, svc.Name)
+	// Every event replaces the full set of mappings of the service so
+	// that renamed or removed ports do not stay routable. UIDs are only
+	// unique within a cluster.
+	source := p.cluster + "/" + string(svc.UID)
+	if action == k8s.InformerActionDelete {
+		p.mu.Lock()
+		delete(p.services, key)
+		p.mu.Unlock()
+		tracker.DeleteSource(source)
+		return
+	}
+
+	workspaceHostTemplate := svc.Annotations[workspaceHostTemplateAnnotation]
+	workspaceID := svc.Annotations[workspaceIDAnnotation]
+
+	var mappings []upstream.HostMapping
+	switch {
+	case workspaceHostTemplate == "":
+		p.logger.Error("workspace host template annotation not available on kubernetes service",
+			logz.ServiceName(svc.Name),
+			logz.ServiceNamespace(svc.Namespace),
+		)
+		p.client.RecordServiceEvent(svc, v1.EventTypeWarning, eventReasonMissingHostTemplate,
+			fmt.Sprintf("the %s annotation is missing, the workspace is not routed", workspaceHostTemplateAnnotation))
+	case workspaceID == "":
+		p.logger.Error("workspace id annotation not available on kubernetes service",
+			logz.ServiceName(svc.Name),
+			logz.ServiceNamespace(svc.Namespace),
+		)
+		p.client.RecordServiceEvent(svc, v1.EventTypeWarning, eventReasonMissingWorkspaceID,
+			fmt.Sprintf("the %s annotation is missing, the workspace is not routed", workspaceIDAnnotation))
+	default:
+		var err error
+		mappings, err = hostMappings(workspaceID, workspaceHostTemplate, svc, p.backendProtocols(svc), backendTLS(ctx, p.client, svc, p.logger))
+		if err != nil {
+			p.logger.Error("failed to compute workspace host mappings",
+				logz.Error(err),
+				logz.ServiceName(svc.Name),
+				logz.ServiceNamespace(svc.Namespace),
+				logz.WorkspaceHostTemplate(workspaceHostTemplate),
+			)
+			p.client.RecordServiceEvent(svc, v1.EventTypeWarning, eventReasonInvalidHostTemplate, err.Error())
+		}
+	}
+	for i := range mappings {
+		mappings[i].Cluster = p.cluster
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := &serviceState{source: source, service: svc, mappings: mappings}
+	p.services[key] = state
+	p.publish(tracker, key, state)
+}
+
+// RecordWorkspaceWarning records a warning on the service of a workspace
+// discovered by this provider. The service of a workspace is named after it.
+func (p *KubernetesProvider) RecordWorkspaceWarning(namespace, workspaceName, reason, message string) {
+	p.mu.Lock()
+	state, ok := p.services[serviceKey(namespace, workspaceName)]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	p.client.RecordServiceEvent(state.service, v1.EventTypeWarning, reason, message)
+}
+
+// backendProtocols parses the backend protocols annotation of the service,
+// every port falls back to http when it is invalid.
+func (p *KubernetesProvider) backendProtocols(svc *v1.Service) map[string]string {
+	protocols, err := parsePortProtocols(svc.Annotations[workspaceBackendProtocolsAnnotation])
+	if err != nil {
+		p.logger.Error("failed to parse workspace backend protocols, falling back to http",
+			logz.Error(err),
+			logz.ServiceName(svc.Name),
+			logz.ServiceNamespace(svc.Namespace),
+		)
+		p.client.RecordServiceEvent(svc, v1.EventTypeWarning, eventReasonInvalidBackendProtocols, err.Error())
+		return map[string]string{}
+	}
+	return protocols
+}
+
+func (p *KubernetesProvider) reconcileEndpointSlice(tracker *upstream.Tracker, action k8s.InformerAction, slice *discoveryv1.EndpointSlice) {
+	serviceName := slice.Labels[discoveryv1.LabelServiceName]
+	if serviceName == "" {
+		return
+	}
+	key := serviceKey(slice.Namespace, serviceName)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if action == k8s.InformerActionDelete {
+		delete(p.slices[key], slice.Name)
+		if len(p.slices[key]) == 0 {
+			delete(p.slices, key)
+		}
+	} else {
+		if p.slices[key] == nil {
+			p.slices[key] = make(map[string]*discoveryv1.EndpointSlice)
+		}
+		p.slices[key][slice.Name] = slice
+	}
+
+	if state, ok := p.services[key]; ok {
+		p.publish(tracker, key, state)
+	}
+}
+
+// publish replaces the mappings of a service in the tracker and reports new
+// hostname conflicts on the service. The caller must hold the lock.
+func (p *KubernetesProvider) publish(tracker *upstream.Tracker, key string, state *serviceState) {
+	mappings := state.mappings
+	if p.config.WatchEndpoints {
+		mappings = make([]upstream.HostMapping, 0, len(state.mappings))
+		for _, mapping := range state.mappings {
+			mappings = append(mappings, p.withReadiness(mapping, p.slices[key]))
+		}
+	}
+
+	for _, conflict := range tracker.Replace(state.source, mappings) {
+		owner := conflict.Owner
+		p.client.RecordServiceEvent(state.service, v1.EventTypeWarning, eventReasonHostnameConflict, fmt.Sprintf(
+			"hostname %s of port %d is already served by port %d of workspace %s in namespace %s, it is not routed until the other workspace is removed",
+			conflict.Mapping.Hostname, conflict.Mapping.BackendPort, owner.BackendPort, owner.WorkspaceName, owner.Namespace))
+	}
+}
+
+// withReadiness records whether any pod is ready to serve the port of the
+// mapping. Endpoint slice ports are matched to service ports by name.
+func (p *KubernetesProvider) withReadiness(mapping upstream.HostMapping, slices map[string]*discoveryv1.EndpointSlice) upstream.HostMapping {
+	addresses := make(map[string]bool)
+	for _, slice := range slices {
+		for _, port := range slice.Ports {
+			if port.Port == nil || portName(port) != mapping.PortName {
+				continue
+			}
+
+			for _, endpoint := range slice.Endpoints {
+				// A missing condition means the endpoint is ready
+				if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+					continue
+				}
+				for _, address := range endpoint.Addresses {
+					addresses[net.JoinHostPort(address, strconv.Itoa(int(*port.Port)))] = true
+				}
+			}
+		}
+	}
+
+	mapping.Readiness = upstream.ReadinessNotReady
+	if len(addresses) > 0 {
+		mapping.Readiness = upstream.ReadinessReady
+	}
+
+	if !p.config.RouteToEndpoints || len(addresses) == 0 {
+		return mapping
+	}
+
+	mapping.Endpoints = make([]string, 0, len(addresses))
+	for address := range addresses {
+		mapping.Endpoints = append(mapping.Endpoints, address)
+	}
+	sort.Strings(mapping.Endpoints)
+
+	if mapping.BackendProtocol == upstream.ProtocolHTTPS {
+		// Pods are verified against the service name which was dialed before
+		tls := upstream.BackendTLS{}
+		if mapping.TLS != nil {
+			tls = *mapping.TLS
+		}
+		if tls.ServerName == "" {
+			tls.ServerName = mapping.Backend
+		}
+		mapping.TLS = &tls
+	}
+	return mapping
+}
+
+func portName(port discoveryv1.EndpointPort) string {
+	if port.Name == nil {
+		return ""
+	}
+	return *port.Name
+}
+
+// hostMappings computes the mappings of every port of a workspace service.
+// The host template is rendered for every port before any mapping is
+// returned, so that a service with an invalid template gets no mappings.
+//
+// The template is given the workspaceName, workspaceID and namespace of the
+// service, and the port (target port number), servicePort and portName.
+func hostMappings(workspaceID string, workspaceHostTemplate string, svc *v1.Service, protocols map[string]string, tls *upstream.BackendTLS) ([]upstream.HostMapping, error) {
+	streamingPorts := parsePortList(svc.Annotations[workspaceStreamingPortsAnnotation])
+
+	t, err := template.New("workspaceHostTemplate").Option("missingkey=error").Parse(workspaceHostTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse workspace host template: %w", err)
+	}
+
+	mappings := make([]upstream.HostMapping, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		hostname, err := renderHostname(t, map[string]string{
+			"workspaceName": svc.Name,
+			"workspaceID":   workspaceID,
+			"namespace":     svc.Namespace,
+			"port":          strconv.Itoa(port.TargetPort.IntValue()),
+			"servicePort":   strconv.Itoa(int(port.Port)),
+			"portName":      port.Name,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("port %d: %w", port.Port, err)
+		}
+
+		protocol := upstream.ProtocolHTTP
+		if p, ok := protocols[port.Name]; ok {
+			protocol = p
+		} else if p, ok := protocols[strconv.Itoa(int(port.Port))]; ok {
+			protocol = p
+		}
+
+		mapping := upstream.HostMapping{
+			Hostname:        hostname,
+			BackendPort:     port.Port,
+			PortName:        port.Name,
+			Backend:         fmt.Sprintf("%s.%s", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace),
+			BackendProtocol: protocol,
+			WorkspaceID:     workspaceID,
+			WorkspaceName:   svc.ObjectMeta.Name,
+			Namespace:       svc.ObjectMeta.Namespace,
+			Streaming:       streamingPorts[port.Name] || streamingPorts[strconv.Itoa(int(port.Port))],
+		}
+		if protocol == upstream.ProtocolHTTPS {
+			mapping.TLS = tls
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// renderHostname executes the host template and checks that the result is a
+// valid DNS name.
+func renderHostname(t *template.Template, data map[string]string) (string, error) {
+	var h bytes.Buffer
+	if err := t.Execute(&h, data); err != nil {
+		return "", fmt.Errorf("failed to render workspace host template: %w", err)
+	}
+
+	hostname := h.String()
+	if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+		return "", fmt.Errorf("workspace host template rendered invalid hostname %q: %s", hostname, strings.Join(errs, ", "))
+	}
+	return hostname, nil
+}
+
+// backendTLS reads the TLS settings for the https ports of a workspace. A CA
+// secret which cannot be read is logged and skipped, verification then falls
+// back to the global trust roots.
+func backendTLS(ctx context.Context, k8sClient k8s.Client, svc *v1.Service, logger *zap.Logger) *upstream.BackendTLS {
+	settings := &upstream.BackendTLS{
+		ServerName:         svc.Annotations[workspaceBackendTLSServerNameAnnotation],
+		InsecureSkipVerify: svc.Annotations[workspaceBackendTLSInsecureSkipVerifyAnnotation] == "true",
+	}
+
+	secretName := svc.Annotations[workspaceBackendCASecretAnnotation]
+	if secretName == "" {
+		return settings
+	}
+
+	secret, err := k8sClient.GetSecret(ctx, svc.Namespace, secretName)
+	if err != nil {
+		logger.Error("failed to read workspace backend CA secret",
+			logz.Error(err),
+			logz.ServiceName(svc.Name),
+			logz.ServiceNamespace(svc.Namespace),
+			logz.SecretName(secretName),
+		)
+		return settings
+	}
+
+	settings.CA = string(secret.Data[backendCASecretKey])
+	return settings
+}
+
+// parsePortProtocols parses a comma separated list of port=protocol pairs.
+func parsePortProtocols(value string) (map[string]string, error) {
+	protocols := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, protocol, found := strings.Cut(entry, "=")
+		port = strings.TrimSpace(port)
+		protocol = strings.TrimSpace(protocol)
+		if !found || port == "" {
+			return nil, fmt.Errorf("invalid port protocol %q, expected port=protocol", entry)
+		}
+
+		if !upstream.IsValidProtocol(protocol) {
+			return nil, fmt.Errorf("unsupported protocol %q for port %s", protocol, port)
+		}
+
+		protocols[port] = protocol
+	}
+	return protocols, nil
+}
+
+// parsePortList parses a comma separated list of port names or numbers.
+func parsePortList(value string) map[string]bool {
+	ports := make(map[string]bool)
+	for _, port := range strings.Split(value, ",") {
+		port = strings.TrimSpace(port)
+		if port != "" {
+			ports[port] = true
+		}
+	}
+	return ports
+}
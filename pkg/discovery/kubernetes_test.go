@@ -0,0 +1,391 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/k8s"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+type event struct {
+	action k8s.InformerAction
+	svc    *v1.Service
+}
+
+type sliceEvent struct {
+	action k8s.InformerAction
+	slice  *discoveryv1.EndpointSlice
+}
+
+// fakeClient replays events to the informer callbacks, endpoint slices are
+// replayed when services are. The reasons of recorded service events are kept.
+type fakeClient struct {
+	events        []event
+	sliceEvents   []sliceEvent
+	sliceCallback func(k8s.InformerAction, *discoveryv1.EndpointSlice)
+	eventReasons  []string
+}
+
+func (c *fakeClient) GetEndpointSlices(_ context.Context, callback func(k8s.InformerAction, *discoveryv1.EndpointSlice)) error {
+	c.sliceCallback = callback
+	return nil
+}
+
+func (c *fakeClient) GetService(_ context.Context, callback func(k8s.InformerAction, *v1.Service)) error {
+	for _, e := range c.events {
+		callback(e.action, e.svc)
+	}
+	for _, e := range c.sliceEvents {
+		c.sliceCallback(e.action, e.slice)
+	}
+	return nil
+}
+
+func (c *fakeClient) GetSecret(context.Context, string, string) (*v1.Secret, error) {
+	return &v1.Secret{Data: map[string][]byte{backendCASecretKey: []byte("CA")}}, nil
+}
+
+func (c *fakeClient) AnnotateService(context.Context, string, string, map[string]string) error {
+	return nil
+}
+
+func (c *fakeClient) RecordServiceEvent(_ *v1.Service, _, reason, _ string) {
+	c.eventReasons = append(c.eventReasons, reason)
+}
+
+func newService(ports ...int32) *v1.Service {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "workspace1",
+			Namespace: "gl-workspaces",
+			UID:       "uid-1",
+			Annotations: map[string]string{
+				workspaceHostTemplateAnnotation:     "{{ .port }}-workspace1.workspaces.com",
+				workspaceIDAnnotation:               "1",
+				workspaceBackendProtocolsAnnotation: "8443=https",
+				workspaceStreamingPortsAnnotation:   "editor",
+				workspaceBackendCASecretAnnotation:  "workspace1-ca",
+			},
+		},
+	}
+	for _, port := range ports {
+		name := ""
+		if port == 3000 {
+			name = "editor"
+		}
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: name, Port: port, TargetPort: intstr.FromInt(int(port))})
+	}
+	return svc
+}
+
+func TestKubernetesProvider(t *testing.T) {
+	tt := []struct {
+		description       string
+		events            []event
+		expectedHostnames []string
+	}{
+		{
+			description:       "When a service is added maps every port",
+			events:            []event{{k8s.InformerActionAdd, newService(3000, 8443)}},
+			expectedHostnames: []string{"3000-workspace1.workspaces.com", "8443-workspace1.workspaces.com"},
+		},
+		{
+			description: "When a port is removed on update its mapping is pruned",
+			events: []event{
+				{k8s.InformerActionAdd, newService(3000, 8443)},
+				{k8s.InformerActionUpdate, newService(3000)},
+			},
+			expectedHostnames: []string{"3000-workspace1.workspaces.com"},
+		},
+		{
+			description: "When a service is deleted removes every port",
+			events: []event{
+				{k8s.InformerActionAdd, newService(3000, 8443)},
+				{k8s.InformerActionDelete, newService(3000, 8443)},
+			},
+			expectedHostnames: []string{},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			tracker := upstream.NewTracker(zaptest.NewLogger(t))
+			provider := NewKubernetesProvider(zaptest.NewLogger(t), &fakeClient{events: tr.events}, "", KubernetesConfig{})
+			require.Nil(t, provider.Start(context.Background(), tracker))
+
+			hostnames := []string{}
+			for _, mapping := range tracker.List() {
+				hostnames = append(hostnames, mapping.Hostname)
+			}
+			require.Equal(t, tr.expectedHostnames, hostnames)
+		})
+	}
+}
+
+func TestHostMappings(t *testing.T) {
+	svc := newService(3000, 8443)
+	tls := &upstream.BackendTLS{CA: "CA"}
+
+	result, err := hostMappings("1", svc.Annotations[workspaceHostTemplateAnnotation], svc, map[string]string{"8443": upstream.ProtocolHTTPS}, tls)
+	require.Nil(t, err)
+	require.Equal(t, []upstream.HostMapping{
+		{
+			Hostname:        "3000-workspace1.workspaces.com",
+			BackendPort:     3000,
+			PortName:        "editor",
+			Backend:         "workspace1.gl-workspaces",
+			BackendProtocol: upstream.ProtocolHTTP,
+			WorkspaceID:     "1",
+			WorkspaceName:   "workspace1",
+			Namespace:       "gl-workspaces",
+			Streaming:       true,
+		},
+		{
+			Hostname:        "8443-workspace1.workspaces.com",
+			BackendPort:     8443,
+			Backend:         "workspace1.gl-workspaces",
+			BackendProtocol: upstream.ProtocolHTTPS,
+			WorkspaceID:     "1",
+			WorkspaceName:   "workspace1",
+			Namespace:       "gl-workspaces",
+			TLS:             tls,
+		},
+	}, result)
+}
+
+func TestHostMappingsTemplate(t *testing.T) {
+	tt := []struct {
+		description       string
+		template          string
+		expectedHostnames []string
+		expectedErr       bool
+	}{
+		{
+			description:       "When the template uses the workspace and port data renders every port",
+			template:          "{{ .servicePort }}-{{ .workspaceName }}-{{ .workspaceID }}.{{ .namespace }}.workspaces.com",
+			expectedHostnames: []string{"3000-workspace1-1.gl-workspaces.workspaces.com", "8443-workspace1-1.gl-workspaces.workspaces.com"},
+		},
+		{
+			description: "When the template cannot be parsed returns error",
+			template:    "{{ .port -workspace1.workspaces.com",
+			expectedErr: true,
+		},
+		{
+			description: "When the template uses unknown data returns error",
+			template:    "{{ .host }}.workspaces.com",
+			expectedErr: true,
+		},
+		{
+			description: "When the template renders an invalid hostname returns error",
+			template:    "{{ .port }}_Workspace1.workspaces.com",
+			expectedErr: true,
+		},
+		{
+			description: "When the template renders an invalid hostname for one port maps no port",
+			template:    "{{ .portName }}.workspace1.workspaces.com",
+			expectedErr: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			result, err := hostMappings("1", tr.template, newService(3000, 8443), nil, nil)
+			if tr.expectedErr {
+				require.Error(t, err)
+				require.Nil(t, result)
+				return
+			}
+
+			require.Nil(t, err)
+			hostnames := []string{}
+			for _, mapping := range result {
+				hostnames = append(hostnames, mapping.Hostname)
+			}
+			require.Equal(t, tr.expectedHostnames, hostnames)
+		})
+	}
+}
+
+func TestKubernetesProviderRecordsInvalidAnnotations(t *testing.T) {
+	tt := []struct {
+		description          string
+		annotations          map[string]string
+		expectedHostnames    []string
+		expectedEventReasons []string
+	}{
+		{
+			description:       "When the annotations are valid records no event",
+			expectedHostnames: []string{"3000-workspace1.workspaces.com"},
+		},
+		{
+			description:          "When the host template is missing records an event and maps no port",
+			annotations:          map[string]string{workspaceHostTemplateAnnotation: ""},
+			expectedHostnames:    []string{},
+			expectedEventReasons: []string{eventReasonMissingHostTemplate},
+		},
+		{
+			description:          "When the workspace id is missing records an event and maps no port",
+			annotations:          map[string]string{workspaceIDAnnotation: ""},
+			expectedHostnames:    []string{},
+			expectedEventReasons: []string{eventReasonMissingWorkspaceID},
+		},
+		{
+			description:          "When the host template is invalid records an event and maps no port",
+			annotations:          map[string]string{workspaceHostTemplateAnnotation: "{{ .host }}.workspaces.com"},
+			expectedHostnames:    []string{},
+			expectedEventReasons: []string{eventReasonInvalidHostTemplate},
+		},
+		{
+			description:          "When the backend protocols are invalid records an event and falls back to http",
+			annotations:          map[string]string{workspaceBackendProtocolsAnnotation: "3000=ftp"},
+			expectedHostnames:    []string{"3000-workspace1.workspaces.com"},
+			expectedEventReasons: []string{eventReasonInvalidBackendProtocols},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			svc := newService(3000)
+			for key, value := range tr.annotations {
+				svc.Annotations[key] = value
+			}
+
+			tracker := upstream.NewTracker(zaptest.NewLogger(t))
+			client := &fakeClient{events: []event{{k8s.InformerActionAdd, svc}}}
+			provider := NewKubernetesProvider(zaptest.NewLogger(t), client, "", KubernetesConfig{})
+			require.Nil(t, provider.Start(context.Background(), tracker))
+
+			hostnames := []string{}
+			for _, mapping := range tracker.List() {
+				hostnames = append(hostnames, mapping.Hostname)
+			}
+			require.Equal(t, tr.expectedHostnames, hostnames)
+			require.Equal(t, tr.expectedEventReasons, client.eventReasons)
+		})
+	}
+}
+
+func TestKubernetesProviderRecordsHostnameConflicts(t *testing.T) {
+	hijacker := newService(3000)
+	hijacker.Name = "workspace2"
+	hijacker.UID = "uid-2"
+
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	client := &fakeClient{events: []event{
+		{k8s.InformerActionAdd, newService(3000)},
+		{k8s.InformerActionAdd, hijacker},
+		{k8s.InformerActionUpdate, hijacker},
+	}}
+	provider := NewKubernetesProvider(zaptest.NewLogger(t), client, "", KubernetesConfig{})
+	require.Nil(t, provider.Start(context.Background(), tracker))
+
+	mapping, err := tracker.GetByHostname("3000-workspace1.workspaces.com")
+	require.Nil(t, err)
+	require.Equal(t, "workspace1", mapping.WorkspaceName)
+	require.Equal(t, []string{eventReasonHostnameConflict}, client.eventReasons)
+}
+
+func newEndpointSlice(name string, ready bool, addresses ...string) *discoveryv1.EndpointSlice {
+	portName := "editor"
+	port := int32(3000)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "gl-workspaces",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "workspace1"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+	for _, address := range addresses {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	return slice
+}
+
+func TestKubernetesProviderReadiness(t *testing.T) {
+	tt := []struct {
+		description       string
+		config            KubernetesConfig
+		sliceEvents       []sliceEvent
+		expectedReadiness upstream.Readiness
+		expectedEndpoints []string
+	}{
+		{
+			description:       "When endpoints are not watched readiness is unknown",
+			expectedReadiness: upstream.ReadinessUnknown,
+		},
+		{
+			description:       "When the service has no endpoint slice the port is not ready",
+			config:            KubernetesConfig{WatchEndpoints: true},
+			expectedReadiness: upstream.ReadinessNotReady,
+		},
+		{
+			description:       "When no endpoint is ready the port is not ready",
+			config:            KubernetesConfig{WatchEndpoints: true},
+			sliceEvents:       []sliceEvent{{k8s.InformerActionAdd, newEndpointSlice("slice1", false, "10.0.0.1")}},
+			expectedReadiness: upstream.ReadinessNotReady,
+		},
+		{
+			description:       "When an endpoint is ready the port is ready",
+			config:            KubernetesConfig{WatchEndpoints: true},
+			sliceEvents:       []sliceEvent{{k8s.InformerActionAdd, newEndpointSlice("slice1", true, "10.0.0.1")}},
+			expectedReadiness: upstream.ReadinessReady,
+		},
+		{
+			description: "When the endpoint slice is deleted the port is not ready",
+			config:      KubernetesConfig{WatchEndpoints: true},
+			sliceEvents: []sliceEvent{
+				{k8s.InformerActionAdd, newEndpointSlice("slice1", true, "10.0.0.1")},
+				{k8s.InformerActionDelete, newEndpointSlice("slice1", true, "10.0.0.1")},
+			},
+			expectedReadiness: upstream.ReadinessNotReady,
+		},
+		{
+			description: "When routing to endpoints records the ready pod addresses of every slice",
+			config:      KubernetesConfig{WatchEndpoints: true, RouteToEndpoints: true},
+			sliceEvents: []sliceEvent{
+				{k8s.InformerActionAdd, newEndpointSlice("slice1", true, "10.0.0.2")},
+				{k8s.InformerActionAdd, newEndpointSlice("slice2", true, "10.0.0.1")},
+			},
+			expectedReadiness: upstream.ReadinessReady,
+			expectedEndpoints: []string{"10.0.0.1:3000", "10.0.0.2:3000"},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			tracker := upstream.NewTracker(zaptest.NewLogger(t))
+			client := &fakeClient{
+				events:      []event{{k8s.InformerActionAdd, newService(3000)}},
+				sliceEvents: tr.sliceEvents,
+			}
+			provider := NewKubernetesProvider(zaptest.NewLogger(t), client, "", tr.config)
+			require.Nil(t, provider.Start(context.Background(), tracker))
+
+			mapping, err := tracker.GetByHostname("3000-workspace1.workspaces.com")
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedReadiness, mapping.Readiness)
+			require.Equal(t, tr.expectedEndpoints, mapping.Endpoints)
+		})
+	}
+}
+
+func TestWithReadinessKeepsTLSServerName(t *testing.T) {
+	provider := NewKubernetesProvider(zaptest.NewLogger(t), &fakeClient{}, "", KubernetesConfig{WatchEndpoints: true, RouteToEndpoints: true})
+	tls := &upstream.BackendTLS{CA: "CA"}
+	mapping := upstream.HostMapping{Backend: "workspace1.gl-workspaces", PortName: "editor", BackendProtocol: upstream.ProtocolHTTPS, TLS: tls}
+
+	result := provider.withReadiness(mapping, map[string]*discoveryv1.EndpointSlice{"slice1": newEndpointSlice("slice1", true, "10.0.0.1")})
+	require.Equal(t, &upstream.BackendTLS{CA: "CA", ServerName: "workspace1.gl-workspaces"}, result.TLS)
+	require.Equal(t, "", tls.ServerName)
+}
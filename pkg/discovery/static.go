@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type staticFile struct {
+	Mappings []upstream.HostMapping `yaml:"mappings"`
+}
+
+// StaticProvider serves the host mappings listed in a YAML file.
+type StaticProvider struct {
+	logger *zap.Logger
+	config StaticConfig
+}
+
+func NewStaticProvider(logger *zap.Logger, config StaticConfig) *StaticProvider {
+	return &StaticProvider{
+		logger: logger,
+		config: config,
+	}
+}
+
+// Start fails when the file cannot be loaded initially. Later errors are
+// logged and the previously loaded mappings are kept.
+func (p *StaticProvider) Start(ctx context.Context, tracker *upstream.Tracker) error {
+	data, err := os.ReadFile(p.config.File)
+	if err != nil {
+		return err
+	}
+
+	if err = p.load(tracker, data); err != nil {
+		return err
+	}
+
+	go p.watch(ctx, tracker, data)
+	return nil
+}
+
+func (p *StaticProvider) watch(ctx context.Context, tracker *upstream.Tracker, loaded []byte) {
+	interval := p.config.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The file is compared by content, since a ConfigMap mount swaps a
+		// symlink and keeps the modification time of the old file
+		data, err := os.ReadFile(p.config.File)
+		if err != nil {
+			p.logger.Error("failed to read static host mappings", logz.Error(err), logz.FilePath(p.config.File))
+			continue
+		}
+		if bytes.Equal(data, loaded) {
+			continue
+		}
+
+		if err = p.load(tracker, data); err != nil {
+			p.logger.Error("failed to reload static host mappings, keeping the previous mappings",
+				logz.Error(err),
+				logz.FilePath(p.config.File),
+			)
+		}
+		loaded = data
+	}
+}
+
+func (p *StaticProvider) load(tracker *upstream.Tracker, data []byte) error {
+	mappings, err := parseStaticMappings(data)
+	if err != nil {
+		return err
+	}
+
+	tracker.Replace("static:"+p.config.File, mappings)
+	return nil
+}
+
+func parseStaticMappings(data []byte) ([]upstream.HostMapping, error) {
+	var file staticFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	for i := range file.Mappings {
+		mapping := &file.Mappings[i]
+		if mapping.Hostname == "" || mapping.Backend == "" || mapping.BackendPort == 0 || mapping.WorkspaceName == "" {
+			return nil, fmt.Errorf("host mapping %d requires host, backend, port and workspaceName", i)
+		}
+
+		if mapping.BackendProtocol == "" {
+			mapping.BackendProtocol = upstream.ProtocolHTTP
+		}
+		if !upstream.IsValidProtocol(mapping.BackendProtocol) {
+			return nil, fmt.Errorf("unsupported protocol %q for host %s", mapping.BackendProtocol, mapping.Hostname)
+		}
+	}
+	return file.Mappings, nil
+}
@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+const staticMappings = `
+mappings:
+  - host: 3000-workspace1.localdev.me
+    backend: localhost
+    port: 3000
+    workspaceID: "1"
+    workspaceName: workspace1
+  - host: 8443-workspace1.localdev.me
+    backend: localhost
+    port: 8443
+    protocol: https
+    workspaceName: workspace1
+    tls:
+      insecureSkipVerify: true
+`
+
+func TestParseStaticMappings(t *testing.T) {
+	tt := []struct {
+		description      string
+		data             string
+		expectedError    bool
+		expectedMappings []upstream.HostMapping
+	}{
+		{
+			description: "When the file is valid returns the mappings",
+			data:        staticMappings,
+			expectedMappings: []upstream.HostMapping{
+				{Hostname: "3000-workspace1.localdev.me", Backend: "localhost", BackendPort: 3000, BackendProtocol: upstream.ProtocolHTTP, WorkspaceID: "1", WorkspaceName: "workspace1"},
+				{Hostname: "8443-workspace1.localdev.me", Backend: "localhost", BackendPort: 8443, BackendProtocol: upstream.ProtocolHTTPS, WorkspaceName: "workspace1", TLS: &upstream.BackendTLS{InsecureSkipVerify: true}},
+			},
+		},
+		{
+			description:   "When a mapping has no backend throws error",
+			data:          "mappings:\n  - host: 3000-workspace1.localdev.me\n    port: 3000\n    workspaceName: workspace1\n",
+			expectedError: true,
+		},
+		{
+			description:   "When a mapping has an unknown protocol throws error",
+			data:          "mappings:\n  - host: 3000-workspace1.localdev.me\n    backend: localhost\n    port: 3000\n    protocol: ftp\n    workspaceName: workspace1\n",
+			expectedError: true,
+		},
+		{
+			description:   "When the file is not YAML throws error",
+			data:          "mappings: [",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			result, err := parseStaticMappings([]byte(tr.data))
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedMappings, result)
+		})
+	}
+}
+
+func TestStaticProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mappings.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(staticMappings), 0o600))
+
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	provider := NewStaticProvider(zaptest.NewLogger(t), StaticConfig{File: file, PollInterval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.Nil(t, provider.Start(ctx, tracker))
+	require.Equal(t, 2, tracker.Len())
+
+	// An invalid file keeps the previous mappings
+	require.Nil(t, os.WriteFile(file, []byte("mappings: ["), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 2, tracker.Len())
+
+	require.Nil(t, os.WriteFile(file, []byte("mappings:\n  - host: 3000-workspace2.localdev.me\n    backend: localhost\n    port: 3000\n    workspaceName: workspace2\n"), 0o600))
+	require.Eventually(t, func() bool {
+		mappings := tracker.List()
+		return len(mappings) == 1 && mappings[0].WorkspaceName == "workspace2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStaticProviderMissingFile(t *testing.T) {
+	provider := NewStaticProvider(zaptest.NewLogger(t), StaticConfig{File: filepath.Join(t.TempDir(), "missing.yaml")})
+	require.NotNil(t, provider.Start(context.Background(), upstream.NewTracker(zaptest.NewLogger(t))))
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/hasura/go-graphql-client"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 	"go.uber.org/zap"
 )
 
@@ -54,7 +55,7 @@ func (att tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 func NewClient(logger *zap.Logger, accessToken, baseURL string, tokenType TokenType) *Client {
 	client := &http.Client{
-		Transport: http.DefaultTransport,
+		Transport: tracing.NewTransport(http.DefaultTransport),
 	}
 	client.Transport = tokenTransport{
 		logger:    logger,
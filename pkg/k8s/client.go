@@ -2,21 +2,37 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
-	informerResyncPeriod  = 1 * time.Hour
+	DefaultResyncPeriod   = 1 * time.Hour
 	WorkspaceServiceLabel = "agent.gitlab.com/id"
+	// EventSourceComponent is reported as the source of the events recorded
+	// on workspace services
+	EventSourceComponent = "gitlab-workspaces-proxy"
+	// DefaultEventInterval is how often the same event is recorded on a service
+	DefaultEventInterval = 5 * time.Minute
+	// secretReadTimeout bounds the read of a CA secret
+	secretReadTimeout = 5 * time.Second
 )
 
 type InformerAction uint16
@@ -29,15 +45,56 @@ const (
 
 type Client interface {
 	GetService(ctx context.Context, callback func(InformerAction, *v1.Service)) error
+	GetEndpointSlices(ctx context.Context, callback func(InformerAction, *discoveryv1.EndpointSlice)) error
+	GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error)
+	AnnotateService(ctx context.Context, namespace, name string, annotations map[string]string) error
+	// RecordServiceEvent reports a problem with a workspace service to its
+	// owner, who can see it with kubectl describe
+	RecordServiceEvent(svc *v1.Service, eventType, reason, message string)
+}
+
+// WatchConfig limits which workspace services are watched. With namespaces
+// set an informer is started per namespace, so that the proxy only needs
+// namespaced RBAC.
+type WatchConfig struct {
+	// Namespaces to watch, all namespaces when empty
+	Namespaces []string `yaml:"namespaces"`
+	// LabelSelector is combined with WorkspaceServiceLabel
+	LabelSelector string `yaml:"label_selector"`
+	// FieldSelector only applies to services, since endpoint slices are
+	// named differently
+	FieldSelector string        `yaml:"field_selector"`
+	ResyncPeriod  time.Duration `yaml:"resync_period"`
+}
+
+// ClusterConfig selects the cluster a client connects to. Without kubeconfig
+// and context the in-cluster configuration of the proxy pod is used.
+type ClusterConfig struct {
+	// Name tags the workspaces discovered in the cluster, it may be empty
+	// when only a single cluster is watched
+	Name       string `yaml:"name"`
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Context of the kubeconfig to use instead of its current context
+	Context string `yaml:"context"`
 }
 
 type KubernetesClient struct {
 	clientset *kubernetes.Clientset
 	logger    *zap.Logger
+	watch     WatchConfig
+	recorder  record.EventRecorder
+	limiter   *eventLimiter
+	secrets   *secretCache
 }
 
-func New(logger *zap.Logger, kubeconfig string) (*KubernetesClient, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// New creates a client for the cluster. Events with the same reason are
+// recorded on a service at most once per eventInterval.
+func New(logger *zap.Logger, cluster ClusterConfig, watch WatchConfig, eventInterval time.Duration) (*KubernetesClient, error) {
+	if err := watch.validate(); err != nil {
+		return nil, err
+	}
+
+	config, err := cluster.restConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -47,45 +104,209 @@ func New(logger *zap.Logger, kubeconfig string) (*KubernetesClient, error) {
 		return nil, err
 	}
 
-	return &KubernetesClient{
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+
+	client := &KubernetesClient{
 		logger:    logger,
 		clientset: clientset,
-	}, nil
+		watch:     watch,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: EventSourceComponent}),
+		limiter:   newEventLimiter(eventInterval),
+	}
+	client.secrets = newSecretCache(client.readSecret, secretTTL)
+	return client, nil
+}
+
+func (c ClusterConfig) restConfig() (*rest.Config, error) {
+	if c.Context == "" {
+		return clientcmd.BuildConfigFromFlags("", c.Kubeconfig)
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = c.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: c.Context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+func (w WatchConfig) validate() error {
+	if _, err := labels.Parse(w.labelSelector()); err != nil {
+		return fmt.Errorf("invalid label selector: %w", err)
+	}
+
+	if _, err := fields.ParseSelector(w.FieldSelector); err != nil {
+		return fmt.Errorf("invalid field selector: %w", err)
+	}
+	return nil
+}
+
+func (w WatchConfig) labelSelector() string {
+	if w.LabelSelector == "" {
+		return WorkspaceServiceLabel
+	}
+	return WorkspaceServiceLabel + "," + w.LabelSelector
+}
+
+func (w WatchConfig) resyncPeriod() time.Duration {
+	if w.ResyncPeriod == 0 {
+		return DefaultResyncPeriod
+	}
+	return w.ResyncPeriod
+}
+
+func (w WatchConfig) namespaces() []string {
+	if len(w.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return w.Namespaces
 }
 
 func (c *KubernetesClient) GetService(ctx context.Context, callback func(InformerAction, *v1.Service)) error {
-	factory := informers.NewSharedInformerFactoryWithOptions(c.clientset, informerResyncPeriod, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
-		opts.LabelSelector = WorkspaceServiceLabel
-	}))
+	informerFor := func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return factory.Core().V1().Services().Informer()
+	}
+
+	return c.startInformers(ctx, c.watch.FieldSelector, informerFor, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if svc, ok := serviceFromObject(obj); ok {
+				callback(InformerActionAdd, svc)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			if svc, ok := serviceFromObject(new); ok {
+				callback(InformerActionUpdate, svc)
+			}
+		},
+		DeleteFunc: func(old interface{}) {
+			if svc, ok := serviceFromObject(old); ok {
+				callback(InformerActionDelete, svc)
+				return
+			}
+			c.logger.Error("received a deleted object which is not a service")
+		},
+	})
+}
 
-	svc := factory.Core().V1().Services()
-	informer := svc.Informer()
+// serviceFromObject unwraps the tombstone the informer hands out when a
+// deletion was missed, e.g. during a watch disconnect.
+func serviceFromObject(obj interface{}) (*v1.Service, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
 
-	stopper := make(chan struct{})
-	go func() {
-		<-ctx.Done()
-		stopper <- struct{}{}
-	}()
+	svc, ok := obj.(*v1.Service)
+	return svc, ok
+}
 
-	go factory.Start(stopper)
-	if !cache.WaitForCacheSync(stopper, informer.HasSynced) {
-		return fmt.Errorf("timed out waiting for caches to sync")
+// GetEndpointSlices watches the endpoint slices of workspace services. The
+// endpoint slice controller copies the service labels onto the slices.
+func (c *KubernetesClient) GetEndpointSlices(ctx context.Context, callback func(InformerAction, *discoveryv1.EndpointSlice)) error {
+	informerFor := func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return factory.Discovery().V1().EndpointSlices().Informer()
 	}
 
-	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	return c.startInformers(ctx, "", informerFor, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			svc := obj.(*v1.Service)
-			callback(InformerActionAdd, svc)
+			if slice, ok := endpointSliceFromObject(obj); ok {
+				callback(InformerActionAdd, slice)
+			}
 		},
 		UpdateFunc: func(old interface{}, new interface{}) {
-			svc := new.(*v1.Service)
-			callback(InformerActionUpdate, svc)
+			if slice, ok := endpointSliceFromObject(new); ok {
+				callback(InformerActionUpdate, slice)
+			}
 		},
 		DeleteFunc: func(old interface{}) {
-			svc := old.(*v1.Service)
-			callback(InformerActionUpdate, svc)
+			if slice, ok := endpointSliceFromObject(old); ok {
+				callback(InformerActionDelete, slice)
+				return
+			}
+			c.logger.Error("received a deleted object which is not an endpoint slice")
+		},
+	})
+}
+
+func endpointSliceFromObject(obj interface{}) (*discoveryv1.EndpointSlice, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	return slice, ok
+}
+
+// startInformers starts an informer per watched namespace and adds the
+// handler once all of them are synced.
+func (c *KubernetesClient) startInformers(ctx context.Context, fieldSelector string, informerFor func(informers.SharedInformerFactory) cache.SharedIndexInformer, handler cache.ResourceEventHandler) error {
+	stopper := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(stopper)
+	}()
+
+	namespaces := c.watch.namespaces()
+	watched := make([]cache.SharedIndexInformer, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(c.clientset, c.watch.resyncPeriod(),
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = c.watch.labelSelector()
+				opts.FieldSelector = fieldSelector
+			}),
+		)
+		informer := informerFor(factory)
+		go factory.Start(stopper)
+		watched = append(watched, informer)
+	}
+
+	for _, informer := range watched {
+		if !cache.WaitForCacheSync(stopper, informer.HasSynced) {
+			return fmt.Errorf("timed out waiting for caches to sync")
+		}
+	}
+
+	for _, informer := range watched {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSecret reads a secret. Secrets are reused for secretTTL so that service
+// resyncs do not read the same CA secret for every service.
+func (c *KubernetesClient) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return c.secrets.get(ctx, namespace, name)
+}
+
+func (c *KubernetesClient) readSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	// Reads happen in informer callbacks, which must not hang on the API server
+	ctx, cancel := context.WithTimeout(ctx, secretReadTimeout)
+	defer cancel()
+	return c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// AnnotateService merges the annotations into those of the service.
+func (c *KubernetesClient) AnnotateService(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
 		},
 	})
+	if err != nil {
+		return err
+	}
 
+	_, err = c.clientset.CoreV1().Services(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
 	return err
 }
+
+// RecordServiceEvent records an event on the service, unless an event with
+// the same reason was recorded on it recently. Events are sent in the
+// background.
+func (c *KubernetesClient) RecordServiceEvent(svc *v1.Service, eventType, reason, message string) {
+	if !c.limiter.allow(svc.Namespace + "/" + svc.Name + "/" + reason) {
+		return
+	}
+	c.recorder.Event(svc, eventType, reason, message)
+}
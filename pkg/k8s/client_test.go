@@ -0,0 +1,87 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestServiceFromObject(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "workspace1"}}
+
+	tt := []struct {
+		description string
+		obj         interface{}
+		expectedOk  bool
+	}{
+		{
+			description: "When the object is a service returns it",
+			obj:         svc,
+			expectedOk:  true,
+		},
+		{
+			description: "When the object is a tombstone returns the service it holds",
+			obj:         cache.DeletedFinalStateUnknown{Key: "ns/workspace1", Obj: svc},
+			expectedOk:  true,
+		},
+		{
+			description: "When the object is not a service returns false",
+			obj:         &v1.Secret{},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			result, ok := serviceFromObject(tr.obj)
+			require.Equal(t, tr.expectedOk, ok)
+			if tr.expectedOk {
+				require.Equal(t, svc, result)
+			}
+		})
+	}
+}
+
+func TestWatchConfigValidate(t *testing.T) {
+	tt := []struct {
+		description           string
+		watch                 WatchConfig
+		expectedLabelSelector string
+		expectedErr           bool
+	}{
+		{
+			description:           "When no label selector is set selects workspace services",
+			expectedLabelSelector: WorkspaceServiceLabel,
+		},
+		{
+			description:           "When a label selector is set combines it with the workspace label",
+			watch:                 WatchConfig{LabelSelector: "tier=premium"},
+			expectedLabelSelector: WorkspaceServiceLabel + ",tier=premium",
+		},
+		{
+			description: "When the label selector is invalid returns error",
+			watch:       WatchConfig{LabelSelector: "tier in premium"},
+			expectedErr: true,
+		},
+		{
+			description: "When the field selector is invalid returns error",
+			watch:       WatchConfig{FieldSelector: "metadata.name"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			err := tr.watch.validate()
+			if tr.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedLabelSelector, tr.watch.labelSelector())
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+)
+
+// minEventSweep is the number of keys from which expired ones are swept.
+const minEventSweep = 64
+
+// eventLimiter lets one event per key through every interval. Informer
+// resyncs and retried requests would otherwise record the same problem over
+// and over, while the workspace owner only needs to learn about it.
+type eventLimiter struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	recorded map[string]time.Time
+	// sweepAt is the number of keys at which expired ones are dropped, it
+	// doubles with the live keys so that sweeps stay rare
+	sweepAt int
+}
+
+func newEventLimiter(interval time.Duration) *eventLimiter {
+	if interval <= 0 {
+		interval = DefaultEventInterval
+	}
+
+	return &eventLimiter{
+		interval: interval,
+		now:      time.Now,
+		recorded: make(map[string]time.Time),
+		sweepAt:  minEventSweep,
+	}
+}
+
+func (l *eventLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if at, ok := l.recorded[key]; ok && now.Sub(at) < l.interval {
+		return false
+	}
+	l.recorded[key] = now
+
+	if len(l.recorded) >= l.sweepAt {
+		l.sweep(now)
+	}
+	return true
+}
+
+// sweep drops expired keys so that deleted services are forgotten.
+func (l *eventLimiter) sweep(now time.Time) {
+	for k, at := range l.recorded {
+		if now.Sub(at) >= l.interval {
+			delete(l.recorded, k)
+		}
+	}
+	l.sweepAt = max(2*len(l.recorded), minEventSweep)
+}
@@ -0,0 +1,67 @@
+package k8s
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLimiter(t *testing.T) {
+	tt := []struct {
+		description   string
+		key           string
+		elapsed       time.Duration
+		expectedAllow bool
+	}{
+		{
+			description:   "When the event was recorded recently suppresses it",
+			key:           "ns/workspace1/InvalidHostTemplate",
+			elapsed:       time.Minute,
+			expectedAllow: false,
+		},
+		{
+			description:   "When the interval passed records the event again",
+			key:           "ns/workspace1/InvalidHostTemplate",
+			elapsed:       5 * time.Minute,
+			expectedAllow: true,
+		},
+		{
+			description:   "When the reason differs records the event",
+			key:           "ns/workspace1/HostnameConflict",
+			elapsed:       time.Minute,
+			expectedAllow: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+			limiter := newEventLimiter(5 * time.Minute)
+			limiter.now = func() time.Time { return now }
+			require.True(t, limiter.allow("ns/workspace1/InvalidHostTemplate"))
+
+			now = now.Add(tr.elapsed)
+			require.Equal(t, tr.expectedAllow, limiter.allow(tr.key))
+		})
+	}
+}
+
+func TestEventLimiterSweep(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	limiter := newEventLimiter(5 * time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < minEventSweep-1; i++ {
+		require.True(t, limiter.allow("ns/workspace"+strconv.Itoa(i)+"/InvalidHostTemplate"))
+	}
+
+	// Expired keys are only dropped once the map reaches the sweep size
+	now = now.Add(5 * time.Minute)
+	require.True(t, limiter.allow("ns/workspace1/InvalidHostTemplate"))
+	require.Len(t, limiter.recorded, minEventSweep-1)
+	require.True(t, limiter.allow("ns/other/InvalidHostTemplate"))
+	require.Len(t, limiter.recorded, 2)
+	require.Equal(t, minEventSweep, limiter.sweepAt)
+}
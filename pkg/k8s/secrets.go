@@ -0,0 +1,76 @@
+package k8s
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// secretTTL is how long a secret is reused. A rotated CA secret is picked up
+// by the first reconciliation of the service after it expired.
+const secretTTL = time.Minute
+
+// minSecretSweep is the number of cached secrets from which expired ones are swept.
+const minSecretSweep = 64
+
+type secretGetter func(ctx context.Context, namespace, name string) (*v1.Secret, error)
+
+// secretCache keeps secrets which were read successfully for ttl. Failed
+// reads are not cached, the next lookup tries again.
+type secretCache struct {
+	read secretGetter
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	secrets map[string]cachedSecret
+	// sweepAt is the number of secrets at which expired ones are dropped
+	sweepAt int
+}
+
+type cachedSecret struct {
+	secret *v1.Secret
+	readAt time.Time
+}
+
+func newSecretCache(read secretGetter, ttl time.Duration) *secretCache {
+	return &secretCache{
+		read:    read,
+		ttl:     ttl,
+		now:     time.Now,
+		secrets: make(map[string]cachedSecret),
+		sweepAt: minSecretSweep,
+	}
+}
+
+func (c *secretCache) get(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	key := namespace + "/" + name
+
+	c.mu.Lock()
+	cached, ok := c.secrets[key]
+	c.mu.Unlock()
+	if ok && c.now().Sub(cached.readAt) < c.ttl {
+		return cached.secret, nil
+	}
+
+	secret, err := c.read(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.secrets[key] = cachedSecret{secret: secret, readAt: now}
+	if len(c.secrets) >= c.sweepAt {
+		for k, s := range c.secrets {
+			if now.Sub(s.readAt) >= c.ttl {
+				delete(c.secrets, k)
+			}
+		}
+		c.sweepAt = max(2*len(c.secrets), minSecretSweep)
+	}
+	return secret, nil
+}
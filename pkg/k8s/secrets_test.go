@@ -0,0 +1,75 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeSecrets struct {
+	reads  int
+	secret *v1.Secret
+	err    error
+}
+
+func (f *fakeSecrets) read(context.Context, string, string) (*v1.Secret, error) {
+	f.reads++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.secret, nil
+}
+
+func newCASecret(ca string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "backend-ca"},
+		Data:       map[string][]byte{"ca.crt": []byte(ca)},
+	}
+}
+
+func TestSecretCacheRotation(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	secrets := &fakeSecrets{secret: newCASecret("ca1")}
+	cache := newSecretCache(secrets.read, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	secret, err := cache.get(context.Background(), "ns", "backend-ca")
+	require.Nil(t, err)
+	require.Equal(t, "ca1", string(secret.Data["ca.crt"]))
+
+	// Reconciling other services within the TTL does not read the secret again
+	secrets.secret = newCASecret("ca2")
+	now = now.Add(30 * time.Second)
+	secret, err = cache.get(context.Background(), "ns", "backend-ca")
+	require.Nil(t, err)
+	require.Equal(t, "ca1", string(secret.Data["ca.crt"]))
+	require.Equal(t, 1, secrets.reads)
+
+	// The rotated secret is read once the TTL expired
+	now = now.Add(30 * time.Second)
+	secret, err = cache.get(context.Background(), "ns", "backend-ca")
+	require.Nil(t, err)
+	require.Equal(t, "ca2", string(secret.Data["ca.crt"]))
+	require.Equal(t, 2, secrets.reads)
+}
+
+func TestSecretCacheError(t *testing.T) {
+	secrets := &fakeSecrets{err: errors.New("forbidden")}
+	cache := newSecretCache(secrets.read, time.Minute)
+
+	_, err := cache.get(context.Background(), "ns", "backend-ca")
+	require.EqualError(t, err, "forbidden")
+
+	// Failures are not cached, the next reconciliation reads the secret again
+	secrets.err = nil
+	secrets.secret = newCASecret("ca1")
+	secret, err := cache.get(context.Background(), "ns", "backend-ca")
+	require.Nil(t, err)
+	require.Equal(t, "ca1", string(secret.Data["ca.crt"]))
+	require.Equal(t, 2, secrets.reads)
+}
@@ -0,0 +1,27 @@
+package logging
+
+// Format selects how the access log is written.
+type Format string
+
+const (
+	// FormatJSON writes access log entries through the structured logger
+	FormatJSON Format = "json"
+	// FormatCombined writes entries in the Apache combined log format
+	FormatCombined Format = "combined"
+	// FormatOff disables the access log
+	FormatOff Format = "off"
+)
+
+type AccessLogConfig struct {
+	Format Format `yaml:"format"`
+	// LogHeaders adds the request headers to JSON entries, the values of the
+	// headers denylisted in log_redaction are replaced
+	LogHeaders bool `yaml:"log_headers"`
+	// RedactPathPatterns lists regular expressions whose matches in the path
+	// are replaced in the log, e.g. "glpat-[0-9A-Za-z_-]+"
+	RedactPathPatterns []string `yaml:"redact_path_patterns"`
+}
+
+func IsValidFormat(format Format) bool {
+	return format == FormatJSON || format == FormatCombined || format == FormatOff
+}
@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey struct{}
+
+// Details describe a request beyond what the access log middleware sees
+// itself. The handlers behind the middleware fill them in while serving the
+// request.
+type Details struct {
+	Username      string
+	WorkspaceID   string
+	WorkspaceName string
+	// Upstream is the address of the workspace backend which served the request
+	Upstream string
+}
+
+// DetailsFromRequest returns the details logged for the request. Requests
+// which did not pass the middleware get details which are not logged.
+func DetailsFromRequest(r *http.Request) *Details {
+	if details, ok := r.Context().Value(contextKey{}).(*Details); ok {
+		return details
+	}
+	return &Details{}
+}
+
+func withDetails(r *http.Request, details *Details) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, details))
+}
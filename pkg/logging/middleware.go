@@ -1,26 +1,116 @@
 package logging
 
 import (
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
 	"go.uber.org/zap"
 )
 
-func NewMiddleware(logger *zap.Logger) func(http.Handler) http.Handler {
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// NewMiddleware writes an access log entry for every request once it has been
+// served, which for websockets is when the connection is closed. Entries in
+// the combined format are written to out, JSON entries go through logger.
+// Query parameters and headers are redacted by logRedactor, like in the other
+// logs.
+func NewMiddleware(logger *zap.Logger, config AccessLogConfig, logRedactor *logz.Redactor, out io.Writer) (func(http.Handler) http.Handler, error) {
+	redactor, err := newRedactor(config, logRedactor)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(next http.Handler) http.Handler {
+		if config.Format == FormatOff {
+			return next
+		}
+
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			details := &Details{}
 			recorder := newResponseRecorder(w)
-			next.ServeHTTP(recorder, r)
-
-			logger.Info("processed HTTP request",
-				logz.HTTPPath(r.URL.Path),
-				logz.HTTPIp(r.RemoteAddr),
-				logz.HTTPStatus(recorder.status),
-				logz.HTTPHost(r.Host),
-				logz.HTTPMethod(r.Method),
-				logz.HTTPScheme(r.URL.Scheme),
-			)
+			next.ServeHTTP(recorder, withDetails(r, details))
+
+			if config.Format == FormatCombined {
+				writeCombined(out, redactor, r, recorder, details, start)
+				return
+			}
+			logJSON(logger, redactor, config.LogHeaders, r, recorder, details, start)
 		})
+	}, nil
+}
+
+func logJSON(logger *zap.Logger, redactor *redactor, logHeaders bool, r *http.Request, recorder *responseRecorder, details *Details, start time.Time) {
+	end := time.Now()
+	client := clientinfo.FromRequest(r)
+	fields := []zap.Field{
+		logz.HTTPPath(redactor.path(r.URL.EscapedPath())),
+		logz.HTTPQuery(redactor.Query(r.URL.RawQuery)),
+		logz.HTTPIp(client.IP),
+		logz.HTTPStatus(recorder.status),
+		logz.HTTPHost(client.Host),
+		logz.HTTPMethod(r.Method),
+		logz.HTTPScheme(client.SchemeOr("http")),
+		logz.HTTPDuration(end.Sub(start)),
+		logz.HTTPResponseBytes(recorder.bytes.Load()),
+		logz.HTTPUserAgent(r.UserAgent()),
+		logz.Username(details.Username),
+		logz.WorkspaceID(details.WorkspaceID),
+		logz.WorkspaceName(details.WorkspaceName),
+		logz.Upstream(details.Upstream),
+		logz.Websocket(recorder.hijacked()),
+	}
+	if recorder.hijacked() {
+		fields = append(fields, logz.WebsocketDuration(end.Sub(recorder.hijackedAt)))
+	}
+	if logHeaders {
+		fields = append(fields, redactor.HTTPHeaders(r.Header))
 	}
+
+	requestid.Logger(logger, r).Info("processed HTTP request", fields...)
+}
+
+// writeCombined writes an entry in the Apache combined log format:
+// host ident user [time] "request line" status bytes "referer" "user agent"
+func writeCombined(out io.Writer, redactor *redactor, r *http.Request, recorder *responseRecorder, details *Details, start time.Time) {
+	bytes := "-"
+	if n := recorder.bytes.Load(); n > 0 {
+		bytes = strconv.FormatInt(n, 10)
+	}
+
+	referer := r.Referer()
+	if referer != "" {
+		referer = redactor.rawURL(referer)
+	}
+
+	_, _ = fmt.Fprintf(out, "%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		orDash(clientinfo.FromRequest(r).IP),
+		orDash(details.Username),
+		start.Format(combinedTimeFormat),
+		r.Method,
+		escapeQuotes(redactor.requestURI(r.URL)),
+		r.Proto,
+		recorder.status,
+		bytes,
+		escapeQuotes(orDash(referer)),
+		escapeQuotes(orDash(r.UserAgent())),
+	)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func escapeQuotes(value string) string {
+	return strings.ReplaceAll(value, `"`, `\"`)
 }
@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func testHandler(w http.ResponseWriter, r *http.Request) {
+	details := DetailsFromRequest(r)
+	details.Username = "root"
+	details.WorkspaceID = "1"
+	details.WorkspaceName = "workspace1"
+	details.Upstream = "workspace1.default:3000"
+	_, _ = w.Write([]byte("Hello World"))
+}
+
+func TestMiddlewareJSON(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	middleware, err := NewMiddleware(zap.New(core), AccessLogConfig{
+		Format:             FormatJSON,
+		RedactPathPatterns: []string{"glpat-[0-9A-Za-z_-]+"},
+	}, nil, nil)
+	require.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com/tokens/glpat-secret/files?private_token=abc&page=2", nil)
+	middleware(http.HandlerFunc(testHandler)).ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	require.Equal(t, "/tokens/REDACTED/files", fields["http_path"])
+	require.Equal(t, "private_token=REDACTED&page=2", fields["http_query"])
+	require.Equal(t, int64(http.StatusOK), fields["http_status"])
+	require.Equal(t, int64(len("Hello World")), fields["http_response_bytes"])
+	require.Equal(t, "root", fields["username"])
+	require.Equal(t, "1", fields["workspace_id"])
+	require.Equal(t, "workspace1", fields["workspace_name"])
+	require.Equal(t, "workspace1.default:3000", fields["upstream"])
+	require.Equal(t, false, fields["websocket"])
+	require.Contains(t, fields, "http_duration")
+}
+
+func TestMiddlewareCombined(t *testing.T) {
+	var out bytes.Buffer
+	middleware, err := NewMiddleware(zap.NewNop(), AccessLogConfig{
+		Format: FormatCombined,
+	}, nil, &out)
+	require.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com/callback?code=abc&state=xyz", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Referer", "https://gitlab.com/oauth/authorize?code=abc")
+	req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	middleware(http.HandlerFunc(testHandler)).ServeHTTP(httptest.NewRecorder(), req)
+
+	line := out.String()
+	require.True(t, strings.HasPrefix(line, "192.0.2.1 - root ["), line)
+	require.Contains(t, line, `"GET /callback?code=REDACTED&state=xyz HTTP/1.1" 200 11 "https://gitlab.com/oauth/authorize?code=REDACTED" "curl/8.0 \"quoted\""`)
+	require.True(t, strings.HasSuffix(line, "\n"))
+}
+
+func TestMiddlewareHeaders(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	redactor := logz.NewRedactor(logz.Redaction{QueryParams: []string{"session"}, Headers: []string{"Cookie"}})
+	middleware, err := NewMiddleware(zap.New(core), AccessLogConfig{Format: FormatJSON, LogHeaders: true}, redactor, nil)
+	require.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com/?session=abc&token=xyz", nil)
+	req.Header.Set("Cookie", "gitlab-workspace-session=abc")
+	req.Header.Set("Accept", "text/html")
+	middleware(http.HandlerFunc(testHandler)).ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	require.Equal(t, "session=REDACTED&token=xyz", fields["http_query"])
+	require.Equal(t, map[string]interface{}{
+		"Accept": "text/html",
+		"Cookie": logz.Redacted,
+	}, fields["http_headers"])
+}
+
+func TestMiddlewareOff(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	middleware, err := NewMiddleware(zap.New(core), AccessLogConfig{Format: FormatOff}, nil, nil)
+	require.Nil(t, err)
+
+	middleware(http.HandlerFunc(testHandler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, 0, logs.Len())
+}
+
+func TestMiddlewareInvalidPathPattern(t *testing.T) {
+	_, err := NewMiddleware(zap.NewNop(), AccessLogConfig{Format: FormatJSON, RedactPathPatterns: []string{"("}}, nil, nil)
+	require.NotNil(t, err)
+}
+
+func TestMiddlewareWebsocket(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	middleware, err := NewMiddleware(zap.New(core), AccessLogConfig{Format: FormatJSON}, nil, nil)
+	require.Nil(t, err)
+
+	srv := httptest.NewServer(middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, hijackErr := http.NewResponseController(w).Hijack()
+		require.Nil(t, hijackErr)
+		defer func() { _ = conn.Close() }()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = conn.Write([]byte("frame"))
+	})))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	require.Nil(t, err)
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	require.Eventually(t, func() bool { return logs.Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+	fields := logs.All()[0].ContextMap()
+	require.Equal(t, int64(http.StatusSwitchingProtocols), fields["http_status"])
+	require.Equal(t, true, fields["websocket"])
+	require.Equal(t, int64(len("frame")), fields["http_response_bytes"])
+	require.Contains(t, fields, "websocket_duration")
+}
@@ -5,15 +5,20 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type responseRecorder struct {
 	http.ResponseWriter
 	status int
+	// bytes is updated from the goroutines copying a hijacked connection
+	bytes      atomic.Int64
+	hijackedAt time.Time
 }
 
 func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
-	return &responseRecorder{w, http.StatusOK}
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
 }
 
 func (r *responseRecorder) WriteHeader(statusCode int) {
@@ -26,13 +31,20 @@ func (r *responseRecorder) Write(b []byte) (int, error) {
 		// The status will be StatusOK if WriteHeader has not been called yet
 		r.status = http.StatusOK
 	}
-	return r.ResponseWriter.Write(b)
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes.Add(int64(n))
+	return n, err
+}
+
+func (r *responseRecorder) hijacked() bool {
+	return !r.hijackedAt.IsZero()
 }
 
 // Hijack has to be implemented by the recorder in order to support websocket
 // connections needed by the IDE. Without this interface the HTTP request
 // cannot be converted to a websocket. The hijack method ensures that we
-// can access the underlying raw TCP connection.
+// can access the underlying raw TCP connection. The reverse proxy writes the
+// 101 response to the connection itself, so the status is recorded here.
 func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hj, ok := r.ResponseWriter.(http.Hijacker)
 	if !ok {
@@ -41,5 +53,38 @@ func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 		return nil, nil, fmt.Errorf("hijack not supported")
 	}
 
-	return hj.Hijack()
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.status = http.StatusSwitchingProtocols
+	r.hijackedAt = time.Now()
+	return &countingConn{Conn: conn, bytes: &r.bytes}, rw, nil
+}
+
+// countingConn counts the bytes sent to the client over a hijacked connection.
+type countingConn struct {
+	net.Conn
+	bytes *atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+// Flush has to be implemented by the recorder so that streamed responses such
+// as server-sent events reach the client as soon as the proxy flushes them.
+// Without it the recorder hides the http.Flusher of the underlying writer.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
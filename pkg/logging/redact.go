@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+)
+
+// redactor removes credentials from URLs before they are logged. Query
+// parameters are redacted like in every other log, path patterns only apply
+// to the access log.
+type redactor struct {
+	*logz.Redactor
+	pathPatterns []*regexp.Regexp
+}
+
+func newRedactor(config AccessLogConfig, logRedactor *logz.Redactor) (*redactor, error) {
+	r := &redactor{Redactor: logRedactor}
+
+	for _, pattern := range config.RedactPathPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log path redaction pattern %q: %w", pattern, err)
+		}
+		r.pathPatterns = append(r.pathPatterns, re)
+	}
+	return r, nil
+}
+
+func (r *redactor) path(path string) string {
+	for _, re := range r.pathPatterns {
+		path = re.ReplaceAllString(path, logz.Redacted)
+	}
+	return path
+}
+
+// requestURI returns the redacted path and query of u.
+func (r *redactor) requestURI(u *url.URL) string {
+	uri := r.path(u.EscapedPath())
+	if query := r.Query(u.RawQuery); query != "" {
+		uri += "?" + query
+	}
+	return uri
+}
+
+// rawURL redacts a full URL such as the Referer header.
+func (r *redactor) rawURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.RawPath = ""
+	u.Path = r.path(u.Path)
+	u.RawQuery = r.Query(u.RawQuery)
+	return u.String()
+}
@@ -0,0 +1,265 @@
+// Package proxyproto implements the receiving side of the PROXY protocol v1
+// and v2 so that listeners behind a load balancer see the real client address.
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+)
+
+const (
+	defaultHeaderTimeout = 10 * time.Second
+	// v1 headers are at most 107 bytes including the CRLF
+	maxV1HeaderLength = 107
+	v2HeaderLength    = 16
+
+	v1Signature = "PROXY "
+	v2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+var (
+	ErrInvalidHeader  = errors.New("invalid PROXY protocol header")
+	errNoTrustedCIDRs = errors.New("PROXY protocol is enabled without trusted CIDRs")
+)
+
+// Result describes where the remote address of a connection comes from.
+type Result string
+
+const (
+	// ResultProxied connections carry the client address in their header
+	ResultProxied Result = "proxied"
+	// ResultDirect connections come from a trusted source without a client
+	// address, e.g. health checks of the load balancer
+	ResultDirect Result = "direct"
+	// ResultUntrusted connections are not allowed to send a header
+	ResultUntrusted Result = "untrusted"
+	// ResultInvalid connections sent a malformed header and are refused
+	ResultInvalid Result = "invalid"
+)
+
+// Listener wraps a listener and parses the PROXY protocol header of
+// connections coming from trusted sources. Connections from other sources
+// are passed through untouched, so a client cannot spoof its address by
+// sending a header itself.
+type Listener struct {
+	net.Listener
+	trusted       cidr.Set
+	headerTimeout time.Duration
+	observe       func(Result)
+}
+
+// NewListener creates a PROXY protocol listener. observe is called once per
+// connection with the outcome of reading its header, it may be nil.
+func NewListener(listener net.Listener, trusted cidr.Set, observe func(Result)) *Listener {
+	return &Listener{
+		Listener:      listener,
+		trusted:       trusted,
+		headerTimeout: defaultHeaderTimeout,
+		observe:       observe,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:          conn,
+		trusted:       l.trusted.ContainsAddr(conn.RemoteAddr()),
+		headerTimeout: l.headerTimeout,
+		observe:       l.observe,
+	}, nil
+}
+
+// Conn reads the PROXY protocol header lazily on the first Read or
+// RemoteAddr call, so that a slow client cannot block the accept loop.
+type Conn struct {
+	net.Conn
+	trusted       bool
+	headerTimeout time.Duration
+	observe       func(Result)
+
+	once       sync.Once
+	reader     io.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remoteAddr
+}
+
+// PeerAddr returns the address of the connection peer, e.g. the load balancer
+// which sent the PROXY protocol header, while RemoteAddr returns the client.
+func (c *Conn) PeerAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	result := c.parseHeader()
+	if c.observe != nil {
+		c.observe(result)
+	}
+}
+
+func (c *Conn) parseHeader() Result {
+	c.reader = c.Conn
+	c.remoteAddr = c.Conn.RemoteAddr()
+	if !c.trusted {
+		return ResultUntrusted
+	}
+
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout)); err != nil {
+		c.err = err
+		return ResultInvalid
+	}
+	defer func() {
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+			c.err = err
+		}
+	}()
+
+	reader := bufio.NewReaderSize(c.Conn, maxV1HeaderLength)
+	c.reader = reader
+
+	addr, err := parseHeader(reader)
+	if err != nil {
+		c.err = err
+		return ResultInvalid
+	}
+
+	if addr == nil {
+		return ResultDirect
+	}
+	c.remoteAddr = addr
+	return ResultProxied
+}
+
+// parseHeader consumes a PROXY protocol header from the reader. A nil address
+// is returned when there is no header or when it does not carry the client
+// address, e.g. for health checks of the load balancer itself.
+func parseHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(v1Signature))
+	if err != nil {
+		// Too short to hold a header, leave the data for the application
+		return nil, nil //nolint:nilerr
+	}
+
+	if string(signature) == v1Signature {
+		return parseV1(reader)
+	}
+
+	signature, err = reader.Peek(len(v2Signature))
+	if err == nil && string(signature) == v2Signature {
+		return parseV2(reader)
+	}
+
+	return nil, nil
+}
+
+func parseV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > maxV1HeaderLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, fields)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: invalid source address", ErrInvalidHeader)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func parseV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version", ErrInvalidHeader)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	// LOCAL connections are initiated by the proxy itself and keep the real address
+	if versionCommand&0x0F == 0x00 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Wrap returns a PROXY protocol listener when it is enabled in the config and
+// the listener itself otherwise.
+func Wrap(listener net.Listener, cfg config.ProxyProtocol, observe func(Result)) (net.Listener, error) {
+	if !cfg.Enabled {
+		return listener, nil
+	}
+
+	if len(cfg.TrustedCIDRs) == 0 {
+		return nil, errNoTrustedCIDRs
+	}
+
+	trusted, err := cidr.Parse(cfg.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(listener, trusted, observe), nil
+}
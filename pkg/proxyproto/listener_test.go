@@ -0,0 +1,132 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+)
+
+func v2Header(command byte, family byte, payload []byte) []byte {
+	header := []byte(v2Signature)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestListener(t *testing.T) {
+	tcp4Payload := []byte{
+		203, 0, 113, 7, // source address
+		10, 0, 0, 1, // destination address
+		0x30, 0x39, // source port 12345
+		0x00, 0x16, // destination port 22
+	}
+
+	tt := []struct {
+		description        string
+		trusted            []string
+		data               []byte
+		expectedError      bool
+		expectedRemoteAddr string
+		expectedPayload    string
+		expectedResult     Result
+	}{
+		{
+			description:        "When a trusted source sends a v1 header uses the client address",
+			trusted:            []string{"127.0.0.1"},
+			data:               []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 22\r\nhello"),
+			expectedRemoteAddr: "203.0.113.7:12345",
+			expectedPayload:    "hello",
+			expectedResult:     ResultProxied,
+		},
+		{
+			description:        "When a trusted source sends a v1 IPv6 header uses the client address",
+			trusted:            []string{"127.0.0.1"},
+			data:               []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 22\r\nhello"),
+			expectedRemoteAddr: "[2001:db8::1]:12345",
+			expectedPayload:    "hello",
+			expectedResult:     ResultProxied,
+		},
+		{
+			description:        "When a trusted source sends a v2 header uses the client address",
+			trusted:            []string{"127.0.0.1"},
+			data:               append(v2Header(0x1, 0x11, tcp4Payload), []byte("hello")...),
+			expectedRemoteAddr: "203.0.113.7:12345",
+			expectedPayload:    "hello",
+			expectedResult:     ResultProxied,
+		},
+		{
+			description:     "When a trusted source sends a v2 LOCAL header keeps the connection address",
+			trusted:         []string{"127.0.0.1"},
+			data:            append(v2Header(0x0, 0x00, nil), []byte("hello")...),
+			expectedPayload: "hello",
+			expectedResult:  ResultDirect,
+		},
+		{
+			description:     "When a trusted source sends no header passes the data through",
+			trusted:         []string{"127.0.0.1"},
+			data:            []byte("SSH-2.0-OpenSSH_9.0\r\n"),
+			expectedPayload: "SSH-2.0-OpenSSH_9.0\r\n",
+			expectedResult:  ResultDirect,
+		},
+		{
+			description:     "When an untrusted source sends a header ignores it",
+			trusted:         []string{"10.0.0.0/8"},
+			data:            []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 22\r\nhello"),
+			expectedPayload: "PROXY TCP4 203.0.113.7 10.0.0.1 12345 22\r\nhello",
+			expectedResult:  ResultUntrusted,
+		},
+		{
+			description:    "When a trusted source sends a malformed header returns error",
+			trusted:        []string{"127.0.0.1"},
+			data:           []byte("PROXY TCP4 not-an-ip 10.0.0.1 12345 22\r\nhello"),
+			expectedError:  true,
+			expectedResult: ResultInvalid,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			trusted, err := cidr.Parse(tr.trusted)
+			require.Nil(t, err)
+
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.Nil(t, err)
+			results := make(chan Result, 1)
+			listener := NewListener(tcpListener, trusted, func(result Result) { results <- result })
+			defer func() { _ = listener.Close() }()
+
+			go func() {
+				client, dialErr := net.Dial("tcp", listener.Addr().String())
+				if dialErr != nil {
+					return
+				}
+				_, _ = client.Write(tr.data)
+				_ = client.(*net.TCPConn).CloseWrite()
+			}()
+
+			conn, err := listener.Accept()
+			require.Nil(t, err)
+			defer func() { _ = conn.Close() }()
+
+			payload, err := io.ReadAll(conn)
+			require.Equal(t, tr.expectedResult, <-results)
+			if tr.expectedError {
+				require.ErrorIs(t, err, ErrInvalidHeader)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedPayload, string(payload))
+			if tr.expectedRemoteAddr != "" {
+				require.Equal(t, tr.expectedRemoteAddr, conn.RemoteAddr().String())
+			} else {
+				require.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+			}
+			require.Equal(t, "127.0.0.1", conn.(*Conn).PeerAddr().(*net.TCPAddr).IP.String())
+		})
+	}
+}
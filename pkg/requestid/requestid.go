@@ -0,0 +1,83 @@
+// Package requestid gives every HTTP request an ID which ties together the
+// proxy logs, the response seen by the user and the logs of the workspace.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"go.uber.org/zap"
+)
+
+// HeaderName carries the request ID to the workspace and back to the client.
+const HeaderName = "X-Request-ID"
+
+const (
+	maxLength       = 128
+	generatedLength = 16
+)
+
+type contextKey struct{}
+
+// NewMiddleware stores the request ID in the request context and sets it on
+// the request and response headers. An incoming ID is kept when the peer is
+// in trusted, e.g. the ingress controller, otherwise a new one is generated.
+func NewMiddleware(trusted cidr.Set) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(HeaderName)
+			if !trusted.ContainsHostPort(r.RemoteAddr) || !isValid(id) {
+				id = generate()
+			}
+
+			r.Header.Set(HeaderName, id)
+			w.Header().Set(HeaderName, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+		})
+	}
+}
+
+// FromContext returns the request ID, or an empty string for requests which
+// did not pass the middleware.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger adds the request ID of r to every entry written by logger.
+func Logger(logger *zap.Logger, r *http.Request) *zap.Logger {
+	id := FromContext(r.Context())
+	if id == "" {
+		return logger
+	}
+	return logger.With(logz.RequestID(id))
+}
+
+func generate() string {
+	b := make([]byte, generatedLength)
+	// crypto/rand does not fail on supported platforms
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isValid rejects IDs which would be unsafe to echo in headers, logs and
+// error pages.
+func isValid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '+', c == '=', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
+)
+
+func TestMiddleware(t *testing.T) {
+	trusted, err := cidr.Parse([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+
+	tt := []struct {
+		description  string
+		remoteAddr   string
+		incomingID   string
+		expectedKept bool
+	}{
+		{
+			description:  "When the peer is trusted keeps the incoming request ID",
+			remoteAddr:   "10.0.0.1:1234",
+			incomingID:   "abc-123",
+			expectedKept: true,
+		},
+		{
+			description: "When the peer is not trusted generates a request ID",
+			remoteAddr:  "192.168.0.1:1234",
+			incomingID:  "abc-123",
+		},
+		{
+			description: "When no request ID is sent generates one",
+			remoteAddr:  "10.0.0.1:1234",
+		},
+		{
+			description: "When the incoming request ID contains invalid characters generates one",
+			remoteAddr:  "10.0.0.1:1234",
+			incomingID:  "<script>",
+		},
+		{
+			description: "When the incoming request ID is too long generates one",
+			remoteAddr:  "10.0.0.1:1234",
+			incomingID:  strings.Repeat("a", maxLength+1),
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			var contextID, forwardedID string
+			handler := NewMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contextID = FromContext(r.Context())
+				forwardedID = r.Header.Get(HeaderName)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com", nil)
+			req.RemoteAddr = tr.remoteAddr
+			if tr.incomingID != "" {
+				req.Header.Set(HeaderName, tr.incomingID)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			require.NotEmpty(t, contextID)
+			require.Equal(t, contextID, forwardedID)
+			require.Equal(t, contextID, recorder.Header().Get(HeaderName))
+			if tr.expectedKept {
+				require.Equal(t, tr.incomingID, contextID)
+			} else {
+				require.NotEqual(t, tr.incomingID, contextID)
+				require.Len(t, contextID, 2*generatedLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
+)
+
+// StripPrefix returns a copy of the request in which the backend sees the path
+// below the route prefix. The prefix is passed on in X-Forwarded-Prefix for
+// backends which build absolute links themselves.
+func (r *Route) StripPrefix(req *http.Request) *http.Request {
+	if r.Prefix == "" {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Path = r.Path
+	if req.URL.RawPath != "" {
+		// The client may have spelled the port differently than the prefix,
+		// so strip as many segments as the prefix has
+		rest := req.URL.RawPath
+		for i := strings.Count(r.Prefix, "/"); i > 0; i-- {
+			_, rest, _ = strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+		}
+		req.URL.RawPath = "/" + rest
+	}
+	req.Header.Set("X-Forwarded-Prefix", r.Prefix)
+	return req
+}
+
+// RewriteResponse maps redirects and cookie paths of a backend response back
+// below the route prefix. backendHost is the host:port the request was sent to.
+func (r *Route) RewriteResponse(res *http.Response, backendHost string) {
+	if r.Prefix == "" {
+		return
+	}
+
+	if location := res.Header.Get("Location"); location != "" {
+		clientHost := ""
+		if res.Request != nil {
+			clientHost = clientinfo.FromRequest(res.Request).Host
+		}
+		res.Header.Set("Location", r.rewriteLocation(location, backendHost, clientHost))
+	}
+
+	cookies := res.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = r.rewriteCookiePath(cookie)
+	}
+}
+
+// TrailingSlashRedirect is the location a request for the bare route prefix is
+// redirected to.
+func (r *Route) TrailingSlashRedirect(req *http.Request) string {
+	location := r.Prefix + "/"
+	if req.URL.RawQuery != "" {
+		location += "?" + req.URL.RawQuery
+	}
+	return location
+}
+
+func (r *Route) rewriteLocation(location string, backendHost string, clientHost string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	switch {
+	case u.Host == "":
+	case u.Host == backendHost:
+		// Redirects built from the backend address are made relative to the proxy
+		u.Scheme = ""
+		u.Host = ""
+	case u.Host == clientHost:
+	default:
+		return location
+	}
+
+	// Relative locations resolve below the prefix already
+	if !strings.HasPrefix(u.Path, "/") || r.hasPrefix(u.Path) {
+		return u.String()
+	}
+
+	u.Path = r.Prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = r.Prefix + u.RawPath
+	}
+	return u.String()
+}
+
+func (r *Route) rewriteCookiePath(cookie string) string {
+	attributes := strings.Split(cookie, ";")
+	// The first pair is the cookie itself, the attributes follow
+	for i := 1; i < len(attributes); i++ {
+		key, value, found := strings.Cut(strings.TrimSpace(attributes[i]), "=")
+		if !found || !strings.EqualFold(key, "path") || !strings.HasPrefix(value, "/") || r.hasPrefix(value) {
+			continue
+		}
+		attributes[i] = " " + key + "=" + r.Prefix + value
+	}
+	return strings.Join(attributes, ";")
+}
+
+// hasPrefix reports whether the backend already built the path below the
+// prefix, e.g. from X-Forwarded-Prefix.
+func (r *Route) hasPrefix(path string) bool {
+	return path == r.Prefix || strings.HasPrefix(path, r.Prefix+"/")
+}
@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripPrefix(t *testing.T) {
+	route := &Route{Prefix: "/w/workspace1/3000", Path: "/files/a b"}
+	request := httptest.NewRequest(http.MethodGet, "http://workspaces.com/w/workspace1/3000/files/a%20b?x=1", nil)
+
+	stripped := route.StripPrefix(request)
+
+	require.Equal(t, "/files/a b", stripped.URL.Path)
+	require.Equal(t, "x=1", stripped.URL.RawQuery)
+	require.Equal(t, "/w/workspace1/3000", stripped.Header.Get("X-Forwarded-Prefix"))
+	require.Equal(t, "/w/workspace1/3000/files/a b", request.URL.Path)
+}
+
+func TestStripPrefixEscapedPath(t *testing.T) {
+	// The client spelled the port with a leading zero, the prefix is normalised
+	route := &Route{Prefix: "/w/workspace1/3000", Path: "/files/a/b"}
+	request := httptest.NewRequest(http.MethodGet, "http://workspaces.com/w/workspace1/03000/files/a%2Fb", nil)
+
+	stripped := route.StripPrefix(request)
+
+	require.Equal(t, "/files/a/b", stripped.URL.Path)
+	require.Equal(t, "/files/a%2Fb", stripped.URL.RawPath)
+	require.Equal(t, "/files/a%2Fb", stripped.URL.EscapedPath())
+}
+
+func TestRewriteResponse(t *testing.T) {
+	route := &Route{Prefix: "/w/workspace1/3000"}
+
+	tt := []struct {
+		description        string
+		location           string
+		cookies            []string
+		expectedLocation   string
+		expectedSetCookies []string
+	}{
+		{
+			description:      "When the location is an absolute path adds the prefix",
+			location:         "/login?next=%2F",
+			expectedLocation: "/w/workspace1/3000/login?next=%2F",
+		},
+		{
+			description:      "When the location points to the backend makes it relative to the proxy",
+			location:         "http://10.0.0.1:3000/login",
+			expectedLocation: "/w/workspace1/3000/login",
+		},
+		{
+			description:      "When the location points to the proxy host adds the prefix",
+			location:         "https://workspaces.com/login",
+			expectedLocation: "https://workspaces.com/w/workspace1/3000/login",
+		},
+		{
+			description:      "When the location is relative keeps it",
+			location:         "login",
+			expectedLocation: "login",
+		},
+		{
+			description:      "When the location is already below the prefix keeps it",
+			location:         "/w/workspace1/3000/login",
+			expectedLocation: "/w/workspace1/3000/login",
+		},
+		{
+			description:      "When the location points to another host keeps it",
+			location:         "https://gitlab.com/oauth/authorize",
+			expectedLocation: "https://gitlab.com/oauth/authorize",
+		},
+		{
+			description: "When cookies have a path adds the prefix",
+			cookies: []string{
+				"session=abc; Path=/; HttpOnly",
+				"path=/api; path=/api",
+				"theme=dark",
+				"lang=en; Path=/w/workspace1/3000/",
+			},
+			expectedSetCookies: []string{
+				"session=abc; Path=/w/workspace1/3000/; HttpOnly",
+				"path=/api; path=/w/workspace1/3000/api",
+				"theme=dark",
+				"lang=en; Path=/w/workspace1/3000/",
+			},
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			res := &http.Response{
+				Header:  http.Header{},
+				Request: httptest.NewRequest(http.MethodGet, "https://workspaces.com/login", nil),
+			}
+			if tr.location != "" {
+				res.Header.Set("Location", tr.location)
+			}
+			for _, cookie := range tr.cookies {
+				res.Header.Add("Set-Cookie", cookie)
+			}
+
+			route.RewriteResponse(res, "10.0.0.1:3000")
+
+			require.Equal(t, tr.expectedLocation, res.Header.Get("Location"))
+			require.Equal(t, tr.expectedSetCookies, res.Header.Values("Set-Cookie"))
+		})
+	}
+}
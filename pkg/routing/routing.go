@@ -0,0 +1,126 @@
+// Package routing maps an incoming request to the workspace port it targets,
+// either by hostname or by a path of the form /w/<workspace-name>/<port>/.
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+type Mode string
+
+const (
+	// ModeHost routes on the hostname rendered from the host template annotation
+	ModeHost Mode = "host"
+	// ModePath routes on the path so that a single hostname serves every workspace
+	ModePath Mode = "path"
+
+	DefaultPathPrefix = "/w"
+)
+
+func IsValidMode(mode Mode) bool {
+	return mode == ModeHost || mode == ModePath
+}
+
+// Route is a workspace port resolved from a request.
+type Route struct {
+	Mapping *upstream.HostMapping
+	// Prefix is stripped from the request before it is proxied, e.g.
+	// "/w/workspace1/3000". It is empty in host mode.
+	Prefix string
+	// WorkspacePrefix is the part of Prefix shared by every port of the
+	// workspace, e.g. "/w/workspace1".
+	WorkspacePrefix string
+	// Path is the request path as seen by the backend
+	Path string
+	// MissingTrailingSlash is set when the path stops at the port, e.g.
+	// "/w/workspace1/3000", so that relative links would resolve outside of
+	// the workspace.
+	MissingTrailingSlash bool
+}
+
+// CookiePath is the path of cookies scoped to the workspace.
+func (r *Route) CookiePath() string {
+	return r.WorkspacePrefix + "/"
+}
+
+type Resolver struct {
+	mode       Mode
+	pathPrefix string
+	tracker    *upstream.Tracker
+}
+
+func NewResolver(mode Mode, pathPrefix string, tracker *upstream.Tracker) *Resolver {
+	if mode == "" {
+		mode = ModeHost
+	}
+	if pathPrefix == "" {
+		pathPrefix = DefaultPathPrefix
+	}
+
+	return &Resolver{
+		mode:       mode,
+		pathPrefix: "/" + strings.Trim(pathPrefix, "/"),
+		tracker:    tracker,
+	}
+}
+
+// Mode returns how requests are routed.
+func (r *Resolver) Mode() Mode {
+	return r.mode
+}
+
+// PathPrefix returns the prefix of workspace paths in path mode.
+func (r *Resolver) PathPrefix() string {
+	return r.pathPrefix
+}
+
+// Resolve finds the workspace port serving the given hostname and path.
+func (r *Resolver) Resolve(hostname string, path string) (*Route, error) {
+	if r.mode == ModeHost {
+		mapping, err := r.tracker.GetByHostname(hostname)
+		if err != nil {
+			return nil, err
+		}
+		return &Route{Mapping: mapping, Path: path}, nil
+	}
+
+	rest, ok := strings.CutPrefix(path, r.pathPrefix+"/")
+	if !ok {
+		return nil, fmt.Errorf("%w: path %q is not below %s", upstream.ErrNotFound, path, r.pathPrefix)
+	}
+
+	workspaceName, rest, _ := strings.Cut(rest, "/")
+	portSegment, rest, hasSlash := strings.Cut(rest, "/")
+	port, err := strconv.ParseInt(portSegment, 10, 32)
+	if workspaceName == "" || err != nil {
+		return nil, fmt.Errorf("%w: path %q does not name a workspace and port", upstream.ErrNotFound, path)
+	}
+
+	mapping, err := r.tracker.GetByWorkspaceNameAndPort(workspaceName, int32(port))
+	if err != nil {
+		return nil, err
+	}
+
+	// The prefix names the port the way it is exposed, e.g. "03000" and "3000"
+	// share cookies and links
+	workspacePrefix := r.pathPrefix + "/" + workspaceName
+	return &Route{
+		Mapping:              mapping,
+		Prefix:               workspacePrefix + "/" + strconv.Itoa(int(port)),
+		WorkspacePrefix:      workspacePrefix,
+		Path:                 "/" + rest,
+		MissingTrailingSlash: !hasSlash,
+	}, nil
+}
+
+// ResolveRequest resolves the route of a request from the host and path the
+// client asked for.
+func (r *Resolver) ResolveRequest(req *http.Request) (*Route, error) {
+	return r.Resolve(clientinfo.FromRequest(req).Hostname(), req.URL.Path)
+}
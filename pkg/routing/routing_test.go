@@ -0,0 +1,119 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestResolve(t *testing.T) {
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace1.workspaces.com", WorkspaceName: "workspace1", BackendPort: 3000})
+	tracker.Add(upstream.HostMapping{Hostname: "8080-workspace1.workspaces.com", WorkspaceName: "workspace1", BackendPort: 8080})
+
+	tt := []struct {
+		description      string
+		mode             Mode
+		hostname         string
+		path             string
+		expectedError    bool
+		expectedHostname string
+		expectedRoute    Route
+	}{
+		{
+			description:      "When routing by host returns the mapping of the hostname",
+			mode:             ModeHost,
+			hostname:         "8080-workspace1.workspaces.com",
+			path:             "/w/workspace1/3000/index.html",
+			expectedHostname: "8080-workspace1.workspaces.com",
+			expectedRoute:    Route{Path: "/w/workspace1/3000/index.html"},
+		},
+		{
+			description:   "When routing by host and the hostname is unknown throws error",
+			mode:          ModeHost,
+			hostname:      "workspaces.com",
+			path:          "/",
+			expectedError: true,
+		},
+		{
+			description:      "When routing by path returns the mapping of the workspace port",
+			mode:             ModePath,
+			hostname:         "workspaces.com",
+			path:             "/w/workspace1/3000/static/app.js",
+			expectedHostname: "3000-workspace1.workspaces.com",
+			expectedRoute: Route{
+				Prefix:          "/w/workspace1/3000",
+				WorkspacePrefix: "/w/workspace1",
+				Path:            "/static/app.js",
+			},
+		},
+		{
+			description:      "When routing by path and the path stops at the port flags the missing slash",
+			mode:             ModePath,
+			hostname:         "workspaces.com",
+			path:             "/w/workspace1/8080",
+			expectedHostname: "8080-workspace1.workspaces.com",
+			expectedRoute: Route{
+				Prefix:               "/w/workspace1/8080",
+				WorkspacePrefix:      "/w/workspace1",
+				Path:                 "/",
+				MissingTrailingSlash: true,
+			},
+		},
+		{
+			description:      "When routing by path and the port has leading zeros normalises the prefix",
+			mode:             ModePath,
+			hostname:         "workspaces.com",
+			path:             "/w/workspace1/03000/",
+			expectedHostname: "3000-workspace1.workspaces.com",
+			expectedRoute: Route{
+				Prefix:          "/w/workspace1/3000",
+				WorkspacePrefix: "/w/workspace1",
+				Path:            "/",
+			},
+		},
+		{
+			description:   "When routing by path and the port is not exposed throws error",
+			mode:          ModePath,
+			hostname:      "workspaces.com",
+			path:          "/w/workspace1/9000/",
+			expectedError: true,
+		},
+		{
+			description:   "When routing by path and the port is not a number throws error",
+			mode:          ModePath,
+			hostname:      "workspaces.com",
+			path:          "/w/workspace1/web/",
+			expectedError: true,
+		},
+		{
+			description:   "When routing by path and the path is outside of the prefix throws error",
+			mode:          ModePath,
+			hostname:      "workspaces.com",
+			path:          "/workspace1/3000/",
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			route, err := NewResolver(tr.mode, "/w/", tracker).Resolve(tr.hostname, tr.path)
+			if tr.expectedError {
+				require.ErrorIs(t, err, upstream.ErrNotFound)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedHostname, route.Mapping.Hostname)
+			route.Mapping = nil
+			require.Equal(t, tr.expectedRoute, *route)
+		})
+	}
+}
+
+func TestCookiePath(t *testing.T) {
+	require.Equal(t, "/", (&Route{}).CookiePath())
+	require.Equal(t, "/w/workspace1/", (&Route{WorkspacePrefix: "/w/workspace1"}).CookiePath())
+}
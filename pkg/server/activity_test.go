@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestServerRecordsActivity(t *testing.T) {
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello World"))
+	}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{
+		Hostname:        "workspace1.workspaces.com",
+		BackendPort:     int32(port),
+		Backend:         u.Hostname(),
+		BackendProtocol: "http",
+		WorkspaceName:   "workspace1",
+	})
+
+	activityTracker := activity.NewTracker()
+	s := New(&Options{Logger: logger, Tracker: tracker, Activity: activityTracker})
+
+	// The starting page polling for the backend is not user activity
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com"+workspaceStatusPath, nil))
+	_, ok := activityTracker.Get("workspace1")
+	require.False(t, ok)
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	_, ok = activityTracker.Get("workspace1")
+	require.True(t, ok)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/proxyproto"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+const metricsNamespace = "gitlab_workspaces_proxy"
+
+type metrics struct {
+	workspaces       *cardinality.Limiter
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	activeWebsockets *prometheus.GaugeVec
+	upstreamErrors   *prometheus.CounterVec
+	proxyProtocol    *prometheus.CounterVec
+}
+
+// newMetrics creates the HTTP proxy metrics. When registerer is nil the
+// collectors are created but not registered, which keeps tests independent.
+// Workspace label values are capped by the limiter.
+func newMetrics(registerer prometheus.Registerer, workspaces *cardinality.Limiter, tracker *upstream.Tracker) *metrics {
+	factory := promauto.With(registerer)
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "host_mappings",
+		Help:      "Number of workspace host mappings known to the proxy.",
+	}, func() float64 {
+		return float64(tracker.Len())
+	})
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "host_mapping_conflicts",
+		Help:      "Number of workspace host mappings not routed because another workspace claimed their hostname first.",
+	}, func() float64 {
+		return float64(len(tracker.Conflicts()))
+	})
+
+	readinessLabels := map[upstream.Readiness]string{
+		upstream.ReadinessUnknown:  "unknown",
+		upstream.ReadinessReady:    "ready",
+		upstream.ReadinessNotReady: "not_ready",
+	}
+	for readiness, label := range readinessLabels {
+		readiness := readiness
+		factory.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "host_mappings_by_readiness",
+			Help:        "Number of workspace host mappings, by readiness of the pods serving them.",
+			ConstLabels: prometheus.Labels{"readiness": label},
+		}, func() float64 {
+			return float64(tracker.CountByReadiness()[readiness])
+		})
+	}
+
+	if registerer != nil {
+		registerer.MustRegister(newClusterCollector(tracker))
+	}
+
+	m := &metrics{
+		workspaces: workspaces,
+		requests: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of requests proxied to workspaces, by cluster, workspace, port and status class.",
+		}, []string{"cluster", "workspace", "port", "status_class"}),
+		requestDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to proxy requests to workspaces, by cluster, workspace, port and status class.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"cluster", "workspace", "port", "status_class"}),
+		activeWebsockets: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_connections_active",
+			Help:      "Number of open websocket connections, by cluster and workspace.",
+		}, []string{"cluster", "workspace"}),
+		upstreamErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_errors_total",
+			Help:      "Number of requests that failed to reach a workspace upstream, by cluster, workspace and error kind.",
+		}, []string{"cluster", "workspace", "kind"}),
+		proxyProtocol: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "proxy_protocol_connections_total",
+			Help:      "Number of connections accepted with PROXY protocol enabled, by listener and where the client address came from.",
+		}, []string{"listener", "result"}),
+	}
+
+	// Series of a workspace would otherwise be exported until restart
+	workspaces.OnForget(m.forget)
+
+	return m
+}
+
+// forget deletes the series of a workspace which is not reported anymore.
+func (m *metrics) forget(workspaceName string) {
+	labels := prometheus.Labels{"workspace": workspaceName}
+	m.requests.DeletePartialMatch(labels)
+	m.requestDuration.DeletePartialMatch(labels)
+	m.activeWebsockets.DeletePartialMatch(labels)
+	m.upstreamErrors.DeletePartialMatch(labels)
+}
+
+// clusterCollector exposes the number of host mappings per cluster. Clusters
+// are only known from the mappings, so the gauges are built on collection.
+type clusterCollector struct {
+	tracker *upstream.Tracker
+	desc    *prometheus.Desc
+}
+
+func newClusterCollector(tracker *upstream.Tracker) prometheus.Collector {
+	return &clusterCollector{
+		tracker: tracker,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "host_mappings_by_cluster"),
+			"Number of workspace host mappings, by cluster the workspace was discovered in.",
+			[]string{"cluster"},
+			nil,
+		),
+	}
+}
+
+func (c *clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	for cluster, count := range c.tracker.CountByCluster() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), cluster)
+	}
+}
+
+func (m *metrics) workspace(name string) string {
+	return m.workspaces.Value(name)
+}
+
+// observeProxyProtocol counts how the client address of the connections of a
+// listener was determined.
+func (m *metrics) observeProxyProtocol(listener string) func(proxyproto.Result) {
+	return func(result proxyproto.Result) {
+		m.proxyProtocol.WithLabelValues(listener, string(result)).Inc()
+	}
+}
+
+func (m *metrics) observeRequest(mapping *upstream.HostMapping, status int, duration time.Duration) {
+	labels := prometheus.Labels{
+		"cluster":      mapping.Cluster,
+		"workspace":    m.workspace(mapping.WorkspaceName),
+		"port":         strconv.Itoa(int(mapping.BackendPort)),
+		"status_class": statusClass(status),
+	}
+	m.requests.With(labels).Inc()
+	m.requestDuration.With(labels).Observe(duration.Seconds())
+}
+
+// trackWebsocket counts the connection as an active websocket and registers it
+// as a session of the workspace until it is closed. Terminating the session
+// closes the backend connection, which makes the reverse proxy close the
+// client connection as well.
+func (s *Server) trackWebsocket(mapping *upstream.HostMapping, remoteAddr string, conn io.ReadWriteCloser) io.ReadWriteCloser {
+	gauge := s.metrics.activeWebsockets.WithLabelValues(mapping.Cluster, s.metrics.workspace(mapping.WorkspaceName))
+	gauge.Inc()
+
+	tracked := &websocketConn{ReadWriteCloser: conn}
+	deregister := s.sessions.Register(sessions.KindWebsocket, mapping.WorkspaceName, remoteAddr, tracked)
+	tracked.onClose = func() {
+		gauge.Dec()
+		deregister()
+	}
+	return tracked
+}
+
+type websocketConn struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (c *websocketConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+// statusClass groups status codes, e.g. 404 into "4xx".
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// statusRecorder captures the status code written by the reverse proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to hijack it
+// for websockets.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
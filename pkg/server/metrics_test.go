@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestStatusClass(t *testing.T) {
+	tt := []struct {
+		status   int
+		expected string
+	}{
+		{status: http.StatusSwitchingProtocols, expected: "1xx"},
+		{status: http.StatusOK, expected: "2xx"},
+		{status: http.StatusPermanentRedirect, expected: "3xx"},
+		{status: http.StatusNotFound, expected: "4xx"},
+		{status: http.StatusBadGateway, expected: "5xx"},
+		{status: 0, expected: "unknown"},
+	}
+
+	for _, tr := range tt {
+		t.Run(strconv.Itoa(tr.status), func(t *testing.T) {
+			require.Equal(t, tr.expected, statusClass(tr.status))
+		})
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("Hello World"))
+	}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	for _, name := range []string{"workspace1", "workspace2"} {
+		tracker.Add(upstream.HostMapping{
+			Hostname:        name + ".workspaces.com",
+			BackendPort:     int32(port),
+			Backend:         u.Hostname(),
+			BackendProtocol: "http",
+			WorkspaceName:   name,
+			Cluster:         "cluster1",
+		})
+	}
+
+	registry := prometheus.NewRegistry()
+	s := New(&Options{
+		Logger:                logger,
+		Tracker:               tracker,
+		MetricsRegisterer:     registry,
+		WorkspaceLabelLimiter: cardinality.NewLimiter(1),
+	})
+
+	for _, target := range []string{
+		"http://workspace1.workspaces.com/",
+		"http://workspace1.workspaces.com/missing",
+		"http://workspace2.workspaces.com/",
+	} {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	portLabel := strconv.Itoa(port)
+	expected := `
+# HELP gitlab_workspaces_proxy_host_mappings Number of workspace host mappings known to the proxy.
+# TYPE gitlab_workspaces_proxy_host_mappings gauge
+gitlab_workspaces_proxy_host_mappings 2
+# HELP gitlab_workspaces_proxy_host_mappings_by_cluster Number of workspace host mappings, by cluster the workspace was discovered in.
+# TYPE gitlab_workspaces_proxy_host_mappings_by_cluster gauge
+gitlab_workspaces_proxy_host_mappings_by_cluster{cluster="cluster1"} 2
+# HELP gitlab_workspaces_proxy_http_requests_total Number of requests proxied to workspaces, by cluster, workspace, port and status class.
+# TYPE gitlab_workspaces_proxy_http_requests_total counter
+gitlab_workspaces_proxy_http_requests_total{cluster="cluster1",port="` + portLabel + `",status_class="2xx",workspace="other"} 1
+gitlab_workspaces_proxy_http_requests_total{cluster="cluster1",port="` + portLabel + `",status_class="2xx",workspace="workspace1"} 1
+gitlab_workspaces_proxy_http_requests_total{cluster="cluster1",port="` + portLabel + `",status_class="4xx",workspace="workspace1"} 1
+`
+	require.Nil(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"gitlab_workspaces_proxy_host_mappings", "gitlab_workspaces_proxy_host_mappings_by_cluster", "gitlab_workspaces_proxy_http_requests_total"))
+}
+
+func TestServerMetricsForgetWorkspaces(t *testing.T) {
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	limiter := cardinality.NewLimiter(2)
+	s := New(&Options{
+		Logger:                logger,
+		Tracker:               tracker,
+		WorkspaceLabelLimiter: limiter,
+	})
+
+	// Workspaces come and go, the series of removed ones must not pile up
+	for i := 0; i < 10; i++ {
+		name := "workspace" + strconv.Itoa(i)
+		mapping := upstream.HostMapping{
+			Hostname:        name + ".workspaces.com",
+			BackendPort:     int32(port),
+			Backend:         u.Hostname(),
+			BackendProtocol: "http",
+			WorkspaceName:   name,
+		}
+		tracker.Add(mapping)
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://"+mapping.Hostname+"/", nil))
+		require.Nil(t, s.trackWebsocket(&mapping, "192.0.2.1", nopReadWriteCloser{}).Close())
+		tracker.DeleteByHostname(mapping.Hostname)
+		limiter.Forget(name)
+	}
+
+	require.Equal(t, 0, testutil.CollectAndCount(s.metrics.requests))
+	require.Equal(t, 0, testutil.CollectAndCount(s.metrics.requestDuration))
+	require.Equal(t, 0, testutil.CollectAndCount(s.metrics.activeWebsockets))
+}
+
+func TestTrackWebsocket(t *testing.T) {
+	s := New(&Options{Logger: zaptest.NewLogger(t), Tracker: upstream.NewTracker(zaptest.NewLogger(t))})
+
+	conn := s.trackWebsocket(&upstream.HostMapping{Cluster: "cluster1", WorkspaceName: "workspace1"}, "192.0.2.1", nopReadWriteCloser{})
+	gauge := s.metrics.activeWebsockets.WithLabelValues("cluster1", "workspace1")
+	require.Equal(t, float64(1), testutil.ToFloat64(gauge))
+	require.Len(t, s.sessions.List("workspace1"), 1)
+
+	require.Nil(t, conn.Close())
+	require.Nil(t, conn.Close())
+	require.Equal(t, float64(0), testutil.ToFloat64(gauge))
+	require.Empty(t, s.sessions.List("workspace1"))
+}
+
+type nopReadWriteCloser struct{}
+
+func (nopReadWriteCloser) Read([]byte) (int, error)    { return 0, nil }
+func (nopReadWriteCloser) Write(b []byte) (int, error) { return len(b), nil }
+func (nopReadWriteCloser) Close() error                { return nil }
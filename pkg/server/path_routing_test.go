@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func newPathRoutingServer(t *testing.T, backend http.Handler) (*httptest.Server, int) {
+	t.Helper()
+
+	upstreamSrv := httptest.NewServer(backend)
+	t.Cleanup(upstreamSrv.Close)
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{
+		Hostname:        fmt.Sprintf("%d-workspace1.workspaces.com", port),
+		BackendPort:     int32(port),
+		Backend:         u.Hostname(),
+		BackendProtocol: "http",
+		WorkspaceName:   "workspace1",
+	})
+
+	s := New(&Options{
+		HTTPConfig: config.HTTP{
+			Routing: config.Routing{Mode: routing.ModePath, PathPrefix: "/w"},
+		},
+		Logger:  logger,
+		Tracker: tracker,
+	})
+	proxySrv := httptest.NewServer(s)
+	t.Cleanup(proxySrv.Close)
+
+	return proxySrv, port
+}
+
+func TestServerRoutesByPath(t *testing.T) {
+	proxySrv, port := newPathRoutingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		default:
+			_, _ = fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("X-Forwarded-Prefix"))
+		}
+	}))
+	prefix := fmt.Sprintf("/w/workspace1/%d", port)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tt := []struct {
+		description        string
+		path               string
+		expectedStatusCode int
+		expectedBody       string
+		expectedLocation   string
+		expectedCookiePath string
+	}{
+		{
+			description:        "When the path targets a workspace port strips the prefix",
+			path:               prefix + "/static/app.js",
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "/static/app.js " + prefix,
+		},
+		{
+			description:        "When the path stops at the port redirects to the trailing slash",
+			path:               prefix + "?folder=/projects",
+			expectedStatusCode: http.StatusPermanentRedirect,
+			expectedLocation:   prefix + "/?folder=/projects",
+		},
+		{
+			description:        "When the backend redirects rewrites the location and cookie path",
+			path:               prefix + "/login",
+			expectedStatusCode: http.StatusFound,
+			expectedLocation:   prefix + "/home",
+			expectedCookiePath: prefix + "/",
+		},
+		{
+			description:        "When the workspace port is not exposed returns 404",
+			path:               "/w/workspace1/1/",
+			expectedStatusCode: http.StatusNotFound,
+			expectedBody:       "Workspace not found",
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			res, err := client.Get(proxySrv.URL + tr.path)
+			require.Nil(t, err)
+			defer func() { _ = res.Body.Close() }()
+
+			body, err := io.ReadAll(res.Body)
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedStatusCode, res.StatusCode)
+			if tr.expectedBody != "" {
+				require.Equal(t, tr.expectedBody, string(body))
+			}
+			require.Equal(t, tr.expectedLocation, res.Header.Get("Location"))
+			if tr.expectedCookiePath != "" {
+				require.Len(t, res.Cookies(), 1)
+				require.Equal(t, tr.expectedCookiePath, res.Cookies()[0].Path)
+			}
+		})
+	}
+}
+
+func TestServerRoutesWebsocketsByPath(t *testing.T) {
+	proxySrv, port := newPathRoutingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" || r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		// Echo a single line back to the client
+		line, _ := rw.ReadString('\n')
+		_, _ = rw.WriteString(line)
+		_ = rw.Flush()
+	}))
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	require.Nil(t, err)
+	defer func() { _ = conn.Close() }()
+	require.Nil(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = fmt.Fprintf(conn, "GET /w/workspace1/%d/ws HTTP/1.1\r\nHost: workspaces.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", port)
+	require.Nil(t, err)
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.Nil(t, err)
+	line, err := reader.ReadString('\n')
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", line)
+}
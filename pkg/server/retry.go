@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"go.uber.org/zap"
+)
+
+// retryTransport retries idempotent requests whose connection was refused by
+// the upstream. This happens while a workspace pod is restarting and the
+// service already exists but nothing is listening yet. No bytes have reached
+// the backend in that case, so retrying is always safe.
+type retryTransport struct {
+	next   http.RoundTripper
+	config config.UpstreamRetry
+	logger *zap.Logger
+}
+
+func newRetryTransport(next http.RoundTripper, cfg config.UpstreamRetry, logger *zap.Logger) *retryTransport {
+	return &retryTransport{
+		next:   next,
+		config: cfg,
+		logger: logger,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryableRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	backoff := t.config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := t.next.RoundTrip(req)
+		if err == nil || attempt >= t.config.MaxAttempts || classifyUpstreamError(err) != upstreamErrorConnectionRefused {
+			return res, err
+		}
+
+		requestid.Logger(t.logger, req).Debug("upstream refused connection, retrying request",
+			logz.Error(err),
+			logz.HTTPHost(req.URL.Host),
+			logz.HTTPPath(req.URL.Path),
+			logz.UpstreamAttempt(attempt),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			// The client went away, the refused connection is not the upstream's fault
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		backoff = min(backoff*2, t.config.MaxBackoff)
+	}
+}
+
+func isRetryableRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody
+}
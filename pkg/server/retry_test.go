@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tt := []struct {
+		description    string
+		method         string
+		body           io.Reader
+		maxAttempts    int
+		expectedError  bool
+		expectedStatus int
+	}{
+		{
+			description:    "When an idempotent request is refused, retries until the upstream is up",
+			method:         http.MethodGet,
+			maxAttempts:    20,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:   "When the retries are exhausted, returns the error",
+			method:        http.MethodGet,
+			maxAttempts:   1,
+			expectedError: true,
+		},
+		{
+			description:   "When the request is not idempotent, does not retry",
+			method:        http.MethodPost,
+			body:          strings.NewReader("data"),
+			maxAttempts:   20,
+			expectedError: true,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			// Reserve a port and only start listening on it after a few refused
+			// attempts, the same way a restarting workspace pod refuses connections
+			// until it is ready
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.Nil(t, err)
+			addr := listener.Addr().String()
+			require.Nil(t, listener.Close())
+
+			srv := &http.Server{
+				Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				ReadHeaderTimeout: time.Second,
+			}
+			defer func() { _ = srv.Close() }()
+			upstream := &startingUpstream{
+				next:        http.DefaultTransport,
+				startsAfter: 2,
+				start: func() {
+					delayedListener, listenErr := net.Listen("tcp", addr)
+					require.Nil(t, listenErr)
+					go func() { _ = srv.Serve(delayedListener) }()
+				},
+			}
+
+			transport := newRetryTransport(upstream, config.UpstreamRetry{
+				MaxAttempts:    tr.maxAttempts,
+				InitialBackoff: 50 * time.Millisecond,
+				MaxBackoff:     50 * time.Millisecond,
+			}, zaptest.NewLogger(t))
+
+			req, err := http.NewRequest(tr.method, fmt.Sprintf("http://%s", addr), tr.body)
+			require.Nil(t, err)
+
+			res, err := transport.RoundTrip(req)
+			if tr.expectedError {
+				require.Error(t, err)
+				require.Equal(t, upstreamErrorConnectionRefused, classifyUpstreamError(err))
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedStatus, res.StatusCode)
+			require.Nil(t, res.Body.Close())
+		})
+	}
+}
+
+func TestRetryTransportCanceledDuringBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := listener.Addr().String()
+	require.Nil(t, listener.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client goes away after the first refused attempt, while waiting to retry
+	upstream := &startingUpstream{
+		next:        http.DefaultTransport,
+		startsAfter: 1,
+		start:       cancel,
+	}
+	transport := newRetryTransport(upstream, config.UpstreamRetry{
+		MaxAttempts:    4,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+	}, zaptest.NewLogger(t))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s", addr), nil)
+	require.Nil(t, err)
+
+	_, err = transport.RoundTrip(req)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, upstreamErrorCanceled, classifyUpstreamError(err))
+	require.Equal(t, 1, upstream.attempts)
+}
+
+// startingUpstream starts the upstream once the given number of attempts were
+// made, so the test does not depend on timing.
+type startingUpstream struct {
+	next        http.RoundTripper
+	attempts    int
+	startsAfter int
+	start       func()
+}
+
+func (u *startingUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := u.next.RoundTrip(req)
+	u.attempts++
+	if u.attempts == u.startsAfter {
+		u.start()
+	}
+	return res, err
+}
+
+func TestRetrySameEndpoint(t *testing.T) {
+	// Neither endpoint accepts connections, so every attempt is retried
+	var endpoints []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		endpoints = append(endpoints, listener.Addr().String())
+		require.Nil(t, listener.Close())
+	}
+
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	tracker.Add(upstream.HostMapping{
+		Hostname:        "workspace1.workspaces.com",
+		BackendProtocol: "http",
+		WorkspaceName:   "workspace1",
+		Endpoints:       endpoints,
+	})
+
+	core, logs := observer.New(zap.DebugLevel)
+	s := New(&Options{
+		HTTPConfig: config.HTTP{UpstreamRetry: config.UpstreamRetry{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		}},
+		Logger:  zap.New(core),
+		Tracker: tracker,
+	})
+
+	// The endpoint is picked once per request, retries do not switch pods
+	for i := 0; i < 10; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com/", nil))
+
+		retries := logs.FilterMessage("upstream refused connection, retrying request").AllUntimed()
+		require.Len(t, retries, 2)
+		hosts := make(map[string]bool)
+		for _, entry := range retries {
+			hosts[entry.ContextMap()["http_host"].(string)] = true
+		}
+		require.Len(t, hosts, 1)
+		logs.TakeAll()
+	}
+}
@@ -2,66 +2,241 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"strings"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/admin"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/cardinality"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/discovery"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/logging"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/proxyproto"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sshproxy"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/tracing"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
+const adminReadHeaderTimeout = 10 * time.Second
+
 type Server struct {
-	opts *Options
+	opts       *Options
+	transports *transports
+	bufferPool httputil.BufferPool
+	metrics    *metrics
+	resolver   *routing.Resolver
+	activity   *activity.Tracker
+	sessions   *sessions.Registry
 }
 
 type Options struct {
-	HTTPConfig        config.HTTP
-	SSHConfig         config.SSH
-	LoggingMiddleware func(http.Handler) http.Handler
-	AuthMiddleware    func(http.Handler) http.Handler
-	Logger            *zap.Logger
-	Tracker           *upstream.Tracker
-	MetricsPath       string
-	APIFactory        gitlab.APIFactory
+	HTTPConfig config.HTTP
+	SSHConfig  config.SSH
+	// ClientInfoMiddleware trusts no forwarded headers when nil
+	ClientInfoMiddleware func(http.Handler) http.Handler
+	// RequestIDMiddleware trusts no incoming request IDs when nil
+	RequestIDMiddleware func(http.Handler) http.Handler
+	LoggingMiddleware   func(http.Handler) http.Handler
+	AuthMiddleware      func(http.Handler) http.Handler
+	Logger              *zap.Logger
+	Tracker             *upstream.Tracker
+	MetricsPath         string
+	MetricsRegisterer   prometheus.Registerer
+	// WorkspaceLabelLimiter caps the workspace label of the proxy metrics, nil disables the cap
+	WorkspaceLabelLimiter *cardinality.Limiter
+	APIFactory            gitlab.APIFactory
+	AdminConfig           config.Admin
+	// Activity records workspace traffic, a private tracker is used when nil
+	Activity *activity.Tracker
+	// Sessions tracks SSH connections and websockets, a private registry is used when nil
+	Sessions *sessions.Registry
+	// BackendRootCAs verifies https backends which do not bring their own CA, nil uses the system roots
+	BackendRootCAs *x509.CertPool
+	// EventRecorder reports denied SSH access on workspace services, nil records no events
+	EventRecorder discovery.EventRecorder
 }
 
 func New(opts *Options) *Server {
+	activityTracker := opts.Activity
+	if activityTracker == nil {
+		activityTracker = activity.NewTracker()
+	}
+
+	sessionRegistry := opts.Sessions
+	if sessionRegistry == nil {
+		sessionRegistry = sessions.NewRegistry()
+	}
+
 	return &Server{
 		opts: opts,
+		transports: newTransports(opts.BackendRootCAs, func(next http.RoundTripper) http.RoundTripper {
+			// Every attempt gets its own client span and traceparent header
+			return newRetryTransport(tracing.NewTransport(next), opts.HTTPConfig.UpstreamRetry, opts.Logger)
+		}),
+		bufferPool: newBufferPool(),
+		metrics:    newMetrics(opts.MetricsRegisterer, opts.WorkspaceLabelLimiter, opts.Tracker),
+		resolver:   routing.NewResolver(opts.HTTPConfig.Routing.Mode, opts.HTTPConfig.Routing.PathPrefix, opts.Tracker),
+		activity:   activityTracker,
+		sessions:   sessionRegistry,
 	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	requestHostName := strings.Split(r.Host, ":")[0]
-	workspaceHostMapping, err := s.opts.Tracker.GetByHostname(requestHostName)
+	route, err := s.resolver.ResolveRequest(r)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
 		// TODO: Add proper error pages when workspace not found
 		// https://gitlab.com/gitlab-org/gitlab/-/issues/407870
-		_, _ = w.Write([]byte("Workspace not found"))
+		writeError(w, r, http.StatusNotFound, "Workspace not found")
 		return
 	}
 
-	targetURL, err := url.Parse(fmt.Sprintf("%s://%s:%d", workspaceHostMapping.BackendProtocol, workspaceHostMapping.Backend, workspaceHostMapping.BackendPort))
+	if route.MissingTrailingSlash {
+		http.Redirect(w, r, route.TrailingSlashRedirect(r), http.StatusPermanentRedirect)
+		return
+	}
+
+	workspaceHostMapping := route.Mapping
+	logger := requestid.Logger(s.opts.Logger, r)
+
+	ctx, span := tracing.Start(r.Context(), "server.ServeHTTP", trace.WithAttributes(
+		attribute.String("workspace.name", workspaceHostMapping.WorkspaceName),
+		attribute.Int("workspace.port", int(workspaceHostMapping.BackendPort)),
+	))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	// Picked once, see backendURL
+	targetURL, err := backendURL(workspaceHostMapping)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		s.opts.Logger.Info("failed to parse workspace url",
+		writeError(w, r, http.StatusInternalServerError, "Workspace unavailable")
+		logger.Info("failed to parse workspace url",
 			logz.Error(err),
-			logz.WorkspaceURL(targetURL.String()),
+			logz.HostMappingBackend(workspaceHostMapping.Backend),
+			logz.HostMappingBackendPort(workspaceHostMapping.BackendPort),
 		)
 		return
 	}
 
+	details := logging.DetailsFromRequest(r)
+	details.WorkspaceName = workspaceHostMapping.WorkspaceName
+	details.WorkspaceID = workspaceHostMapping.WorkspaceID
+	details.Upstream = targetURL.Host
+
+	if route.Path == workspaceStatusPath {
+		s.serveWorkspaceStatus(w, r, workspaceHostMapping, targetURL.Host)
+		return
+	}
+
+	if workspaceHostMapping.Readiness == upstream.ReadinessNotReady {
+		// No pod serves the port, dialing the backend would only fail
+		s.serveWorkspaceStarting(w, r, route.Prefix+workspaceStatusPath)
+		return
+	}
+
+	s.activity.Touch(workspaceHostMapping.WorkspaceName)
+
+	transport, err := s.transports.forMapping(workspaceHostMapping)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, "Workspace unavailable")
+		logger.Error("failed to configure transport for workspace upstream",
+			logz.Error(err),
+			logz.WorkspaceName(workspaceHostMapping.WorkspaceName),
+			logz.HostMappingBackendProtocol(workspaceHostMapping.BackendProtocol),
+		)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	upgraded := false
+	start := time.Now()
+	defer func() {
+		status := recorder.status
+		if upgraded {
+			status = http.StatusSwitchingProtocols
+		}
+		s.metrics.observeRequest(workspaceHostMapping, status, time.Since(start))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}()
+
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	proxy.ServeHTTP(w, r)
+	proxy.Transport = transport
+	proxy.BufferPool = s.bufferPool
+	proxy.ErrorHandler = s.upstreamErrorHandler(route)
+	if workspaceHostMapping.Streaming || workspaceHostMapping.BackendProtocol == upstream.ProtocolGRPC {
+		// A negative interval flushes after every write
+		proxy.FlushInterval = -1
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		route.RewriteResponse(res, targetURL.Host)
+		if body, ok := res.Body.(io.ReadWriteCloser); ok && res.StatusCode == http.StatusSwitchingProtocols {
+			upgraded = true
+			// Websocket frames count as activity for as long as the connection is open
+			res.Body = s.trackWebsocket(workspaceHostMapping, clientinfo.FromRequest(r).IP, s.activity.ReadWriteCloser(workspaceHostMapping.WorkspaceName, body))
+		}
+		if workspaceHostMapping.Streaming || isStreamingResponse(res) {
+			disableIngressBuffering(res)
+		}
+		return nil
+	}
+	proxy.ServeHTTP(recorder, route.StripPrefix(r))
+}
+
+// writeError writes a plain text error which quotes the request ID, so that
+// users can refer to it when reporting a problem.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if id := requestid.FromContext(r.Context()); id != "" {
+		message += "\nRequest ID: " + id
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(message))
+}
+
+// handler builds the handler for the HTTP listener. It accepts HTTP/2 over
+// cleartext next to HTTP/1.1 so that gRPC can be proxied end to end behind an
+// ingress which talks h2c to the proxy.
+func (s *Server) handler() http.Handler {
+	clientInfoMiddleware := s.opts.ClientInfoMiddleware
+	if clientInfoMiddleware == nil {
+		clientInfoMiddleware = clientinfo.NewMiddleware(nil)
+	}
+	requestIDMiddleware := s.opts.RequestIDMiddleware
+	if requestIDMiddleware == nil {
+		requestIDMiddleware = requestid.NewMiddleware(nil)
+	}
+
+	mainHandler := tracing.NewHandler(clientInfoMiddleware(requestIDMiddleware(s.opts.LoggingMiddleware(s.opts.AuthMiddleware(s)))), "workspaces-proxy")
+
+	mux := http.NewServeMux()
+	mux.Handle(s.opts.MetricsPath, promhttp.Handler())
+	mux.Handle("/", mainHandler)
+
+	return h2c.NewHandler(mux, &http2.Server{})
 }
 
 func (s *Server) Start(ctx context.Context) error {
@@ -80,16 +255,40 @@ func (s *Server) Start(ctx context.Context) error {
 		return nil
 	})
 
+	sub := s.opts.Tracker.Subscribe(upstream.DefaultSubscriptionBuffer)
+	eg.Go(func() error {
+		s.closeRemovedWorkspaceSessions(groupCtx, sub)
+		return nil
+	})
+
+	transportSub := s.opts.Tracker.Subscribe(upstream.DefaultSubscriptionBuffer)
+	eg.Go(func() error {
+		s.pruneTransports(groupCtx, transportSub)
+		return nil
+	})
+
 	if s.opts.HTTPConfig.Enabled {
 		eg.Go(func() error {
 			s.opts.Logger.Info("attempting to start HTTP proxy server", logz.Port(s.opts.HTTPConfig.Port))
-			mainHandler := s.opts.LoggingMiddleware(s.opts.AuthMiddleware(s))
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.opts.HTTPConfig.Port))
+			if err != nil {
+				return err
+			}
 
-			mux := http.NewServeMux()
-			mux.Handle(s.opts.MetricsPath, promhttp.Handler())
-			mux.Handle("/", mainHandler)
+			wrapped, err := proxyproto.Wrap(listener, s.opts.HTTPConfig.ProxyProtocol, s.metrics.observeProxyProtocol("http"))
+			if err != nil {
+				_ = listener.Close()
+				return err
+			}
+			listener = wrapped
 
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", s.opts.HTTPConfig.Port), mux); err != nil {
+			// Forwarded headers are trusted based on the load balancer
+			// which sent the PROXY protocol header, not the client
+			proxyServer := &http.Server{
+				Handler:     s.handler(),
+				ConnContext: clientinfo.ConnContext,
+			}
+			if err = proxyServer.Serve(listener); err != nil {
 				return err
 			}
 			return nil
@@ -100,13 +299,23 @@ func (s *Server) Start(ctx context.Context) error {
 		readyCh := make(chan struct{})
 		eg.Go(func() error {
 			s.opts.Logger.Info("attempting to start SSH proxy server", logz.Port(s.opts.SSHConfig.Port))
-			proxy, err := sshproxy.New(groupCtx, s.opts.Logger, s.opts.Tracker, &s.opts.SSHConfig, s.opts.APIFactory)
+			proxy, err := sshproxy.New(groupCtx, s.opts.Logger, s.opts.Tracker, s.activity, s.sessions, &s.opts.SSHConfig, s.opts.APIFactory, s.opts.EventRecorder)
 			if err != nil {
 				return err
 			}
-			return proxy.Start(groupCtx, fmt.Sprintf("0.0.0.0:%d", s.opts.SSHConfig.Port), readyCh, nil)
+			return proxy.Start(groupCtx, fmt.Sprintf("0.0.0.0:%d", s.opts.SSHConfig.Port), s.metrics.observeProxyProtocol("ssh"), readyCh, nil)
+		})
+		// The SSH proxy does not signal readiness when it fails to start
+		select {
+		case <-readyCh:
+		case <-groupCtx.Done():
+		}
+	}
+
+	if s.opts.AdminConfig.Enabled {
+		eg.Go(func() error {
+			return s.startAdmin(groupCtx)
 		})
-		<-readyCh
 	}
 
 	if !s.opts.HTTPConfig.Enabled && !s.opts.SSHConfig.Enabled {
@@ -115,3 +324,72 @@ func (s *Server) Start(ctx context.Context) error {
 
 	return eg.Wait()
 }
+
+// startAdmin serves the admin API until the context is done.
+func (s *Server) startAdmin(ctx context.Context) error {
+	s.opts.Logger.Info("attempting to start admin API server", logz.Port(s.opts.AdminConfig.Port))
+	addr := net.JoinHostPort(s.opts.AdminConfig.Address, strconv.Itoa(s.opts.AdminConfig.Port))
+	tlsConfig, err := adminTLSConfig(s.opts.AdminConfig.TLS)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr: addr,
+		Handler: admin.NewHandler(&admin.Options{
+			Logger:   s.opts.Logger,
+			Activity: s.activity,
+			Tracker:  s.opts.Tracker,
+			Resolver: s.resolver,
+			Sessions: s.sessions,
+			Token:    s.opts.AdminConfig.Token,
+		}),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		TLSConfig:         tlsConfig,
+	}
+
+	go func() {
+		<-ctx.Done()
+		// nolint:golint,contextcheck
+		if err := srv.Shutdown(context.Background()); err != nil {
+			s.opts.Logger.Error("failed to shut down admin API server", logz.Error(err))
+		}
+	}()
+
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS(s.opts.AdminConfig.TLS.CertFile, s.opts.AdminConfig.TLS.KeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// adminTLSConfig returns nil when the admin API is served over plain HTTP.
+// With a client CA, certificates presented by clients must be signed by it.
+// Clients without one can still authenticate with the token.
+func adminTLSConfig(cfg config.AdminTLS) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	data, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("admin client CA %s contains no certificates", cfg.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
@@ -2,17 +2,23 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/cidr"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
 	"go.uber.org/zap/zaptest"
 )
@@ -51,7 +57,7 @@ func TestStartServer(t *testing.T) {
 			description:        "When no upstream is present returns 404",
 			port:               8111,
 			expectedStatusCode: http.StatusNotFound,
-			expectedBody:       "Workspace not found",
+			expectedBody:       "Workspace not found\nRequest ID: test-request-id",
 			upstreamsToAdd:     []upstream.HostMapping{},
 			upstreamsToRemove:  []string{},
 		},
@@ -74,7 +80,7 @@ func TestStartServer(t *testing.T) {
 			description:        "When an upstream is deleted does not route to upstream",
 			port:               8113,
 			expectedStatusCode: http.StatusNotFound,
-			expectedBody:       "Workspace not found",
+			expectedBody:       "Workspace not found\nRequest ID: test-request-id",
 			upstreamsToAdd: []upstream.HostMapping{
 				{
 					Hostname:        "localhost",
@@ -91,8 +97,26 @@ func TestStartServer(t *testing.T) {
 			},
 			upstreamsToRemove: []string{"localhost"},
 		},
+		{
+			description:        "When the upstream address is invalid returns 500 with the request ID",
+			port:               8114,
+			expectedStatusCode: http.StatusInternalServerError,
+			expectedBody:       "Workspace unavailable\nRequest ID: test-request-id",
+			upstreamsToAdd: []upstream.HostMapping{
+				{
+					Hostname:        "localhost",
+					BackendPort:     int32(port),
+					Backend:         "invalid host",
+					BackendProtocol: "http",
+				},
+			},
+			upstreamsToRemove: []string{},
+		},
 	}
 
+	localhost, err := cidr.Parse([]string{"127.0.0.0/8", "::1/128"})
+	require.Nil(t, err)
+
 	for _, tr := range tt {
 		t.Run(tr.description, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -106,11 +130,12 @@ func TestStartServer(t *testing.T) {
 					Enabled: true,
 					Port:    tr.port,
 				},
-				AuthMiddleware:    emptyAuthHandler,
-				LoggingMiddleware: emptyLoggingHandler,
-				Logger:            logger,
-				Tracker:           tracker,
-				MetricsPath:       "/metrics",
+				RequestIDMiddleware: requestid.NewMiddleware(localhost),
+				AuthMiddleware:      emptyAuthHandler,
+				LoggingMiddleware:   emptyLoggingHandler,
+				Logger:              logger,
+				Tracker:             tracker,
+				MetricsPath:         "/metrics",
 			})
 
 			for _, u := range tr.upstreamsToAdd {
@@ -127,13 +152,17 @@ func TestStartServer(t *testing.T) {
 			}()
 			time.Sleep(2 * time.Second)
 
-			res, err := http.Get(fmt.Sprintf("http://localhost:%d", tr.port))
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", tr.port), nil)
+			require.Nil(t, err)
+			req.Header.Set(requestid.HeaderName, "test-request-id")
+			res, err := http.DefaultClient.Do(req)
 			require.Nil(t, err)
 
 			result, err := io.ReadAll(res.Body)
 			require.Nil(t, err)
 			require.Equal(t, tr.expectedStatusCode, res.StatusCode)
 			require.Equal(t, tr.expectedBody, string(result))
+			require.Equal(t, "test-request-id", res.Header.Get(requestid.HeaderName))
 			closeErr := res.Body.Close()
 			if closeErr != nil {
 				t.Error(closeErr)
@@ -177,3 +206,32 @@ func TestMetricsPath(t *testing.T) {
 		t.Error(closeErr)
 	}
 }
+
+func TestStartReturnsSSHProxyError(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	s := New(&Options{
+		// An invalid host key makes the SSH proxy fail before it is ready
+		SSHConfig: config.SSH{Enabled: true, HostKey: "invalid"},
+		Logger:    logger,
+		Tracker:   upstream.NewTracker(logger),
+	})
+
+	require.Error(t, s.Start(context.Background()))
+}
+
+func TestAdminTLSConfig(t *testing.T) {
+	caSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer caSrv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caSrv.Certificate().Raw}), 0o600))
+
+	tlsConfig, err := adminTLSConfig(config.AdminTLS{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: caFile})
+	require.Nil(t, err)
+	// Clients without a certificate can still authenticate with the token
+	require.Equal(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+	require.NotNil(t, tlsConfig.ClientCAs)
+
+	tlsConfig, err = adminTLSConfig(config.AdminTLS{})
+	require.Nil(t, err)
+	require.Nil(t, tlsConfig)
+}
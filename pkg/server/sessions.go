@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+// closeRemovedWorkspaceSessions terminates the SSH connections and websockets
+// of workspaces which are no longer tracked until the context is done.
+func (s *Server) closeRemovedWorkspaceSessions(ctx context.Context, sub *upstream.Subscription) {
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+
+			switch event.Type {
+			case upstream.EventRemoved:
+				s.terminateIfRemoved(event.Before.WorkspaceName)
+			case upstream.EventResync:
+				for _, session := range s.sessions.List("") {
+					s.terminateIfRemoved(session.WorkspaceName)
+				}
+			}
+		}
+	}
+}
+
+// terminateIfRemoved keeps the sessions of workspaces which still expose other ports.
+func (s *Server) terminateIfRemoved(workspaceName string) {
+	if _, err := s.opts.Tracker.GetWorkspaceByName(workspaceName); err == nil {
+		return
+	}
+
+	if terminated := s.sessions.Terminate(workspaceName); terminated > 0 {
+		s.opts.Logger.Info("closed sessions of removed workspace",
+			logz.WorkspaceName(workspaceName),
+			logz.SessionCount(terminated),
+		)
+	}
+}
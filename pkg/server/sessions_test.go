@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCloseRemovedWorkspaceSessions(t *testing.T) {
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	tracker.Add(upstream.HostMapping{Hostname: "3000-workspace1", WorkspaceName: "workspace1", BackendPort: 3000})
+	tracker.Add(upstream.HostMapping{Hostname: "8080-workspace1", WorkspaceName: "workspace1", BackendPort: 8080})
+	s := New(&Options{Logger: zaptest.NewLogger(t), Tracker: tracker})
+
+	closed := make(chan struct{})
+	s.sessions.Register(sessions.KindSSH, "workspace1", "192.0.2.1:1234", sessions.CloseFunc(func() error {
+		close(closed)
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.closeRemovedWorkspaceSessions(ctx, tracker.Subscribe(0))
+
+	// Sessions are closed once the last port of the workspace is gone
+	tracker.DeleteByHostname("3000-workspace1")
+	tracker.DeleteByHostname("8080-workspace1")
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sessions of the removed workspace were not closed")
+	}
+	require.Empty(t, s.sessions.List("workspace1"))
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+)
+
+const (
+	// workspaceStatusPath is served by the proxy itself on every workspace host so
+	// that the "workspace starting" page can poll for the backend to come up.
+	// The path is reserved, requests to it never reach the workspace backend.
+	workspaceStatusPath = "/-/workspaces-proxy/status"
+
+	workspaceStartingRetryAfter = 5 * time.Second
+	workspaceStatusDialTimeout  = 2 * time.Second
+)
+
+//go:embed templates/workspace_starting.html
+var workspaceStartingHTML string
+
+var workspaceStartingTemplate = template.Must(template.New("workspace_starting").Parse(workspaceStartingHTML)) //nolint:gochecknoglobals
+
+type workspaceStatus struct {
+	Ready bool `json:"ready"`
+}
+
+// serveWorkspaceStarting responds to a request for a workspace whose backend
+// is not serving yet. Browser navigations get a page which polls the status
+// endpoint and reloads once the backend answers, API clients get a 503.
+func (s *Server) serveWorkspaceStarting(w http.ResponseWriter, r *http.Request, statusPath string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(workspaceStartingRetryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !isBrowserNavigation(r) {
+		writeError(w, r, http.StatusServiceUnavailable, "Workspace is starting")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := workspaceStartingTemplate.Execute(w, map[string]interface{}{
+		"StatusPath": statusPath,
+		"RetryAfter": int(workspaceStartingRetryAfter.Seconds()),
+		"RequestID":  requestid.FromContext(r.Context()),
+	})
+	if err != nil {
+		requestid.Logger(s.opts.Logger, r).Error("failed to render workspace starting page", logz.Error(err))
+	}
+}
+
+// serveWorkspaceStatus reports whether the workspace backend accepts
+// connections. A port without ready pods is reported without dialing it.
+func (s *Server) serveWorkspaceStatus(w http.ResponseWriter, r *http.Request, mapping *upstream.HostMapping, backendAddr string) {
+	ctx, cancel := context.WithTimeout(r.Context(), workspaceStatusDialTimeout)
+	defer cancel()
+
+	var status workspaceStatus
+	if mapping.Readiness != upstream.ReadinessNotReady {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", backendAddr)
+		if err == nil {
+			status.Ready = true
+			_ = conn.Close()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func isBrowserNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+
+	// Older browsers do not send fetch metadata, fall back to what they accept
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func isUpstreamNotReady(kind upstreamErrorKind) bool {
+	return kind == upstreamErrorConnectionRefused || kind == upstreamErrorDNS
+}
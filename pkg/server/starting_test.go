@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestIsBrowserNavigation(t *testing.T) {
+	tt := []struct {
+		description    string
+		method         string
+		header         http.Header
+		expectedResult bool
+	}{
+		{
+			description:    "When fetch metadata reports a navigation returns true",
+			method:         http.MethodGet,
+			header:         http.Header{"Sec-Fetch-Mode": []string{"navigate"}},
+			expectedResult: true,
+		},
+		{
+			description:    "When fetch metadata reports a fetch returns false",
+			method:         http.MethodGet,
+			header:         http.Header{"Sec-Fetch-Mode": []string{"cors"}, "Accept": []string{"text/html"}},
+			expectedResult: false,
+		},
+		{
+			description:    "When no fetch metadata is present and html is accepted returns true",
+			method:         http.MethodGet,
+			header:         http.Header{"Accept": []string{"text/html,application/xhtml+xml"}},
+			expectedResult: true,
+		},
+		{
+			description:    "When the request is not a GET returns false",
+			method:         http.MethodPost,
+			header:         http.Header{"Sec-Fetch-Mode": []string{"navigate"}},
+			expectedResult: false,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			request := httptest.NewRequest(tr.method, "http://workspace1.workspaces.com", nil)
+			request.Header = tr.header
+			require.Equal(t, tr.expectedResult, isBrowserNavigation(request))
+		})
+	}
+}
+
+func TestServeWorkspaceStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	readyAddr := listener.Addr().String()
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	notReadyAddr := closedListener.Addr().String()
+	require.Nil(t, closedListener.Close())
+
+	defer func() { _ = listener.Close() }()
+
+	tt := []struct {
+		description   string
+		backendAddr   string
+		readiness     upstream.Readiness
+		expectedReady bool
+	}{
+		{
+			description:   "When the backend accepts connections reports ready",
+			backendAddr:   readyAddr,
+			expectedReady: true,
+		},
+		{
+			description:   "When the backend refuses connections reports not ready",
+			backendAddr:   notReadyAddr,
+			expectedReady: false,
+		},
+		{
+			description:   "When no pod is ready reports not ready without dialing",
+			backendAddr:   readyAddr,
+			readiness:     upstream.ReadinessNotReady,
+			expectedReady: false,
+		},
+	}
+
+	s := New(&Options{Logger: zaptest.NewLogger(t)})
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			s.serveWorkspaceStatus(recorder, httptest.NewRequest(http.MethodGet, workspaceStatusPath, nil), &upstream.HostMapping{Readiness: tr.readiness}, tr.backendAddr)
+
+			var status workspaceStatus
+			require.Nil(t, json.NewDecoder(recorder.Body).Decode(&status))
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.Equal(t, tr.expectedReady, status.Ready)
+		})
+	}
+}
+
+func TestServeHTTPNotReady(t *testing.T) {
+	tracker := upstream.NewTracker(zaptest.NewLogger(t))
+	tracker.Add(upstream.HostMapping{
+		Hostname:      "3000-workspace1.workspaces.com",
+		Backend:       "workspace1.invalid",
+		BackendPort:   3000,
+		WorkspaceName: "workspace1",
+		Readiness:     upstream.ReadinessNotReady,
+	})
+	s := New(&Options{Logger: zaptest.NewLogger(t), Tracker: tracker})
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://3000-workspace1.workspaces.com/", nil))
+
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "Workspace is starting")
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"sync"
+)
+
+const proxyBufferSize = 32 * 1024
+
+// bufferPool shares the buffers used by the reverse proxies to copy response
+// bodies. A proxy is created per request, so without a pool every request
+// would allocate a fresh 32KB buffer.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, proxyBufferSize)
+				return &b
+			},
+		},
+	}
+}
+
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) < proxyBufferSize {
+		return
+	}
+	b = b[:proxyBufferSize]
+	p.pool.Put(&b)
+}
+
+// isStreamingResponse detects responses which have to reach the client as they
+// are produced: server-sent events and chunked responses of unknown length.
+// The reverse proxy already flushes those immediately, but the ingress in front
+// of the proxy buffers them unless told otherwise.
+func isStreamingResponse(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return true
+	}
+
+	if res.ContentLength != -1 {
+		return false
+	}
+
+	for _, encoding := range res.TransferEncoding {
+		if encoding == "chunked" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func disableIngressBuffering(res *http.Response) {
+	res.Header.Set("X-Accel-Buffering", "no")
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/logging"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestIsStreamingResponse(t *testing.T) {
+	tt := []struct {
+		description    string
+		response       *http.Response
+		expectedResult bool
+	}{
+		{
+			description: "When the response is an event stream returns true",
+			response: &http.Response{
+				Header:        http.Header{"Content-Type": []string{"text/event-stream; charset=utf-8"}},
+				ContentLength: 100,
+			},
+			expectedResult: true,
+		},
+		{
+			description: "When the response is chunked with unknown length returns true",
+			response: &http.Response{
+				Header:           http.Header{"Content-Type": []string{"text/plain"}},
+				ContentLength:    -1,
+				TransferEncoding: []string{"chunked"},
+			},
+			expectedResult: true,
+		},
+		{
+			description: "When the response has a known length returns false",
+			response: &http.Response{
+				Header:        http.Header{"Content-Type": []string{"text/html"}},
+				ContentLength: 100,
+			},
+			expectedResult: false,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			require.Equal(t, tr.expectedResult, isStreamingResponse(tr.response))
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := newBufferPool()
+
+	b := pool.Get()
+	require.Len(t, b, proxyBufferSize)
+	pool.Put(b[:10])
+	require.Len(t, pool.Get(), proxyBufferSize)
+}
+
+func TestServerStreamsEvents(t *testing.T) {
+	done := make(chan struct{})
+
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: hello\n\n"))
+		w.(http.Flusher).Flush()
+		// Keep the stream open, the event must reach the client before the response ends
+		<-done
+	}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{
+		Hostname:        "127.0.0.1",
+		BackendPort:     int32(port),
+		Backend:         u.Hostname(),
+		BackendProtocol: "http",
+	})
+
+	s := New(&Options{Logger: logger, Tracker: tracker})
+	loggingMiddleware, err := logging.NewMiddleware(logger, logging.AccessLogConfig{Format: logging.FormatJSON}, nil, io.Discard)
+	require.Nil(t, err)
+	proxySrv := httptest.NewServer(loggingMiddleware(s))
+	defer proxySrv.Close()
+	// The servers wait for the open stream on close, so it has to end first
+	defer close(done)
+
+	res, err := http.Get(proxySrv.URL)
+	require.Nil(t, err)
+	defer func() { _ = res.Body.Close() }()
+	require.Equal(t, "no", res.Header.Get("X-Accel-Buffering"))
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		require.Equal(t, "data: hello\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not flushed to the client")
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/clientinfo"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestServerPropagatesTraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	traceparents := make(chan string, 1)
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+	}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{
+		Hostname:        "workspace1.workspaces.com",
+		BackendPort:     int32(port),
+		Backend:         u.Hostname(),
+		BackendProtocol: "http",
+		WorkspaceName:   "workspace1",
+	})
+
+	s := New(&Options{
+		ClientInfoMiddleware: clientinfo.NewMiddleware(nil),
+		RequestIDMiddleware:  requestid.NewMiddleware(nil),
+		LoggingMiddleware:    emptyLoggingHandler,
+		AuthMiddleware:       emptyAuthHandler,
+		Logger:               logger,
+		Tracker:              tracker,
+		MetricsPath:          "/metrics",
+	})
+
+	// Trace context sent by the client does not become the parent of the proxy spans
+	clientTraceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com/", nil)
+	req.Header.Set("traceparent", clientTraceparent)
+	recorder := httptest.NewRecorder()
+	s.handler().ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	traceparent := <-traceparents
+	require.NotEmpty(t, traceparent)
+	require.NotEqual(t, clientTraceparent, traceparent)
+
+	spans := exporter.GetSpans()
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	require.Contains(t, names, "server.ServeHTTP")
+
+	backendCtx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier{"Traceparent": []string{traceparent}})
+	require.Equal(t, spans[0].SpanContext.TraceID(), trace.SpanContextFromContext(backendCtx).TraceID())
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"golang.org/x/net/http2"
+)
+
+var errInvalidBackendCA = errors.New("backend CA does not contain any valid PEM certificate")
+
+// transports holds the round trippers shared by all requests, one per way of
+// talking to a workspace backend. https backends get one transport per TLS
+// configuration so that connections are pooled per trust root.
+type transports struct {
+	http1   http.RoundTripper
+	h2c     http.RoundTripper
+	rootCAs *x509.CertPool
+	wrap    func(http.RoundTripper) http.RoundTripper
+
+	https map[string]*tlsTransport
+	sync.Mutex
+}
+
+// tlsTransport keeps the unwrapped transport around so that its idle
+// connections can be closed once no workspace uses it.
+type tlsTransport struct {
+	roundTripper http.RoundTripper
+	transport    *http.Transport
+}
+
+func newTransports(rootCAs *x509.CertPool, wrap func(http.RoundTripper) http.RoundTripper) *transports {
+	return &transports{
+		http1: wrap(http.DefaultTransport),
+		h2c: wrap(&http2.Transport{
+			// h2c is HTTP/2 without TLS, so dial a plain connection where the
+			// transport would otherwise negotiate TLS
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}),
+		rootCAs: rootCAs,
+		wrap:    wrap,
+		https:   make(map[string]*tlsTransport),
+	}
+}
+
+func (t *transports) forMapping(mapping *upstream.HostMapping) (http.RoundTripper, error) {
+	switch mapping.BackendProtocol {
+	case upstream.ProtocolH2C, upstream.ProtocolGRPC:
+		return t.h2c, nil
+	case upstream.ProtocolHTTPS:
+		return t.forTLS(mapping.TLS)
+	default:
+		return t.http1, nil
+	}
+}
+
+func (t *transports) forTLS(settings *upstream.BackendTLS) (http.RoundTripper, error) {
+	key := tlsTransportKey(settings)
+
+	t.Lock()
+	defer t.Unlock()
+	if cached, ok := t.https[key]; ok {
+		return cached.roundTripper, nil
+	}
+
+	tlsConfig, err := t.tlsConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	t.https[key] = &tlsTransport{roundTripper: t.wrap(transport), transport: transport}
+
+	return t.https[key].roundTripper, nil
+}
+
+// prune drops the https transports none of the mappings use and closes
+// their idle connections. Requests in flight keep their connection.
+func (t *transports) prune(mappings []upstream.HostMapping) {
+	inUse := make(map[string]bool)
+	for i := range mappings {
+		if mappings[i].BackendProtocol == upstream.ProtocolHTTPS {
+			inUse[tlsTransportKey(mappings[i].TLS)] = true
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for key, cached := range t.https {
+		if !inUse[key] {
+			delete(t.https, key)
+			cached.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// pruneTransports releases the https transports of removed workspaces until
+// the context is done.
+func (s *Server) pruneTransports(ctx context.Context, sub *upstream.Subscription) {
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+
+			// Only a changed or removed https mapping can leave a transport unused
+			if event.Type == upstream.EventResync || event.Before != nil && event.Before.BackendProtocol == upstream.ProtocolHTTPS {
+				s.transports.prune(s.opts.Tracker.List())
+			}
+		}
+	}
+}
+
+func (t *transports) tlsConfig(settings *upstream.BackendTLS) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    t.rootCAs,
+	}
+
+	if settings == nil {
+		return config, nil
+	}
+
+	config.ServerName = settings.ServerName
+	// Workspace owners explicitly opt in to skip verification for backends with self-signed certificates
+	config.InsecureSkipVerify = settings.InsecureSkipVerify //nolint:gosec
+
+	if settings.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(settings.CA)) {
+			return nil, errInvalidBackendCA
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+func tlsTransportKey(settings *upstream.BackendTLS) string {
+	if settings == nil {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(settings.CA))
+	return fmt.Sprintf("%s|%s|%t", hex.EncodeToString(hash[:]), settings.ServerName, settings.InsecureSkipVerify)
+}
+
+// LoadBackendRootCAs returns the system trust roots extended with the
+// certificates in caFile. A nil pool, meaning the system roots, is returned
+// when no file is configured.
+func LoadBackendRootCAs(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errInvalidBackendCA
+	}
+
+	return pool, nil
+}
+
+// backendURL picks the endpoint of a request. The status probe, the proxy and
+// its retries all use the returned URL so that they reach the same pod.
+func backendURL(mapping *upstream.HostMapping) (*url.URL, error) {
+	scheme := "http"
+	if mapping.BackendProtocol == upstream.ProtocolHTTPS {
+		scheme = "https"
+	}
+
+	return url.Parse(fmt.Sprintf("%s://%s", scheme, mapping.PickAddress()))
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestBackendURL(t *testing.T) {
+	tt := []struct {
+		description string
+		protocol    string
+		expectedURL string
+	}{
+		{
+			description: "When the protocol is http uses the http scheme",
+			protocol:    upstream.ProtocolHTTP,
+			expectedURL: "http://workspace1.ns:3000",
+		},
+		{
+			description: "When the protocol is https uses the https scheme",
+			protocol:    upstream.ProtocolHTTPS,
+			expectedURL: "https://workspace1.ns:3000",
+		},
+		{
+			description: "When the protocol is grpc uses the http scheme",
+			protocol:    upstream.ProtocolGRPC,
+			expectedURL: "http://workspace1.ns:3000",
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			result, err := backendURL(&upstream.HostMapping{
+				Backend:         "workspace1.ns",
+				BackendPort:     3000,
+				BackendProtocol: tr.protocol,
+			})
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedURL, result.String())
+		})
+	}
+}
+
+func TestServerProxiesH2C(t *testing.T) {
+	upstreamSrv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = w.Write([]byte(r.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	logger := zaptest.NewLogger(t)
+	tracker := upstream.NewTracker(logger)
+	tracker.Add(upstream.HostMapping{
+		Hostname:        "127.0.0.1",
+		BackendPort:     int32(port),
+		Backend:         u.Hostname(),
+		BackendProtocol: upstream.ProtocolGRPC,
+	})
+
+	s := New(&Options{
+		Logger:            logger,
+		Tracker:           tracker,
+		AuthMiddleware:    emptyAuthHandler,
+		LoggingMiddleware: emptyLoggingHandler,
+		MetricsPath:       "/metrics",
+	})
+	proxySrv := httptest.NewServer(s.handler())
+	defer proxySrv.Close()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	res, err := client.Post(proxySrv.URL, "application/grpc", nil)
+	require.Nil(t, err)
+	defer func() { _ = res.Body.Close() }()
+
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "HTTP/2.0", res.Proto)
+	require.Equal(t, "HTTP/2.0", string(body))
+	require.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+}
+
+func TestServerProxiesHTTPS(t *testing.T) {
+	upstreamSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello TLS"))
+	}))
+	defer upstreamSrv.Close()
+
+	u, err := url.Parse(upstreamSrv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	upstreamCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstreamSrv.Certificate().Raw}))
+
+	tt := []struct {
+		description        string
+		tls                *upstream.BackendTLS
+		expectedStatusCode int
+	}{
+		{
+			description:        "When the backend certificate is not trusted returns 502",
+			tls:                nil,
+			expectedStatusCode: http.StatusBadGateway,
+		},
+		{
+			description:        "When the workspace CA signs the backend certificate routes to upstream",
+			tls:                &upstream.BackendTLS{CA: upstreamCA},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description:        "When the server name override matches the certificate routes to upstream",
+			tls:                &upstream.BackendTLS{CA: upstreamCA, ServerName: "example.com"},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description:        "When the server name override does not match the certificate returns 502",
+			tls:                &upstream.BackendTLS{CA: upstreamCA, ServerName: "workspace.invalid"},
+			expectedStatusCode: http.StatusBadGateway,
+		},
+		{
+			description:        "When verification is skipped routes to upstream",
+			tls:                &upstream.BackendTLS{InsecureSkipVerify: true},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description:        "When the workspace CA is invalid returns 502",
+			tls:                &upstream.BackendTLS{CA: "invalid"},
+			expectedStatusCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			logger := zaptest.NewLogger(t)
+			tracker := upstream.NewTracker(logger)
+			tracker.Add(upstream.HostMapping{
+				Hostname:        "workspace1.workspaces.com",
+				BackendPort:     int32(port),
+				Backend:         u.Hostname(),
+				BackendProtocol: upstream.ProtocolHTTPS,
+				TLS:             tr.tls,
+			})
+
+			s := New(&Options{Logger: logger, Tracker: tracker})
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com", nil))
+
+			require.Equal(t, tr.expectedStatusCode, recorder.Code)
+		})
+	}
+}
+
+func TestTransportsPrune(t *testing.T) {
+	tt := []struct {
+		description   string
+		mappings      []upstream.HostMapping
+		expectedCount int
+	}{
+		{
+			description: "When a mapping still uses the TLS settings keeps the transport",
+			mappings: []upstream.HostMapping{
+				{BackendProtocol: upstream.ProtocolHTTPS, TLS: &upstream.BackendTLS{ServerName: "workspace1"}},
+			},
+			expectedCount: 1,
+		},
+		{
+			description: "When the mapping now uses other TLS settings drops the transport",
+			mappings: []upstream.HostMapping{
+				{BackendProtocol: upstream.ProtocolHTTPS, TLS: &upstream.BackendTLS{ServerName: "workspace2"}},
+			},
+			expectedCount: 0,
+		},
+		{
+			description:   "When no mapping is left drops the transport",
+			expectedCount: 0,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			transports := newTransports(nil, func(next http.RoundTripper) http.RoundTripper { return next })
+			_, err := transports.forTLS(&upstream.BackendTLS{ServerName: "workspace1"})
+			require.Nil(t, err)
+
+			transports.prune(tr.mappings)
+			require.Len(t, transports.https, tr.expectedCount)
+		})
+	}
+}
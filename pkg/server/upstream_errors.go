@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/requestid"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/routing"
+)
+
+type upstreamErrorKind string
+
+const (
+	upstreamErrorConnectionRefused upstreamErrorKind = "connection_refused"
+	upstreamErrorTimeout           upstreamErrorKind = "timeout"
+	upstreamErrorDNS               upstreamErrorKind = "dns"
+	upstreamErrorConnectionReset   upstreamErrorKind = "connection_reset"
+	upstreamErrorCanceled          upstreamErrorKind = "canceled"
+	upstreamErrorUnknown           upstreamErrorKind = "unknown"
+)
+
+func classifyUpstreamError(err error) upstreamErrorKind {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return upstreamErrorCanceled
+	case errors.As(err, &dnsErr):
+		return upstreamErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return upstreamErrorConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return upstreamErrorConnectionReset
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return upstreamErrorTimeout
+	default:
+		return upstreamErrorUnknown
+	}
+}
+
+// upstreamErrorHandler replaces the default ReverseProxy error handler, which
+// logs through the standard logger and always returns a bare 502.
+func (s *Server) upstreamErrorHandler(route *routing.Route) func(http.ResponseWriter, *http.Request, error) {
+	mapping := route.Mapping
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		kind := classifyUpstreamError(err)
+		logger := requestid.Logger(s.opts.Logger, r)
+		s.metrics.upstreamErrors.WithLabelValues(mapping.Cluster, s.metrics.workspace(mapping.WorkspaceName), string(kind)).Inc()
+
+		if kind == upstreamErrorCanceled {
+			// The client went away, there is nobody left to send a response to
+			logger.Debug("upstream request canceled by client",
+				logz.WorkspaceName(mapping.WorkspaceName),
+				logz.HTTPPath(r.URL.Path),
+			)
+			return
+		}
+
+		if isUpstreamNotReady(kind) {
+			logger.Info("workspace upstream is not ready",
+				logz.UpstreamErrorKind(string(kind)),
+				logz.WorkspaceName(mapping.WorkspaceName),
+				logz.HostMappingBackend(mapping.Backend),
+				logz.HostMappingBackendPort(mapping.BackendPort),
+			)
+			s.serveWorkspaceStarting(w, r, route.Prefix+workspaceStatusPath)
+			return
+		}
+
+		logger.Error("failed to proxy request to workspace upstream",
+			logz.Error(err),
+			logz.UpstreamErrorKind(string(kind)),
+			logz.WorkspaceName(mapping.WorkspaceName),
+			logz.HostMappingBackend(mapping.Backend),
+			logz.HostMappingBackendPort(mapping.BackendPort),
+			logz.HTTPPath(r.URL.Path),
+		)
+
+		status := http.StatusBadGateway
+		if kind == upstreamErrorTimeout {
+			status = http.StatusGatewayTimeout
+		}
+
+		writeError(w, r, status, "Workspace unavailable")
+	}
+}
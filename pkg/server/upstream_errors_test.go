@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
+	"go.uber.org/zap/zaptest"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyUpstreamError(t *testing.T) {
+	tt := []struct {
+		description  string
+		err          error
+		expectedKind upstreamErrorKind
+	}{
+		{
+			description:  "When the connection is refused returns connection refused",
+			err:          &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			expectedKind: upstreamErrorConnectionRefused,
+		},
+		{
+			description:  "When the dial times out returns timeout",
+			err:          &net.OpError{Op: "dial", Err: timeoutError{}},
+			expectedKind: upstreamErrorTimeout,
+		},
+		{
+			description:  "When the context deadline is exceeded returns timeout",
+			err:          fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			expectedKind: upstreamErrorTimeout,
+		},
+		{
+			description:  "When the hostname cannot be resolved returns dns",
+			err:          &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "workspace.ns", IsNotFound: true}},
+			expectedKind: upstreamErrorDNS,
+		},
+		{
+			description:  "When the connection is reset returns connection reset",
+			err:          &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			expectedKind: upstreamErrorConnectionReset,
+		},
+		{
+			description:  "When the client cancels the request returns canceled",
+			err:          context.Canceled,
+			expectedKind: upstreamErrorCanceled,
+		},
+		{
+			description:  "When the error is not recognised returns unknown",
+			err:          fmt.Errorf("something went wrong"),
+			expectedKind: upstreamErrorUnknown,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			require.Equal(t, tr.expectedKind, classifyUpstreamError(tr.err))
+		})
+	}
+}
+
+func TestUpstreamErrorHandler(t *testing.T) {
+	// Reserve a port and release it so that nothing is listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.Nil(t, listener.Close())
+
+	tt := []struct {
+		description         string
+		header              http.Header
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			description:         "When an API client hits an unready upstream returns 503 with retry after",
+			header:              http.Header{"Accept": []string{"application/json"}},
+			expectedContentType: "text/plain; charset=utf-8",
+			expectedBody:        "Workspace is starting",
+		},
+		{
+			description:         "When a browser navigates to an unready upstream serves the starting page",
+			header:              http.Header{"Sec-Fetch-Mode": []string{"navigate"}, "Accept": []string{"text/html"}},
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        workspaceStatusPath,
+		},
+	}
+
+	for _, tr := range tt {
+		t.Run(tr.description, func(t *testing.T) {
+			logger := zaptest.NewLogger(t)
+			tracker := upstream.NewTracker(logger)
+			tracker.Add(upstream.HostMapping{
+				Hostname:        "workspace1.workspaces.com",
+				BackendPort:     int32(port),
+				Backend:         "127.0.0.1",
+				BackendProtocol: "http",
+				WorkspaceName:   "workspace1",
+			})
+
+			s := New(&Options{
+				HTTPConfig: config.HTTP{
+					UpstreamRetry: config.UpstreamRetry{MaxAttempts: 1},
+				},
+				Logger:  logger,
+				Tracker: tracker,
+			})
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "http://workspace1.workspaces.com", nil)
+			request.Header = tr.header
+			s.ServeHTTP(recorder, request)
+
+			require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+			require.Equal(t, "5", recorder.Header().Get("Retry-After"))
+			require.Equal(t, tr.expectedContentType, recorder.Header().Get("Content-Type"))
+			require.Contains(t, recorder.Body.String(), tr.expectedBody)
+			require.Equal(t, float64(1), testutil.ToFloat64(
+				s.metrics.upstreamErrors.WithLabelValues("", "workspace1", string(upstreamErrorConnectionRefused)),
+			))
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Package sessions keeps track of the long lived connections to workspaces,
+// SSH connections and websockets, so that they can be listed and terminated
+// through the admin API.
+package sessions
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindSSH       Kind = "ssh"
+	KindWebsocket Kind = "websocket"
+)
+
+// Session is an open connection to a workspace.
+type Session struct {
+	ID            uint64    `json:"id"`
+	Kind          Kind      `json:"kind"`
+	WorkspaceName string    `json:"workspace_name"`
+	RemoteAddr    string    `json:"remote_addr"`
+	StartedAt     time.Time `json:"started_at"`
+}
+
+// CloseFunc adapts a function to io.Closer.
+type CloseFunc func() error
+
+func (f CloseFunc) Close() error {
+	return f()
+}
+
+type entry struct {
+	session Session
+	closer  io.Closer
+}
+
+type Registry struct {
+	now      func() time.Time
+	nextID   uint64
+	sessions map[uint64]entry
+	sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		now:      time.Now,
+		sessions: make(map[uint64]entry),
+	}
+}
+
+// Register records an open session which is ended by closing closer. The
+// returned function removes the session once the connection is closed.
+func (r *Registry) Register(kind Kind, workspaceName string, remoteAddr string, closer io.Closer) func() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.nextID++
+	id := r.nextID
+	r.sessions[id] = entry{
+		session: Session{
+			ID:            id,
+			Kind:          kind,
+			WorkspaceName: workspaceName,
+			RemoteAddr:    remoteAddr,
+			StartedAt:     r.now(),
+		},
+		closer: closer,
+	}
+
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.sessions, id)
+	}
+}
+
+// List returns the sessions of a workspace, or of every workspace when the
+// name is empty, oldest first.
+func (r *Registry) List(workspaceName string) []Session {
+	r.Lock()
+	defer r.Unlock()
+
+	result := make([]Session, 0, len(r.sessions))
+	for _, e := range r.sessions {
+		if workspaceName == "" || e.session.WorkspaceName == workspaceName {
+			result = append(result, e.session)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Terminate closes every session of a workspace and returns how many were
+// closed. Errors from closing are ignored, the connection is gone either way.
+func (r *Registry) Terminate(workspaceName string) int {
+	r.Lock()
+	var closers []io.Closer
+	for id, e := range r.sessions {
+		if e.session.WorkspaceName == workspaceName {
+			closers = append(closers, e.closer)
+			delete(r.sessions, id)
+		}
+	}
+	r.Unlock()
+
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+	return len(closers)
+}
@@ -0,0 +1,39 @@
+package sessions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	closed := map[string]bool{}
+	closer := func(name string) CloseFunc {
+		return func() error {
+			closed[name] = true
+			return nil
+		}
+	}
+
+	registry.Register(KindSSH, "workspace1", "192.0.2.1:1234", closer("ssh1"))
+	registry.Register(KindWebsocket, "workspace1", "192.0.2.1", closer("websocket1"))
+	deregister := registry.Register(KindWebsocket, "workspace2", "192.0.2.2", closer("websocket2"))
+
+	require.Len(t, registry.List(""), 3)
+	sessions := registry.List("workspace1")
+	require.Len(t, sessions, 2)
+	require.Equal(t, KindSSH, sessions[0].Kind)
+	require.Equal(t, KindWebsocket, sessions[1].Kind)
+
+	deregister()
+	require.Empty(t, registry.List("workspace2"))
+	require.False(t, closed["websocket2"], "removing a closed session does not close it again")
+
+	require.Equal(t, 2, registry.Terminate("workspace1"))
+	require.True(t, closed["ssh1"])
+	require.True(t, closed["websocket1"])
+	require.Empty(t, registry.List(""))
+	require.Equal(t, 0, registry.Terminate("workspace1"))
+}
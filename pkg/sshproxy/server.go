@@ -5,12 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/discovery"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/proxyproto"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
@@ -22,18 +27,28 @@ const (
 	workspaceNameCtxValueKey workspaceNameCtxValueType = "workspace_name"
 
 	MaxAuthTries = 3
+
+	// sshPortName is the service port name of the workspace SSH server
+	sshPortName = "ssh"
+
+	// eventReasonSSHAuthorizationDenied is recorded on the workspace service
+	// when a user who does not own the workspace tries to connect to it.
+	eventReasonSSHAuthorizationDenied = "SSHAuthorizationDenied"
 )
 
 var errUserNotAllowedAccessToWorkspace = errors.New("user not allowed access to workspace")
 
 type SSHProxy struct {
 	tracker         *upstream.Tracker
+	activity        *activity.Tracker
+	sessions        *sessions.Registry
 	log             *zap.Logger
 	sshConfig       *config.SSH
 	commonSSHConfig *ssh.ServerConfig
 }
 
-func New(ctx context.Context, logger *zap.Logger, tracker *upstream.Tracker, sshConfig *config.SSH, apiFactory gitlab.APIFactory) (*SSHProxy, error) {
+// New creates the SSH proxy. A nil recorder records no events.
+func New(ctx context.Context, logger *zap.Logger, tracker *upstream.Tracker, activityTracker *activity.Tracker, sessionRegistry *sessions.Registry, sshConfig *config.SSH, apiFactory gitlab.APIFactory, recorder discovery.EventRecorder) (*SSHProxy, error) {
 	hostKeySigner, parseErr := ssh.ParsePrivateKey([]byte(sshConfig.HostKey))
 	if parseErr != nil {
 		logger.Error("failed to read host key", logz.Error(parseErr), logz.SSHHostKey(sshConfig.HostKey))
@@ -57,7 +72,11 @@ func New(ctx context.Context, logger *zap.Logger, tracker *upstream.Tracker, ssh
 				logger.Error("failed to validate ownership of workspace",
 					logz.Error(err),
 					logz.WorkspaceName(workspaceName),
+					logz.RemoteAddr(c.RemoteAddr().String()),
 				)
+				if errors.Is(err, errUserNotAllowedAccessToWorkspace) && recorder != nil {
+					recordDenied(recorder, tracker, workspaceName, c.RemoteAddr())
+				}
 				return nil, err
 			}
 
@@ -73,6 +92,8 @@ func New(ctx context.Context, logger *zap.Logger, tracker *upstream.Tracker, ssh
 
 	return &SSHProxy{
 		tracker:         tracker,
+		activity:        activityTracker,
+		sessions:        sessionRegistry,
 		log:             logger,
 		sshConfig:       sshConfig,
 		commonSSHConfig: serverConfig,
@@ -80,15 +101,16 @@ func New(ctx context.Context, logger *zap.Logger, tracker *upstream.Tracker, ssh
 }
 
 func (p *SSHProxy) handleSSHConnection(ctx context.Context, incomingConn net.Conn) {
+	remoteAddr := incomingConn.RemoteAddr().String()
 	clientConn, clientChannel, clientReqChannel, err := ssh.NewServerConn(incomingConn, p.commonSSHConfig)
 	if err != nil {
-		p.log.Error("failed to create SSH connection", logz.Error(err))
+		p.log.Error("failed to create SSH connection", logz.Error(err), logz.RemoteAddr(remoteAddr))
 		return
 	}
 
 	if clientConn.Permissions == nil || clientConn.Permissions.Extensions == nil || clientConn.Permissions.Extensions["workspaceName"] == "" {
-		// TODO: log all fields - e.g. remote addr, permissions.extensions, etc.
-		p.log.Error("failed to find workspace name in connection-permission-extension")
+		// TODO: log all fields - e.g. permissions.extensions, etc.
+		p.log.Error("failed to find workspace name in connection-permission-extension", logz.RemoteAddr(remoteAddr))
 		p.closeConnection(incomingConn, "indeterminable")
 		return
 	}
@@ -98,21 +120,29 @@ func (p *SSHProxy) handleSSHConnection(ctx context.Context, incomingConn net.Con
 	connCtx = context.WithValue(connCtx, workspaceNameCtxValueKey, workspaceName)
 	defer connCancel()
 	defer p.closeConnection(clientConn, workspaceName)
-
-	upstreamHostMapping, err := p.tracker.GetByWorkspaceName(workspaceName)
+	// Terminating the session through the admin API ends the connection
+	// even when the client connection closes without an error
+	defer p.sessions.Register(sessions.KindSSH, workspaceName, remoteAddr, sessions.CloseFunc(func() error {
+		connCancel()
+		return clientConn.Close()
+	}))()
+
+	workspace, err := p.tracker.GetWorkspaceByName(workspaceName)
 	if err != nil {
-		p.log.Error("failed to find workspace name in tracker", logz.Error(err))
+		p.log.Error("failed to find workspace name in tracker", logz.Error(err), logz.RemoteAddr(remoteAddr))
 		return
 	}
 
-	remoteAddr := fmt.Sprintf("%s:%d", upstreamHostMapping.Backend, p.sshConfig.BackendPort)
-	remoteConn, err := net.Dial("tcp", remoteAddr)
+	p.log.Info("accepted SSH connection", logz.WorkspaceName(workspaceName), logz.RemoteAddr(remoteAddr))
+
+	backendAddr := net.JoinHostPort(workspace.Backend, strconv.Itoa(sshBackendPort(workspace, p.sshConfig.BackendPort)))
+	remoteConn, err := net.Dial("tcp", backendAddr)
 	if err != nil {
 		p.log.Error("failed to create backend connection", logz.Error(err), logz.WorkspaceName(workspaceName))
 		return
 	}
 	// before use, a handshake must be performed on the incoming net.Conn.
-	backendConn, backendChannel, backendReqChannel, err := ssh.NewClientConn(remoteConn, remoteAddr, &ssh.ClientConfig{
+	backendConn, backendChannel, backendReqChannel, err := ssh.NewClientConn(remoteConn, backendAddr, &ssh.ClientConfig{
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		User:            p.sshConfig.BackendUsername,
 		Auth: []ssh.AuthMethod{
@@ -151,13 +181,23 @@ func (p *SSHProxy) handleSSHConnection(ctx context.Context, incomingConn net.Con
 	<-connCtx.Done()
 }
 
-func (p *SSHProxy) Start(ctx context.Context, listenAddr string, readyCh chan<- struct{}, stopCh chan<- struct{}) error {
+// Start serves SSH connections until the context is done. observe is called
+// with the PROXY protocol outcome of every connection, it may be nil.
+func (p *SSHProxy) Start(ctx context.Context, listenAddr string, observe func(proxyproto.Result), readyCh chan<- struct{}, stopCh chan<- struct{}) error {
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		p.log.Error("failed to start ssh proxy server.", logz.Error(err))
 		return fmt.Errorf("failed to start ssh proxy server: %v", err)
 	}
 
+	wrapped, err := proxyproto.Wrap(listener, p.sshConfig.ProxyProtocol, observe)
+	if err != nil {
+		_ = listener.Close()
+		p.log.Error("failed to configure PROXY protocol for ssh proxy server.", logz.Error(err))
+		return fmt.Errorf("failed to configure PROXY protocol for ssh proxy server: %v", err)
+	}
+	listener = wrapped
+
 	go func() {
 		<-ctx.Done()
 		closeErr := listener.Close()
@@ -193,6 +233,22 @@ func (p *SSHProxy) Start(ctx context.Context, listenAddr string, readyCh chan<-
 	return nil
 }
 
+// recordDenied reports the client address, which is the address of the real
+// client when the load balancer sends PROXY protocol headers.
+func recordDenied(recorder discovery.EventRecorder, tracker *upstream.Tracker, workspaceName string, remoteAddr net.Addr) {
+	workspace, err := tracker.GetWorkspaceByName(workspaceName)
+	if err != nil {
+		return
+	}
+
+	clientIP := remoteAddr.String()
+	if host, _, splitErr := net.SplitHostPort(clientIP); splitErr == nil {
+		clientIP = host
+	}
+	recorder.RecordWorkspaceWarning(workspace.Cluster, workspace.Namespace, workspace.Name, eventReasonSSHAuthorizationDenied,
+		fmt.Sprintf("a GitLab user who does not own the workspace was denied SSH access from %s", clientIP))
+}
+
 func validateWorkspaceOwnership(ctx context.Context, workspaceName, password string, tracker *upstream.Tracker, apiFactory gitlab.APIFactory) error {
 	api := apiFactory(password)
 
@@ -201,12 +257,12 @@ func validateWorkspaceOwnership(ctx context.Context, workspaceName, password str
 		return err
 	}
 
-	upstreamHostMapping, err := tracker.GetByWorkspaceName(workspaceName)
+	upstreamWorkspace, err := tracker.GetWorkspaceByName(workspaceName)
 	if err != nil {
 		return err
 	}
 
-	workspace, err := api.GetWorkspace(ctx, upstreamHostMapping.WorkspaceID)
+	workspace, err := api.GetWorkspace(ctx, upstreamWorkspace.ID)
 	if err != nil {
 		return err
 	}
@@ -219,6 +275,15 @@ func validateWorkspaceOwnership(ctx context.Context, workspaceName, password str
 	return nil
 }
 
+// sshBackendPort selects the port of the workspace SSH server. A service port
+// named ssh takes precedence over the configured backend port.
+func sshBackendPort(workspace *upstream.Workspace, defaultPort int) int {
+	if port, ok := workspace.PortByName(sshPortName); ok {
+		return int(port.Number)
+	}
+	return defaultPort
+}
+
 type connection interface {
 	Close() error
 }
@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/activity"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/config"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/gitlab"
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/sessions"
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/pkg/upstream"
 	"go.uber.org/zap/zaptest"
 	"golang.org/x/crypto/ssh"
@@ -94,6 +97,31 @@ func TestValidateWorkspaceOwnership(t *testing.T) {
 	}
 }
 
+func TestSSHBackendPort(t *testing.T) {
+	tests := []struct {
+		description  string
+		ports        []upstream.Port
+		expectedPort int
+	}{
+		{
+			description:  "When the service has a port named ssh uses that port",
+			ports:        []upstream.Port{{Name: "editor", Number: 60001}, {Name: "ssh", Number: 60022}},
+			expectedPort: 60022,
+		},
+		{
+			description:  "When the service has no port named ssh uses the configured port",
+			ports:        []upstream.Port{{Name: "editor", Number: 60001}, {Number: 60022}},
+			expectedPort: 22,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			require.Equal(t, tc.expectedPort, sshBackendPort(&upstream.Workspace{Ports: tc.ports}, 22))
+		})
+	}
+}
+
 func TestServerStartsAndExits(t *testing.T) {
 	port := 30010
 	addr := fmt.Sprintf(":%d", port)
@@ -105,15 +133,15 @@ func TestServerStartsAndExits(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	server, err := New(ctx, logger, tracker, &config.SSH{
+	server, err := New(ctx, logger, tracker, activity.NewTracker(), sessions.NewRegistry(), &config.SSH{
 		HostKey: string(hostKey),
-	}, gitlab.MockAPIFactory)
+	}, gitlab.MockAPIFactory, nil)
 	require.NoError(t, err)
 
 	readyCh := make(chan struct{})
 
 	go func() {
-		err = server.Start(ctx, addr, readyCh, nil)
+		err = server.Start(ctx, addr, nil, readyCh, nil)
 		require.NoError(t, err)
 	}()
 
@@ -141,6 +169,7 @@ func TestServerAuth(t *testing.T) {
 		upstreamHostMapping *upstream.HostMapping
 		workspaceName       string
 		expectError         bool
+		expectedEvents      []string
 	}{
 		{
 			description: "Server does not accept connections when no upstreams are found",
@@ -163,8 +192,9 @@ func TestServerAuth(t *testing.T) {
 				WorkspaceID:   "myworkspace",
 				WorkspaceName: "myworkspace",
 			},
-			workspaceName: "myworkspace",
-			expectError:   true,
+			workspaceName:  "myworkspace",
+			expectError:    true,
+			expectedEvents: []string{eventReasonSSHAuthorizationDenied},
 		},
 		{
 			description: "Server does accept connections when upstream found and PAT is correct",
@@ -190,9 +220,10 @@ func TestServerAuth(t *testing.T) {
 				tracker.Add(*test.upstreamHostMapping)
 			}
 
-			server, err := New(ctx, logger, tracker, &config.SSH{
+			recorder := &fakeRecorder{}
+			server, err := New(ctx, logger, tracker, activity.NewTracker(), sessions.NewRegistry(), &config.SSH{
 				HostKey: string(hostKey),
-			}, createFactory(test.userID, 1))
+			}, createFactory(test.userID, 1), recorder)
 			require.NoError(t, err)
 
 			addr := fmt.Sprintf(":%d", test.port)
@@ -200,7 +231,7 @@ func TestServerAuth(t *testing.T) {
 			stopCh := make(chan struct{})
 
 			go func(addr string) {
-				err = server.Start(ctx, addr, readyCh, stopCh)
+				err = server.Start(ctx, addr, nil, readyCh, stopCh)
 				require.NoError(t, err)
 			}(addr)
 
@@ -225,6 +256,10 @@ func TestServerAuth(t *testing.T) {
 					ssh.Password(""),
 				},
 			})
+			require.Equal(t, test.expectedEvents, recorder.reasons())
+			for _, message := range recorder.messages {
+				require.Regexp(t, `denied SSH access from (127\.0\.0\.1|::1)$`, message)
+			}
 			if test.expectError {
 				require.Error(t, err)
 				return
@@ -235,6 +270,25 @@ func TestServerAuth(t *testing.T) {
 	}
 }
 
+type fakeRecorder struct {
+	mu              sync.Mutex
+	recordedReasons []string
+	messages        []string
+}
+
+func (r *fakeRecorder) RecordWorkspaceWarning(_, _, _, reason, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recordedReasons = append(r.recordedReasons, reason)
+	r.messages = append(r.messages, message)
+}
+
+func (r *fakeRecorder) reasons() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.recordedReasons
+}
+
 func createFactory(userID, workspaceUserID int) gitlab.APIFactory {
 	return func(token string) gitlab.API {
 		return &gitlab.MockAPI{
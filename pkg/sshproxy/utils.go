@@ -63,7 +63,7 @@ func (p *SSHProxy) copyData(ctx context.Context, target ssh.Conn, source <-chan
 
 			go func() {
 				p.log.Debug("attempting to copy data to target channel from source channel", logz.WorkspaceName(workspaceName))
-				_, copyErr := io.Copy(targetChannel, sourceChannel)
+				_, copyErr := io.Copy(targetChannel, p.activity.Reader(workspaceName, sourceChannel))
 				if copyErr != nil {
 					p.log.Error("failed to copy data to target channel from source channel", logz.Error(copyErr), logz.WorkspaceName(workspaceName))
 				}
@@ -77,7 +77,7 @@ func (p *SSHProxy) copyData(ctx context.Context, target ssh.Conn, source <-chan
 
 			go func() {
 				p.log.Debug("attempting to copy data to source channel from target channel", logz.WorkspaceName(workspaceName))
-				_, copyErr := io.Copy(sourceChannel, targetChannel)
+				_, copyErr := io.Copy(sourceChannel, p.activity.Reader(workspaceName, targetChannel))
 				if copyErr != nil {
 					p.log.Error("failed to copy data to source channel from target channel", logz.Error(copyErr), logz.WorkspaceName(workspaceName))
 				}
@@ -0,0 +1,102 @@
+// Package tracing exports OpenTelemetry spans for the auth flow and for
+// requests proxied to workspaces. Tracing is off unless enabled in the config,
+// the global no-op provider then makes every span free.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "gitlab.com/remote-development/gitlab-workspaces-proxy"
+	// DefaultServiceName is reported when the config does not name the service.
+	DefaultServiceName = "gitlab-workspaces-proxy"
+	// DefaultSampleRatio records every trace when the config sets no ratio.
+	DefaultSampleRatio = 1.0
+)
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g. http://otel-collector:4318.
+	// When empty the OTEL_EXPORTER_OTLP_* environment variables apply.
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the fraction of new traces which are recorded, nil
+	// records all of them and zero records none.
+	SampleRatio *float64 `yaml:"sample_ratio"`
+	ServiceName string   `yaml:"service_name"`
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans on shutdown.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if config.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(config.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(config.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	sampleRatio := DefaultSampleRatio
+	if config.SampleRatio != nil {
+		sampleRatio = *config.SampleRatio
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// Start creates a span as a child of the span in ctx.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// RecordError marks the span as failed.
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// NewHandler starts a server span for every request. Trace context sent by
+// clients is linked rather than continued, as browsers are not trusted to
+// choose the trace of the proxy.
+func NewHandler(next http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(next, operation, otelhttp.WithPublicEndpoint())
+}
+
+// NewTransport creates a client span for every request sent through next and
+// propagates the trace context in the traceparent header.
+func NewTransport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next)
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"sort"
+	"time"
+
+	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
+)
+
+// Conflict is a host mapping which is not served because its hostname, or its
+// workspace port, already belongs to another workspace. The workspace which
+// claimed it first keeps it, the conflicting mapping is added once the owner
+// is removed.
+type Conflict struct {
+	// Source contributed the conflicting mapping, empty for mappings added with Add
+	Source  string
+	Mapping HostMapping
+	// Owner is the mapping which keeps serving the hostname or workspace port
+	Owner      HostMapping
+	DetectedAt time.Time
+
+	// seq orders conflicts by detection, the oldest is resolved first
+	seq uint64
+}
+
+// Conflicts returns the mappings waiting for their hostname or workspace port
+// to be released, ordered by hostname.
+func (u *Tracker) Conflicts() []Conflict {
+	u.RLock()
+	defer u.RUnlock()
+	return u.conflictList()
+}
+
+func (u *Tracker) conflictList() []Conflict {
+	result := make([]Conflict, 0)
+	for _, conflicts := range u.conflicts {
+		for _, conflict := range conflicts {
+			result = append(result, *conflict)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Mapping.Hostname != result[j].Mapping.Hostname {
+			return result[i].Mapping.Hostname < result[j].Mapping.Hostname
+		}
+		return result[i].seq < result[j].seq
+	})
+	return result
+}
+
+// sameWorkspace reports whether both mappings belong to the same workspace,
+// e.g. when a service was recreated under a new UID.
+func sameWorkspace(a, b HostMapping) bool {
+	return a.WorkspaceName == b.WorkspaceName && a.Namespace == b.Namespace && a.Cluster == b.Cluster
+}
+
+// conflictOwner returns the mapping of another workspace which serves the
+// hostname or workspace port of mapping. Mappings a source contributed
+// itself are not conflicts, the source replaces them. The caller must hold
+// the lock.
+func (u *Tracker) conflictOwner(source string, mapping HostMapping) (HostMapping, bool) {
+	if owner, ok := u.upstreamsByHost[mapping.Hostname]; ok && u.ownedByOtherSource(source, owner) && !sameWorkspace(owner, mapping) {
+		return owner, true
+	}
+	if owner, ok := u.upstreamsByName[mapping.WorkspaceName][mapping.BackendPort]; ok && u.ownedByOtherSource(source, owner) && !sameWorkspace(owner, mapping) {
+		return owner, true
+	}
+	return HostMapping{}, false
+}
+
+func (u *Tracker) ownedByOtherSource(source string, owner HostMapping) bool {
+	return source == "" || u.sourcesByHost[owner.Hostname] != source
+}
+
+// addConflict records a conflicting mapping of source. The conflict is only
+// logged when it was not known before. The caller must hold the write lock.
+func (u *Tracker) addConflict(source string, mapping HostMapping, owner HostMapping, previous *Conflict) (Conflict, bool) {
+	conflict := &Conflict{Source: source, Mapping: mapping, Owner: owner}
+	known := previous != nil && previous.Owner.Hostname == owner.Hostname && sameWorkspace(previous.Owner, owner)
+	if known {
+		conflict.DetectedAt = previous.DetectedAt
+		conflict.seq = previous.seq
+	} else {
+		u.conflictSeq++
+		conflict.DetectedAt = time.Now()
+		conflict.seq = u.conflictSeq
+		u.logger.Error("host mapping conflicts with another workspace, the first workspace keeps it",
+			logz.HostMappingHostname(mapping.Hostname),
+			logz.WorkspaceName(mapping.WorkspaceName),
+			logz.ServiceNamespace(mapping.Namespace),
+			logz.Cluster(mapping.Cluster),
+			logz.ConflictingWorkspaceName(owner.WorkspaceName),
+			logz.ConflictingCluster(owner.Cluster),
+		)
+	}
+
+	if u.conflicts[source] == nil {
+		u.conflicts[source] = make(map[string]*Conflict)
+	}
+	u.conflicts[source][mapping.Hostname] = conflict
+	return *conflict, !known
+}
+
+// resolveConflicts adds the conflicting mappings whose hostname and workspace
+// port were released, oldest first. The caller must hold the write lock.
+func (u *Tracker) resolveConflicts() {
+	for _, conflict := range u.conflictList() {
+		// Mappings of the conflicting source itself hold on to the hostname
+		// as well, the source resolves those conflicts when it is replaced
+		if _, ok := u.conflictOwner("", conflict.Mapping); ok {
+			continue
+		}
+
+		delete(u.conflicts[conflict.Source], conflict.Mapping.Hostname)
+		if len(u.conflicts[conflict.Source]) == 0 {
+			delete(u.conflicts, conflict.Source)
+		}
+
+		u.add(conflict.Mapping)
+		if conflict.Source != "" {
+			u.sourcesByHost[conflict.Mapping.Hostname] = conflict.Source
+			u.hostnamesBySource[conflict.Source] = append(u.hostnamesBySource[conflict.Source], conflict.Mapping.Hostname)
+		}
+	}
+}
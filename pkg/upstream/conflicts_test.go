@@ -0,0 +1,98 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUpstreamTrackerConflicts(t *testing.T) {
+	owner := HostMapping{Hostname: "3000-test", WorkspaceName: "test", Namespace: "ns1", BackendPort: 3000}
+	hijacker := HostMapping{Hostname: "3000-test", WorkspaceName: "other", Namespace: "ns2", BackendPort: 3000}
+
+	tests := []struct {
+		description       string
+		deleteSource      string
+		expectedWorkspace string
+		expectedConflicts int
+	}{
+		{
+			description:       "When two workspaces claim a hostname, the first keeps it",
+			expectedWorkspace: "test",
+			expectedConflicts: 1,
+		},
+		{
+			description:       "When the owner is removed, the conflicting workspace takes over",
+			deleteSource:      "uid-1",
+			expectedWorkspace: "other",
+		},
+		{
+			description:       "When the conflicting workspace is removed, its conflict is forgotten",
+			deleteSource:      "uid-2",
+			expectedWorkspace: "test",
+		},
+	}
+
+	for _, tr := range tests {
+		t.Run(tr.description, func(t *testing.T) {
+			tracker := NewTracker(zaptest.NewLogger(t))
+			require.Empty(t, tracker.Replace("uid-1", []HostMapping{owner}))
+
+			detected := tracker.Replace("uid-2", []HostMapping{hijacker})
+			require.Len(t, detected, 1)
+			require.Equal(t, "uid-2", detected[0].Source)
+			require.Equal(t, owner, detected[0].Owner)
+			// Known conflicts are only reported once
+			require.Empty(t, tracker.Replace("uid-2", []HostMapping{hijacker}))
+
+			if tr.deleteSource != "" {
+				tracker.DeleteSource(tr.deleteSource)
+			}
+
+			mapping, err := tracker.GetByHostname("3000-test")
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedWorkspace, mapping.WorkspaceName)
+			require.Len(t, tracker.Conflicts(), tr.expectedConflicts)
+		})
+	}
+}
+
+func TestUpstreamTrackerConflictsWithinSource(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	detected := tracker.Replace("static:mappings.yaml", []HostMapping{
+		{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000},
+		{Hostname: "3000-test", WorkspaceName: "other", BackendPort: 3000},
+	})
+	require.Len(t, detected, 1)
+
+	mapping, err := tracker.GetByHostname("3000-test")
+	require.Nil(t, err)
+	require.Equal(t, "test", mapping.WorkspaceName)
+
+	// The source may move its own hostname to another workspace
+	require.Empty(t, tracker.Replace("static:mappings.yaml", []HostMapping{
+		{Hostname: "3000-test", WorkspaceName: "other", BackendPort: 3000},
+	}))
+	mapping, err = tracker.GetByHostname("3000-test")
+	require.Nil(t, err)
+	require.Equal(t, "other", mapping.WorkspaceName)
+	require.Empty(t, tracker.Conflicts())
+}
+
+func TestUpstreamTrackerAddConflict(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000})
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceName: "other", BackendPort: 3000})
+
+	mapping, err := tracker.GetByHostname("3000-test")
+	require.Nil(t, err)
+	require.Equal(t, "test", mapping.WorkspaceName)
+	require.Len(t, tracker.Conflicts(), 1)
+
+	tracker.DeleteByHostname("3000-test")
+	mapping, err = tracker.GetByHostname("3000-test")
+	require.Nil(t, err)
+	require.Equal(t, "other", mapping.WorkspaceName)
+	require.Empty(t, tracker.Conflicts())
+}
@@ -0,0 +1,93 @@
+package upstream
+
+// EventType is the kind of change to a host mapping.
+type EventType string
+
+const (
+	EventAdded   EventType = "added"
+	EventUpdated EventType = "updated"
+	EventRemoved EventType = "removed"
+	// EventResync is delivered after events were dropped because the
+	// subscriber fell behind, it should rebuild its state from Tracker.List
+	EventResync EventType = "resync"
+)
+
+// DefaultSubscriptionBuffer is used when Subscribe is called without a buffer size.
+const DefaultSubscriptionBuffer = 64
+
+// Event describes a change to the mapping of a hostname. Before is nil for
+// added mappings and After is nil for removed ones.
+type Event struct {
+	Type   EventType
+	Before *HostMapping
+	After  *HostMapping
+}
+
+// Subscription receives the changes to the tracker after it was created.
+type Subscription struct {
+	// Snapshot holds every mapping at the time of subscribing, ordered by hostname
+	Snapshot []HostMapping
+
+	tracker *Tracker
+	events  chan Event
+	// dropped is set when an event did not fit in the buffer, guarded by the tracker lock
+	dropped bool
+}
+
+// Subscribe registers a subscriber. Events are delivered without blocking the
+// tracker: when the buffer is full they are dropped and a single EventResync
+// is delivered once there is room again.
+func (u *Tracker) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultSubscriptionBuffer
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	sub := &Subscription{
+		Snapshot: u.list(),
+		tracker:  u,
+		events:   make(chan Event, buffer),
+	}
+	u.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Events returns the channel events are delivered on, it is closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the delivery of events.
+func (s *Subscription) Close() {
+	s.tracker.Lock()
+	defer s.tracker.Unlock()
+	if _, ok := s.tracker.subscribers[s]; !ok {
+		return
+	}
+
+	delete(s.tracker.subscribers, s)
+	close(s.events)
+}
+
+// publish delivers an event to every subscriber. The caller must hold the
+// write lock.
+func (u *Tracker) publish(event Event) {
+	for sub := range u.subscribers {
+		if sub.dropped {
+			select {
+			case sub.events <- Event{Type: EventResync}:
+				sub.dropped = false
+			default:
+				continue
+			}
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped = true
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func receive(t *testing.T, sub *Subscription) []Event {
+	t.Helper()
+
+	var events []Event
+	for {
+		select {
+		case event := <-sub.Events():
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	first := HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}
+	updated := HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000, Streaming: true}
+	moved := HostMapping{Hostname: "3000-moved", WorkspaceName: "test", BackendPort: 3000}
+
+	tests := []struct {
+		description    string
+		change         func(tracker *Tracker)
+		expectedEvents []Event
+	}{
+		{
+			description:    "When a mapping is added emits added",
+			change:         func(tracker *Tracker) { tracker.Add(first) },
+			expectedEvents: []Event{{Type: EventAdded, After: &first}},
+		},
+		{
+			description: "When a mapping changes emits updated with both mappings",
+			change: func(tracker *Tracker) {
+				tracker.Add(first)
+				tracker.Add(updated)
+			},
+			expectedEvents: []Event{{Type: EventAdded, After: &first}, {Type: EventUpdated, Before: &first, After: &updated}},
+		},
+		{
+			description: "When an unchanged mapping is added again emits nothing",
+			change: func(tracker *Tracker) {
+				tracker.Add(first)
+				tracker.Add(first)
+			},
+			expectedEvents: []Event{{Type: EventAdded, After: &first}},
+		},
+		{
+			description: "When a port moves to another hostname emits removed and added",
+			change: func(tracker *Tracker) {
+				tracker.Replace("uid-1", []HostMapping{first})
+				tracker.Replace("uid-1", []HostMapping{moved})
+			},
+			expectedEvents: []Event{
+				{Type: EventAdded, After: &first},
+				{Type: EventRemoved, Before: &first},
+				{Type: EventAdded, After: &moved},
+			},
+		},
+		{
+			description: "When a mapping is deleted emits removed",
+			change: func(tracker *Tracker) {
+				tracker.Add(first)
+				tracker.DeleteByHostname(first.Hostname)
+			},
+			expectedEvents: []Event{{Type: EventAdded, After: &first}, {Type: EventRemoved, Before: &first}},
+		},
+	}
+
+	for _, tr := range tests {
+		t.Run(tr.description, func(t *testing.T) {
+			tracker := NewTracker(zaptest.NewLogger(t))
+			sub := tracker.Subscribe(0)
+			defer sub.Close()
+
+			tr.change(tracker)
+			require.Equal(t, tr.expectedEvents, receive(t, sub))
+		})
+	}
+}
+
+func TestSubscribeSnapshot(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Add(HostMapping{Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080})
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000})
+
+	sub := tracker.Subscribe(0)
+	defer sub.Close()
+
+	require.Equal(t, tracker.List(), sub.Snapshot)
+	require.Empty(t, receive(t, sub))
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	slow := tracker.Subscribe(2)
+	defer slow.Close()
+	fast := tracker.Subscribe(10)
+	defer fast.Close()
+
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000})
+	tracker.Add(HostMapping{Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080})
+	tracker.Add(HostMapping{Hostname: "9000-test", WorkspaceName: "test", BackendPort: 9000})
+	require.Len(t, receive(t, fast), 3)
+
+	events := receive(t, slow)
+	require.Len(t, events, 2)
+	require.Equal(t, EventAdded, events[0].Type)
+	require.Equal(t, EventAdded, events[1].Type)
+
+	// The next event is preceded by a resync since one event was dropped
+	tracker.DeleteByHostname("9000-test")
+	events = receive(t, slow)
+	require.Len(t, events, 2)
+	require.Equal(t, EventResync, events[0].Type)
+	require.Equal(t, EventRemoved, events[1].Type)
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	sub := tracker.Subscribe(0)
+	sub.Close()
+	sub.Close()
+
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000})
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+}
@@ -2,33 +2,119 @@ package upstream
 
 import (
 	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 
 	"gitlab.com/remote-development/gitlab-workspaces-proxy/internal/logz"
 	"go.uber.org/zap"
 )
 
+// Protocols used to talk to a workspace backend port.
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+	ProtocolH2C   = "h2c"
+	ProtocolGRPC  = "grpc"
+)
+
+func IsValidProtocol(protocol string) bool {
+	switch protocol {
+	case ProtocolHTTP, ProtocolHTTPS, ProtocolH2C, ProtocolGRPC:
+		return true
+	default:
+		return false
+	}
+}
+
 type HostMapping struct {
-	Hostname        string `yaml:"host"`
-	BackendPort     int32  `yaml:"port"`
+	Hostname    string `yaml:"host"`
+	BackendPort int32  `yaml:"port"`
+	// PortName is the name of the service port, empty when the port is unnamed
+	PortName        string `yaml:"portName"`
 	Backend         string `yaml:"backend"`
 	BackendProtocol string `yaml:"protocol"`
 	WorkspaceID     string `yaml:"workspaceID"`
 	WorkspaceName   string `yaml:"workspaceName"`
+	// Namespace of the workspace service, empty when not discovered from Kubernetes
+	Namespace string `yaml:"namespace"`
+	// Cluster the workspace service was discovered in, empty with a single cluster
+	Cluster string `yaml:"cluster"`
+	// Streaming flushes every response from this backend immediately instead
+	// of relying on response detection, e.g. for long polling dev servers.
+	Streaming bool `yaml:"streaming"`
+	// TLS configures how an https backend is verified, nil uses the global trust roots
+	TLS *BackendTLS `yaml:"tls"`
+	// Readiness is set by discovery sources which track the pods serving the port
+	Readiness Readiness `yaml:"-"`
+	// Endpoints are the addresses of ready pods, requests are sent to one of
+	// them instead of Backend when set
+	Endpoints []string `yaml:"-"`
+}
+
+// Readiness of a workspace port as reported by the pods serving it.
+type Readiness string
+
+const (
+	// ReadinessUnknown is used when the discovery source does not track pods
+	ReadinessUnknown  Readiness = ""
+	ReadinessReady    Readiness = "ready"
+	ReadinessNotReady Readiness = "not_ready"
+)
+
+// PickAddress returns the host and port requests to the mapping are sent to.
+// With several endpoints every call may pick another pod, so callers pick
+// once per request and reuse the address.
+func (m *HostMapping) PickAddress() string {
+	if len(m.Endpoints) > 0 {
+		// Spreading requests over the pods does not need a secure source
+		return m.Endpoints[rand.Intn(len(m.Endpoints))] //nolint:gosec
+	}
+	return net.JoinHostPort(m.Backend, strconv.Itoa(int(m.BackendPort)))
+}
+
+type BackendTLS struct {
+	// ServerName overrides the name sent in SNI and verified against the certificate
+	ServerName string `yaml:"serverName"`
+	// CA is a PEM bundle which replaces the global trust roots for this backend
+	CA                 string `yaml:"ca"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
 }
 
+// Tracker keeps the host mapping of every workspace port. Mappings are indexed
+// by hostname, and grouped by workspace so that all ports of a workspace can
+// be looked up by its name or ID.
 type Tracker struct {
 	logger          *zap.Logger
 	upstreamsByHost map[string]HostMapping
-	upstreamsByName map[string]HostMapping
+	// upstreamsByName holds the mappings of a workspace keyed by port number
+	upstreamsByName    map[string]map[int32]HostMapping
+	workspaceNamesByID map[string]string
+	// hostnamesBySource holds the hostnames each source, e.g. the UID of a
+	// Kubernetes service, contributed so that they can be replaced together
+	hostnamesBySource map[string][]string
+	sourcesByHost     map[string]string
+	// conflicts holds the mappings which are not served, keyed by their
+	// source and hostname
+	conflicts   map[string]map[string]*Conflict
+	conflictSeq uint64
+	subscribers map[*Subscription]struct{}
 	sync.RWMutex
 }
 
 func NewTracker(logger *zap.Logger) *Tracker {
 	return &Tracker{
-		logger:          logger,
-		upstreamsByHost: make(map[string]HostMapping),
-		upstreamsByName: make(map[string]HostMapping),
+		logger:             logger,
+		upstreamsByHost:    make(map[string]HostMapping),
+		upstreamsByName:    make(map[string]map[int32]HostMapping),
+		workspaceNamesByID: make(map[string]string),
+		hostnamesBySource:  make(map[string][]string),
+		sourcesByHost:      make(map[string]string),
+		conflicts:          make(map[string]map[string]*Conflict),
+		subscribers:        make(map[*Subscription]struct{}),
 	}
 }
 
@@ -44,42 +130,280 @@ func (u *Tracker) GetByHostname(name string) (*HostMapping, error) {
 	return nil, ErrNotFound
 }
 
-func (u *Tracker) GetByWorkspaceName(name string) (*HostMapping, error) {
+// GetWorkspaceByName returns a workspace with all of its ports.
+func (u *Tracker) GetWorkspaceByName(name string) (*Workspace, error) {
 	u.RLock()
 	defer u.RUnlock()
-	if val, ok := u.upstreamsByName[name]; ok {
+	if mappings, ok := u.upstreamsByName[name]; ok {
+		return newWorkspace(mappings), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// GetWorkspaceByID returns a workspace with all of its ports.
+func (u *Tracker) GetWorkspaceByID(id string) (*Workspace, error) {
+	u.RLock()
+	defer u.RUnlock()
+	if name, ok := u.workspaceNamesByID[id]; ok {
+		return newWorkspace(u.upstreamsByName[name]), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// GetWorkspaceByHostname returns the workspace serving a hostname with all of
+// its ports, not only the port the hostname is mapped to.
+func (u *Tracker) GetWorkspaceByHostname(hostname string) (*Workspace, error) {
+	u.RLock()
+	defer u.RUnlock()
+	if mapping, ok := u.upstreamsByHost[hostname]; ok {
+		return newWorkspace(u.upstreamsByName[mapping.WorkspaceName]), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// List returns every host mapping ordered by hostname.
+func (u *Tracker) List() []HostMapping {
+	u.RLock()
+	defer u.RUnlock()
+	return u.list()
+}
+
+func (u *Tracker) list() []HostMapping {
+	result := make([]HostMapping, 0, len(u.upstreamsByHost))
+	for _, mapping := range u.upstreamsByHost {
+		result = append(result, mapping)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Hostname < result[j].Hostname
+	})
+	return result
+}
+
+// CountByReadiness returns the number of host mappings in each readiness state.
+func (u *Tracker) CountByReadiness() map[Readiness]int {
+	u.RLock()
+	defer u.RUnlock()
+
+	result := make(map[Readiness]int)
+	for _, mapping := range u.upstreamsByHost {
+		result[mapping.Readiness]++
+	}
+	return result
+}
+
+// CountByCluster returns the number of host mappings discovered in each cluster.
+func (u *Tracker) CountByCluster() map[string]int {
+	u.RLock()
+	defer u.RUnlock()
+
+	result := make(map[string]int)
+	for _, mapping := range u.upstreamsByHost {
+		result[mapping.Cluster]++
+	}
+	return result
+}
+
+// Len returns the number of host mappings.
+func (u *Tracker) Len() int {
+	u.RLock()
+	defer u.RUnlock()
+	return len(u.upstreamsByHost)
+}
+
+// GetByWorkspaceNameAndPort returns the mapping of a single workspace port,
+// used when workspaces are routed by path instead of hostname.
+func (u *Tracker) GetByWorkspaceNameAndPort(name string, port int32) (*HostMapping, error) {
+	u.RLock()
+	defer u.RUnlock()
+	if val, ok := u.upstreamsByName[name][port]; ok {
 		return &val, nil
 	}
 
 	return nil, ErrNotFound
 }
 
+// Add stores the mapping of a workspace port. A mapping previously stored for
+// the same hostname, or for the same workspace port, is replaced when it
+// belongs to the same workspace. Otherwise the mapping is recorded as a
+// conflict.
 func (u *Tracker) Add(mapping HostMapping) {
 	u.Lock()
 	defer u.Unlock()
+
+	if owner, ok := u.conflictOwner("", mapping); ok {
+		u.addConflict("", mapping, owner, u.conflicts[""][mapping.Hostname])
+		return
+	}
+	u.add(mapping)
+}
+
+// Replace atomically swaps the mappings previously contributed by source for
+// mappings. Mappings of the source which are not part of the new set are
+// removed, an empty set removes the source.
+//
+// A hostname or workspace port already served for another workspace is not
+// taken over, the workspace which claimed it first keeps it. The conflicts
+// detected by this call are returned, conflicts which were already known
+// are not.
+func (u *Tracker) Replace(source string, mappings []HostMapping) []Conflict {
+	u.Lock()
+	defer u.Unlock()
+
+	previous := u.conflicts[source]
+	delete(u.conflicts, source)
+
+	var detected []Conflict
+	accepted := make([]HostMapping, 0, len(mappings))
+	claimed := make(map[string]HostMapping, len(mappings))
+	for _, mapping := range mappings {
+		owner, ok := u.conflictOwner(source, mapping)
+		if first, claimedByBatch := claimed[mapping.Hostname]; !ok && claimedByBatch && !sameWorkspace(first, mapping) {
+			owner, ok = first, true
+		}
+		if ok {
+			if conflict, isNew := u.addConflict(source, mapping, owner, previous[mapping.Hostname]); isNew {
+				detected = append(detected, conflict)
+			}
+			continue
+		}
+		claimed[mapping.Hostname] = mapping
+		accepted = append(accepted, mapping)
+	}
+	mappings = accepted
+
+	desired := make(map[string]bool, len(mappings))
+	for _, mapping := range mappings {
+		desired[mapping.Hostname] = true
+	}
+	u.removeSource(source, desired)
+
+	hostnames := make([]string, 0, len(mappings))
+	for _, mapping := range mappings {
+		u.add(mapping)
+		u.sourcesByHost[mapping.Hostname] = source
+		hostnames = append(hostnames, mapping.Hostname)
+	}
+	if len(hostnames) > 0 {
+		u.hostnamesBySource[source] = hostnames
+	}
+	u.resolveConflicts()
+	return detected
+}
+
+// DeleteSource removes every mapping contributed by source, including its
+// conflicts.
+func (u *Tracker) DeleteSource(source string) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.conflicts, source)
+	u.removeSource(source, nil)
+	u.resolveConflicts()
+}
+
+// removeSource removes the mappings of source except those whose hostname is
+// kept. The caller must hold the write lock.
+func (u *Tracker) removeSource(source string, keep map[string]bool) {
+	for _, hostname := range u.hostnamesBySource[source] {
+		// The hostname may have been taken over by another source since, kept
+		// hostnames are updated in place by add
+		if u.sourcesByHost[hostname] != source || keep[hostname] {
+			continue
+		}
+
+		mapping := u.upstreamsByHost[hostname]
+		u.remove(mapping)
+		u.logRemoved(mapping)
+		u.publish(Event{Type: EventRemoved, Before: &mapping})
+	}
+	delete(u.hostnamesBySource, source)
+}
+
+// add stores a mapping. The caller must hold the write lock.
+func (u *Tracker) add(mapping HostMapping) {
+	event := Event{Type: EventAdded, After: &mapping}
+	if previous, ok := u.upstreamsByHost[mapping.Hostname]; ok {
+		u.remove(previous)
+		switch {
+		case reflect.DeepEqual(previous, mapping):
+			// Periodic resyncs of the discovery source re-add unchanged mappings
+			event.Type = ""
+		case previous.WorkspaceName == mapping.WorkspaceName && previous.BackendPort == mapping.BackendPort:
+			event = Event{Type: EventUpdated, Before: &previous, After: &mapping}
+		default:
+			u.publish(Event{Type: EventRemoved, Before: &previous})
+		}
+	}
+	if previous, ok := u.upstreamsByName[mapping.WorkspaceName][mapping.BackendPort]; ok {
+		u.remove(previous)
+		u.publish(Event{Type: EventRemoved, Before: &previous})
+	}
+
 	u.upstreamsByHost[mapping.Hostname] = mapping
-	u.upstreamsByName[mapping.WorkspaceName] = mapping
+	ports, ok := u.upstreamsByName[mapping.WorkspaceName]
+	if !ok {
+		ports = make(map[int32]HostMapping)
+		u.upstreamsByName[mapping.WorkspaceName] = ports
+	}
+	ports[mapping.BackendPort] = mapping
+	if mapping.WorkspaceID != "" {
+		u.workspaceNamesByID[mapping.WorkspaceID] = mapping.WorkspaceName
+	}
 	u.logger.Info("host mapping added",
 		logz.HostMappingHostname(mapping.Hostname),
 		logz.HostMappingBackend(mapping.Backend),
 		logz.HostMappingBackendPort(mapping.BackendPort),
+		logz.HostMappingPortName(mapping.PortName),
 		logz.HostMappingBackendProtocol(mapping.BackendProtocol),
 		logz.WorkspaceName(mapping.WorkspaceName),
+		logz.Cluster(mapping.Cluster),
 	)
+	if event.Type != "" {
+		u.publish(event)
+	}
 }
 
 func (u *Tracker) DeleteByHostname(name string) {
 	u.Lock()
 	defer u.Unlock()
-	mapping := u.upstreamsByHost[name]
-	workspaceName := mapping.WorkspaceName
-	delete(u.upstreamsByName, workspaceName)
-	delete(u.upstreamsByHost, name)
+	mapping, ok := u.upstreamsByHost[name]
+	if !ok {
+		return
+	}
+
+	u.remove(mapping)
+	u.logRemoved(mapping)
+	u.publish(Event{Type: EventRemoved, Before: &mapping})
+	u.resolveConflicts()
+}
+
+func (u *Tracker) logRemoved(mapping HostMapping) {
 	u.logger.Info("host mapping removed",
 		logz.HostMappingHostname(mapping.Hostname),
 		logz.HostMappingBackend(mapping.Backend),
 		logz.HostMappingBackendPort(mapping.BackendPort),
 		logz.HostMappingBackendProtocol(mapping.BackendProtocol),
 		logz.WorkspaceName(mapping.WorkspaceName),
+		logz.Cluster(mapping.Cluster),
 	)
 }
+
+// remove drops a mapping from every index, the workspace is forgotten with
+// its last port. The caller must hold the write lock.
+func (u *Tracker) remove(mapping HostMapping) {
+	delete(u.upstreamsByHost, mapping.Hostname)
+	delete(u.sourcesByHost, mapping.Hostname)
+
+	ports := u.upstreamsByName[mapping.WorkspaceName]
+	delete(ports, mapping.BackendPort)
+	if len(ports) > 0 {
+		return
+	}
+
+	delete(u.upstreamsByName, mapping.WorkspaceName)
+	if u.workspaceNamesByID[mapping.WorkspaceID] == mapping.WorkspaceName {
+		delete(u.workspaceNamesByID, mapping.WorkspaceID)
+	}
+}
@@ -127,14 +127,272 @@ func TestUpstreamTrackerGetByName(t *testing.T) {
 				tracker.DeleteByHostname(e)
 			}
 
-			result, err := tracker.GetByWorkspaceName(tr.upstreamToFind)
+			result, err := tracker.GetWorkspaceByName(tr.upstreamToFind)
 			if tr.expectedError {
 				require.NotNil(t, err)
 				return
 			}
 
 			require.Nil(t, err)
-			require.Equal(t, tr.expectedWorkspaceName, result.WorkspaceName)
+			require.Equal(t, tr.expectedWorkspaceName, result.Name)
 		})
 	}
 }
+
+func TestUpstreamTrackerGetByNameAndPort(t *testing.T) {
+	tests := []struct {
+		description       string
+		nameToFind        string
+		portToFind        int32
+		upstreamsToAdd    []HostMapping
+		upstreamsToDelete []string
+		expectedError     bool
+		expectedHostName  string
+	}{
+		{
+			description:    "When no upstreams are present returns error",
+			nameToFind:     "test",
+			portToFind:     3000,
+			upstreamsToAdd: []HostMapping{},
+			expectedError:  true,
+		},
+		{
+			description: "When a workspace has several ports, returns the requested port",
+			nameToFind:  "test",
+			portToFind:  8080,
+			upstreamsToAdd: []HostMapping{
+				{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000},
+				{Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080},
+			},
+			expectedHostName: "8080-test",
+		},
+		{
+			description:    "When the port is not exposed by the workspace returns error",
+			nameToFind:     "test",
+			portToFind:     9000,
+			upstreamsToAdd: []HostMapping{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}},
+			expectedError:  true,
+		},
+		{
+			description:       "When upstream is deleted, cannot find that upstream",
+			nameToFind:        "test",
+			portToFind:        3000,
+			upstreamsToAdd:    []HostMapping{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}},
+			upstreamsToDelete: []string{"3000-test"},
+			expectedError:     true,
+		},
+	}
+
+	for _, tr := range tests {
+		tracker := NewTracker(zaptest.NewLogger(t))
+		t.Run(tr.description, func(t *testing.T) {
+			for _, e := range tr.upstreamsToAdd {
+				tracker.Add(e)
+			}
+
+			for _, e := range tr.upstreamsToDelete {
+				tracker.DeleteByHostname(e)
+			}
+
+			result, err := tracker.GetByWorkspaceNameAndPort(tr.nameToFind, tr.portToFind)
+			if tr.expectedError {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tr.expectedHostName, result.Hostname)
+		})
+	}
+}
+
+func TestUpstreamTrackerWorkspacePorts(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Add(HostMapping{Hostname: "8080-test", WorkspaceID: "1", WorkspaceName: "test", Backend: "test.ns", BackendPort: 8080, PortName: "editor", BackendProtocol: ProtocolHTTP})
+	tracker.Add(HostMapping{Hostname: "22-test", WorkspaceID: "1", WorkspaceName: "test", Backend: "test.ns", BackendPort: 22, PortName: "ssh", BackendProtocol: ProtocolHTTP})
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceID: "1", WorkspaceName: "test", Backend: "test.ns", BackendPort: 3000, BackendProtocol: ProtocolHTTPS})
+
+	expected := &Workspace{
+		ID:      "1",
+		Name:    "test",
+		Backend: "test.ns",
+		Ports: []Port{
+			{Name: "ssh", Number: 22, Protocol: ProtocolHTTP, Hostname: "22-test"},
+			{Number: 3000, Protocol: ProtocolHTTPS, Hostname: "3000-test"},
+			{Name: "editor", Number: 8080, Protocol: ProtocolHTTP, Hostname: "8080-test"},
+		},
+	}
+
+	tests := []struct {
+		description string
+		lookup      func() (*Workspace, error)
+	}{
+		{
+			description: "When looking up by name returns every port",
+			lookup:      func() (*Workspace, error) { return tracker.GetWorkspaceByName("test") },
+		},
+		{
+			description: "When looking up by ID returns every port",
+			lookup:      func() (*Workspace, error) { return tracker.GetWorkspaceByID("1") },
+		},
+		{
+			description: "When looking up by the hostname of one port returns every port",
+			lookup:      func() (*Workspace, error) { return tracker.GetWorkspaceByHostname("3000-test") },
+		},
+	}
+
+	for _, tr := range tests {
+		t.Run(tr.description, func(t *testing.T) {
+			result, err := tr.lookup()
+			require.Nil(t, err)
+			require.Equal(t, expected, result)
+		})
+	}
+
+	port, ok := expected.PortByName("ssh")
+	require.True(t, ok)
+	require.Equal(t, int32(22), port.Number)
+
+	tracker.DeleteByHostname("8080-test")
+	result, err := tracker.GetWorkspaceByID("1")
+	require.Nil(t, err)
+	require.Len(t, result.Ports, 2)
+
+	tracker.DeleteByHostname("22-test")
+	tracker.DeleteByHostname("3000-test")
+	_, err = tracker.GetWorkspaceByID("1")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = tracker.GetWorkspaceByName("test")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestUpstreamTrackerReplacesPort(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Add(HostMapping{Hostname: "3000-old", WorkspaceName: "test", BackendPort: 3000})
+	tracker.Add(HostMapping{Hostname: "3000-new", WorkspaceName: "test", BackendPort: 3000})
+
+	_, err := tracker.GetByHostname("3000-old")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	result, err := tracker.GetByWorkspaceNameAndPort("test", 3000)
+	require.Nil(t, err)
+	require.Equal(t, "3000-new", result.Hostname)
+	require.Equal(t, 1, tracker.Len())
+}
+
+func TestUpstreamTrackerReplace(t *testing.T) {
+	tests := []struct {
+		description       string
+		replacements      [][]HostMapping
+		deleteSource      bool
+		expectedHostnames []string
+	}{
+		{
+			description: "When a service is added, all of its ports are mapped",
+			replacements: [][]HostMapping{
+				{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}, {Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080}},
+			},
+			expectedHostnames: []string{"3000-test", "8080-test"},
+		},
+		{
+			description: "When a port is removed on update, its mapping is pruned",
+			replacements: [][]HostMapping{
+				{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}, {Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080}},
+				{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}},
+			},
+			expectedHostnames: []string{"3000-test"},
+		},
+		{
+			description: "When the hostnames change on update, the previous hostnames are pruned",
+			replacements: [][]HostMapping{
+				{{Hostname: "3000-old", WorkspaceName: "test", BackendPort: 3000}},
+				{{Hostname: "3000-new", WorkspaceName: "test", BackendPort: 3000}},
+			},
+			expectedHostnames: []string{"3000-new"},
+		},
+		{
+			description: "When a service is deleted, none of its ports stay mapped",
+			replacements: [][]HostMapping{
+				{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}, {Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080}},
+			},
+			deleteSource:      true,
+			expectedHostnames: []string{},
+		},
+	}
+
+	for _, tr := range tests {
+		t.Run(tr.description, func(t *testing.T) {
+			tracker := NewTracker(zaptest.NewLogger(t))
+			tracker.Add(HostMapping{Hostname: "3000-other", WorkspaceName: "other", BackendPort: 3000})
+
+			for _, mappings := range tr.replacements {
+				tracker.Replace("uid-1", mappings)
+			}
+			if tr.deleteSource {
+				tracker.DeleteSource("uid-1")
+			}
+
+			hostnames := []string{}
+			for _, mapping := range tracker.List() {
+				if mapping.WorkspaceName == "test" {
+					hostnames = append(hostnames, mapping.Hostname)
+				}
+			}
+			require.Equal(t, tr.expectedHostnames, hostnames)
+
+			_, err := tracker.GetByHostname("3000-other")
+			require.Nil(t, err)
+		})
+	}
+}
+
+func TestUpstreamTrackerReplaceKeepsTakenOverHostname(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Replace("uid-1", []HostMapping{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}})
+	// The service was recreated under a new UID before the old one was deleted
+	tracker.Replace("uid-2", []HostMapping{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000}})
+	tracker.DeleteSource("uid-1")
+
+	_, err := tracker.GetByHostname("3000-test")
+	require.Nil(t, err)
+}
+
+func TestUpstreamTrackerReplaceAcrossClusters(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Replace("east/uid-1", []HostMapping{{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000, Cluster: "east"}})
+	tracker.Replace("west/uid-1", []HostMapping{
+		{Hostname: "3000-test", WorkspaceName: "other", BackendPort: 3000, Cluster: "west"},
+		{Hostname: "3000-other", WorkspaceName: "test", BackendPort: 3000, Cluster: "west"},
+		{Hostname: "8080-other", WorkspaceName: "other", BackendPort: 8080, Cluster: "west"},
+	})
+
+	mapping, err := tracker.GetByHostname("3000-test")
+	require.Nil(t, err)
+	require.Equal(t, "east", mapping.Cluster)
+
+	_, err = tracker.GetByHostname("3000-other")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.Equal(t, map[string]int{"east": 1, "west": 1}, tracker.CountByCluster())
+}
+
+func TestHostMappingAddress(t *testing.T) {
+	mapping := HostMapping{Backend: "workspace1.gl-workspaces", BackendPort: 3000}
+	require.Equal(t, "workspace1.gl-workspaces:3000", mapping.PickAddress())
+
+	mapping.Endpoints = []string{"10.0.0.1:3000", "10.0.0.2:3000"}
+	require.Contains(t, mapping.Endpoints, mapping.PickAddress())
+}
+
+func TestUpstreamTrackerCountByReadiness(t *testing.T) {
+	tracker := NewTracker(zaptest.NewLogger(t))
+	tracker.Add(HostMapping{Hostname: "3000-test", WorkspaceName: "test", BackendPort: 3000, Readiness: ReadinessReady})
+	tracker.Add(HostMapping{Hostname: "8080-test", WorkspaceName: "test", BackendPort: 8080, Readiness: ReadinessNotReady})
+	tracker.Add(HostMapping{Hostname: "3000-static", WorkspaceName: "static", BackendPort: 3000})
+
+	require.Equal(t, map[Readiness]int{
+		ReadinessReady:    1,
+		ReadinessNotReady: 1,
+		ReadinessUnknown:  1,
+	}, tracker.CountByReadiness())
+}
@@ -0,0 +1,63 @@
+package upstream
+
+import "sort"
+
+// Workspace is a workspace service together with every port it exposes.
+type Workspace struct {
+	ID        string
+	Name      string
+	Namespace string
+	Cluster   string
+	Backend   string
+	// Ports are ordered by number
+	Ports []Port
+}
+
+// Port is a single port of a workspace service and the hostname it is served on.
+type Port struct {
+	Name     string
+	Number   int32
+	Protocol string
+	Hostname string
+}
+
+// PortByNumber returns the port with the given number.
+func (w *Workspace) PortByNumber(number int32) (*Port, bool) {
+	for i := range w.Ports {
+		if w.Ports[i].Number == number {
+			return &w.Ports[i], true
+		}
+	}
+	return nil, false
+}
+
+// PortByName returns the port with the given service port name.
+func (w *Workspace) PortByName(name string) (*Port, bool) {
+	for i := range w.Ports {
+		if name != "" && w.Ports[i].Name == name {
+			return &w.Ports[i], true
+		}
+	}
+	return nil, false
+}
+
+func newWorkspace(mappings map[int32]HostMapping) *Workspace {
+	var workspace Workspace
+	for _, mapping := range mappings {
+		workspace.ID = mapping.WorkspaceID
+		workspace.Name = mapping.WorkspaceName
+		workspace.Namespace = mapping.Namespace
+		workspace.Cluster = mapping.Cluster
+		workspace.Backend = mapping.Backend
+		workspace.Ports = append(workspace.Ports, Port{
+			Name:     mapping.PortName,
+			Number:   mapping.BackendPort,
+			Protocol: mapping.BackendProtocol,
+			Hostname: mapping.Hostname,
+		})
+	}
+	sort.Slice(workspace.Ports, func(i, j int) bool {
+		return workspace.Ports[i].Number < workspace.Ports[j].Number
+	})
+	return &workspace
+}